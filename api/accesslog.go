@@ -0,0 +1,110 @@
+package api
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/brasilcep/api/apikeys"
+	"github.com/brasilcep/api/tracing"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// maskedValue replaces the values of masked query parameters.
+const maskedValue = "REDACTED"
+
+// accessLog writes one log line per request to the "access" logger.
+type accessLog struct {
+	logger      *zap.Logger
+	sampleRatio float64
+	exclude     []string
+	masked      []string
+}
+
+// newAccessLog builds the access log from api.access_log.*. The API key
+// query parameter is always masked.
+func (api *API) newAccessLog() *accessLog {
+	masked := api.config.GetStringSlice("api.access_log.masked_query_params")
+	if param := api.config.GetString("api.keys.query_param"); param != "" {
+		masked = append(masked, param)
+	}
+	return &accessLog{
+		logger:      api.logger.Named("access"),
+		sampleRatio: api.config.GetFloat64("api.access_log.sample_ratio"),
+		exclude:     api.config.GetStringSlice("api.access_log.exclude_paths"),
+		masked:      masked,
+	}
+}
+
+// middleware logs the request once the response was written. Server errors
+// are always logged, at warn level; other requests are sampled.
+func (l *accessLog) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		for _, pattern := range l.exclude {
+			if matchRoute(pattern, req.URL.Path) {
+				return next(c)
+			}
+		}
+
+		start := time.Now()
+		err := handleError(c, next(c))
+
+		res := c.Response()
+		if res.Status < http.StatusInternalServerError && l.sampleRatio < 1 && rand.Float64() >= l.sampleRatio {
+			return nil
+		}
+
+		fields := []zap.Field{
+			zap.String("method", req.Method),
+			zap.String("path", req.URL.Path),
+			zap.Int("status", res.Status),
+			zap.Duration("latency", time.Since(start)),
+			zap.Int64("bytes", res.Size),
+			zap.String("request_id", res.Header().Get(echo.HeaderXRequestID)),
+			zap.String("client_ip", c.RealIP()),
+		}
+		if route := c.Path(); route != "" {
+			fields = append(fields, zap.String("route", route))
+		}
+		if req.URL.RawQuery != "" {
+			fields = append(fields, zap.String("query", l.maskQuery(req.URL.Query())))
+		}
+		if key, ok := c.Get(apiKeyContextKey).(*apikeys.Key); ok {
+			fields = append(fields, zap.String("api_key", key.Name))
+		}
+		if cep := c.Param("cep"); cep != "" {
+			fields = append(fields, zap.String("cep", strings.ReplaceAll(cep, "-", "")))
+		}
+		if err != nil && res.Status >= http.StatusInternalServerError {
+			fields = append(fields, zap.Error(err))
+		}
+		fields = append(fields, tracing.Fields(req.Context())...)
+
+		if res.Status >= http.StatusInternalServerError {
+			l.logger.Warn("Request", fields...)
+		} else {
+			l.logger.Info("Request", fields...)
+		}
+		return nil
+	}
+}
+
+// maskQuery encodes query with the values of the masked parameters
+// replaced; "*" masks every parameter.
+func (l *accessLog) maskQuery(query url.Values) string {
+	all := slices.Contains(l.masked, "*")
+	for name, values := range query {
+		if !all && !slices.Contains(l.masked, name) {
+			continue
+		}
+		for n := range values {
+			values[n] = maskedValue
+		}
+	}
+	return query.Encode()
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/brasilcep/api/apikeys"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// setupAccessLog returns a handler logging requests with the given
+// settings, and the logged entries.
+func setupAccessLog(t *testing.T, settings map[string]any) (*echo.Echo, *observer.ObservedLogs) {
+	t.Helper()
+	api := newTestAPI(t, settings)
+	logs := observeLogs(api)
+
+	e := echo.New()
+	e.IPExtractor = echo.ExtractIPDirect()
+	e.Use(middleware.RequestID())
+	e.Use(api.newAccessLog().middleware)
+	e.GET("/cep/:cep", func(c echo.Context) error {
+		c.Set(apiKeyContextKey, &apikeys.Key{Name: "parceiro"})
+		return c.String(http.StatusOK, "ok")
+	})
+	e.GET("/ceps", func(c echo.Context) error { return c.String(http.StatusOK, "ok") })
+	e.GET("/falha", func(c echo.Context) error { return errors.New("store closed") })
+	e.GET("/metrics", func(c echo.Context) error { return c.String(http.StatusOK, "") })
+	e.GET("/health/live", func(c echo.Context) error { return c.String(http.StatusOK, "ok") })
+	return e, logs
+}
+
+func TestAccessLogFields(t *testing.T) {
+	e, logs := setupAccessLog(t, map[string]any{})
+
+	rec := requestFrom(e, "203.0.113.1", "/cep/01001-000")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	entries := logs.FilterMessage("Request").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "access", entries[0].LoggerName)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, "GET", fields["method"])
+	assert.Equal(t, "/cep/01001-000", fields["path"])
+	assert.Equal(t, "/cep/:cep", fields["route"])
+	assert.EqualValues(t, http.StatusOK, fields["status"])
+	assert.EqualValues(t, 2, fields["bytes"])
+	assert.Equal(t, "203.0.113.1", fields["client_ip"])
+	assert.Equal(t, "parceiro", fields["api_key"])
+	assert.Equal(t, "01001000", fields["cep"])
+	assert.Equal(t, rec.Header().Get(echo.HeaderXRequestID), fields["request_id"])
+	assert.Contains(t, fields, "latency")
+	assert.NotContains(t, fields, "query")
+}
+
+func TestAccessLogMasking(t *testing.T) {
+	e, logs := setupAccessLog(t, map[string]any{"api.access_log.masked_query_params": []string{"email"}})
+
+	requestFrom(e, "203.0.113.1", "/ceps?uf=SP&email=ana@example.com&api_key=bcep_segredo")
+
+	entries := logs.FilterMessage("Request").All()
+	require.Len(t, entries, 1)
+	query, err := url.ParseQuery(entries[0].ContextMap()["query"].(string))
+	require.NoError(t, err)
+	assert.Equal(t, "SP", query.Get("uf"))
+	assert.Equal(t, maskedValue, query.Get("email"))
+	assert.Equal(t, maskedValue, query.Get("api_key"), "the API key parameter is always masked")
+
+	t.Run("every parameter", func(t *testing.T) {
+		e, logs := setupAccessLog(t, map[string]any{"api.access_log.masked_query_params": []string{"*"}})
+		requestFrom(e, "203.0.113.1", "/ceps?uf=SP&cidade=Santos")
+
+		query, err := url.ParseQuery(logs.All()[0].ContextMap()["query"].(string))
+		require.NoError(t, err)
+		assert.Equal(t, url.Values{"uf": {maskedValue}, "cidade": {maskedValue}}, query)
+	})
+}
+
+func TestAccessLogExclusionsAndSampling(t *testing.T) {
+	e, logs := setupAccessLog(t, map[string]any{"api.access_log.sample_ratio": 0.0})
+
+	for _, path := range []string{"/metrics", "/health/live", "/ceps", "/cep/01001000"} {
+		requestFrom(e, "203.0.113.1", path)
+	}
+	assert.Zero(t, logs.Len(), "excluded and unsampled requests are not logged")
+
+	rec := requestFrom(e, "203.0.113.1", "/falha")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	entries := logs.All()
+	require.Len(t, entries, 1, "server errors are always logged")
+	assert.Equal(t, "warn", entries[0].Level.String())
+	assert.Equal(t, "store closed", entries[0].ContextMap()["error"])
+}
+
+func TestAccessLogHandlesErrorsOnce(t *testing.T) {
+	e, logs := setupAccessLog(t, map[string]any{})
+	e.Use(traceRequests)
+	handled := 0
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		handled++
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+	}
+
+	rec := requestFrom(e, "203.0.113.1", "/falha")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, 1, handled, "the error handler runs once")
+	assert.JSONEq(t, `{"error": "store closed"}`, rec.Body.String(), "one response body")
+	entries := logs.FilterMessage("Request").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "store closed", entries[0].ContextMap()["error"])
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/brasilcep/api/apikeys"
+	"github.com/brasilcep/api/database"
+	"github.com/labstack/echo-contrib/echoprometheus"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.uber.org/zap"
+)
+
+// newAdmin returns the internal server with metrics, profiling and admin
+// routes, kept off the public listeners and their rate limits, API keys
+// and CORS. Health checks stay open for probes; everything else requires
+// one of api.admin.tokens when set. Without tokens only the health checks
+// and metrics are served: profiling and managing keys are too dangerous to
+// leave open on a port that may be reachable.
+func (api *API) newAdmin(keyAuth *apiKeyAuth, dispatcher *WebhookDispatcher) *echo.Echo {
+	admin := echo.New()
+	admin.HideBanner = true
+	admin.HidePort = true
+	admin.IPExtractor = api.echo.IPExtractor
+
+	admin.Use(middleware.Recover())
+	admin.Use(middleware.RequestID())
+
+	admin.GET("/health/live", api.live)
+	admin.GET("/health/ready", api.ready)
+
+	tokens := api.config.GetStringSlice("api.admin.tokens")
+	protected := admin.Group("")
+	if len(tokens) > 0 {
+		protected.Use(bearerAuth(tokens))
+	}
+
+	if api.config.GetBool("api.prometheus.enable") {
+		protected.GET("/metrics", echoprometheus.NewHandler())
+	}
+
+	if len(tokens) == 0 {
+		if api.config.GetBool("api.admin.pprof") || keyAuth != nil || dispatcher != nil {
+			api.logger.Warn("Set api.admin.tokens to serve pprof and the /admin routes on the admin server")
+		}
+		return admin
+	}
+
+	if api.config.GetBool("api.admin.pprof") {
+		protected.GET("/debug/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+		protected.GET("/debug/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+		protected.Any("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+		protected.GET("/debug/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+		protected.GET("/debug/pprof/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+		protected.GET("/debug/vars", echo.WrapHandler(expvar.Handler()))
+	}
+
+	if keyAuth != nil {
+		protected.GET("/admin/apikeys", keyAuth.listAPIKeys)
+		protected.POST("/admin/apikeys", keyAuth.createAPIKey)
+		protected.DELETE("/admin/apikeys/:name", keyAuth.revokeAPIKey)
+	}
+
+	if dispatcher != nil {
+		protected.GET("/admin/webhooks/failed", dispatcher.failedWebhooks)
+	}
+
+	return admin
+}
+
+// listAPIKeys returns the limits and usage of every API key.
+func (a *apiKeyAuth) listAPIKeys(c echo.Context) error {
+	now := time.Now()
+	keys := a.registry.Keys()
+	response := make([]APIKeyUsageResponse, 0, len(keys))
+	for n := range keys {
+		usage, err := a.registry.Usage(&keys[n], now)
+		if err != nil {
+			return err
+		}
+		response = append(response, a.usageResponse(&keys[n], usage))
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// CreateAPIKeyRequest is the body of POST /admin/apikeys. Zero limits use
+// the defaults and zero quotas are unlimited.
+type CreateAPIKeyRequest struct {
+	Name         string  `json:"name"`
+	RateLimit    float64 `json:"rate_limit"`
+	Burst        int     `json:"burst"`
+	DailyQuota   int64   `json:"daily_quota"`
+	MonthlyQuota int64   `json:"monthly_quota"`
+}
+
+// CreateAPIKeyResponse carries the secret of a new key, which is only
+// returned once.
+type CreateAPIKeyResponse struct {
+	APIKeyUsageResponse
+	Key string `json:"key"`
+}
+
+// createAPIKey stores a new key and starts accepting it right away. Keys
+// are kept in the database of this replica only; replicas share keys
+// through api.keys.file.
+func (a *apiKeyAuth) createAPIKey(c echo.Context) error {
+	var req CreateAPIKeyRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "corpo inválido"})
+	}
+	if req.Name == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "nome da chave é obrigatório"})
+	}
+	if req.RateLimit < 0 || req.Burst < 0 || req.DailyQuota < 0 || req.MonthlyQuota < 0 {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "limites e cotas não podem ser negativos"})
+	}
+	// Keys of api.keys.file are not in the store, which only checks its own.
+	if a.registry.Has(req.Name) {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "já existe uma chave com esse nome"})
+	}
+
+	key := apikeys.Key{
+		Name:         req.Name,
+		RateLimit:    req.RateLimit,
+		Burst:        req.Burst,
+		DailyQuota:   req.DailyQuota,
+		MonthlyQuota: req.MonthlyQuota,
+	}
+	secret, err := apikeys.Create(database.GetDB(), key)
+	if errors.Is(err, apikeys.ErrDuplicateName) {
+		return c.JSON(http.StatusConflict, ErrorResponse{Error: "já existe uma chave com esse nome"})
+	}
+	if err != nil {
+		return err
+	}
+	if err := a.reload(); err != nil {
+		return err
+	}
+	a.logger.Info("API key created", zap.String("name", key.Name))
+
+	return c.JSON(http.StatusCreated, CreateAPIKeyResponse{
+		APIKeyUsageResponse: a.usageResponse(&key, apikeys.Usage{}),
+		Key:                 secret,
+	})
+}
+
+// revokeAPIKey deletes a key of the store, resets its quota counters and
+// stops accepting it right away. Keys of api.keys.file are removed from the
+// file instead.
+func (a *apiKeyAuth) revokeAPIKey(c echo.Context) error {
+	name := c.Param("name")
+	found, err := apikeys.Revoke(database.GetDB(), name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "chave não encontrada"})
+	}
+	if err := a.reload(); err != nil {
+		return err
+	}
+	if err := a.registry.Forget(name, time.Now()); err != nil {
+		return err
+	}
+	a.logger.Info("API key revoked", zap.String("name", name))
+	return c.NoContent(http.StatusNoContent)
+}
+
+// failedWebhooks returns the webhook batches given up on.
+func (d *WebhookDispatcher) failedWebhooks(c echo.Context) error {
+	failures, err := d.Failures()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, failures)
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brasilcep/api/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminDefaults(t *testing.T) {
+	api := newTestAPI(t, map[string]any{})
+	assert.Equal(t, []string{"127.0.0.1:9091"}, api.config.GetStringSlice("api.admin.listeners"))
+	assert.Empty(t, api.config.GetStringSlice("api.admin.tokens"))
+}
+
+func TestAdminWithoutTokens(t *testing.T) {
+	api := newTestAPI(t, map[string]any{"api.keys.enable": true})
+	openTestDatabase(t, api.config)
+	keyAuth, err := api.newAPIKeyAuth(ratelimit.NewMemoryStore())
+	require.NoError(t, err)
+	admin := api.newAdmin(keyAuth, nil)
+
+	assert.Equal(t, http.StatusOK, doRequest(admin, http.MethodGet, "/health/live", "").Code)
+	assert.Equal(t, http.StatusOK, doRequest(admin, http.MethodGet, "/metrics", "").Code)
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/vars", "/admin/apikeys"} {
+		assert.Equal(t, http.StatusNotFound, doRequest(admin, http.MethodGet, path, "").Code, path)
+	}
+}
+
+func TestAdminWithTokens(t *testing.T) {
+	api := newTestAPI(t, map[string]any{"api.admin.tokens": []string{"segredo"}})
+	admin := api.newAdmin(nil, nil)
+
+	assert.Equal(t, http.StatusOK, doRequest(admin, http.MethodGet, "/health/live", "").Code, "probes need no token")
+	for _, path := range []string{"/metrics", "/debug/pprof/cmdline", "/debug/vars"} {
+		assert.Equal(t, http.StatusUnauthorized, doRequest(admin, http.MethodGet, path, "").Code, path)
+
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer segredo")
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code, path)
+	}
+}
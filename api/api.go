@@ -1,22 +1,27 @@
 package api
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/brasilcep/api/database"
 	"github.com/brasilcep/api/logger"
+	"github.com/brasilcep/api/ratelimit"
 	"github.com/brasilcep/api/zipcodes"
 	"github.com/dgraph-io/badger/v4"
+	"github.com/labstack/echo-contrib/echoprometheus"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
-	"golang.org/x/time/rate"
 )
 
 type API struct {
@@ -24,6 +29,13 @@ type API struct {
 	logger    *logger.Logger
 	echo      *echo.Echo
 	buildInfo BuildInfo
+
+	// streams counts the bulk downloads reading the store, which Listen
+	// waits for before returning. Once streamsClosed is set no download
+	// starts, so the wait can not race with a new one.
+	streams       sync.WaitGroup
+	streamsMu     sync.Mutex
+	streamsClosed bool
 }
 
 type BuildInfo struct {
@@ -46,9 +58,24 @@ func NewAPI(config *viper.Viper, logger *logger.Logger, buildInfo BuildInfo) *AP
 	}
 }
 
-func (api *API) Listen() {
+// Listen serves the API until ctx is cancelled, then stops accepting
+// connections and waits up to api.shutdown_timeout_seconds for in-flight
+// requests and background workers (webhooks, API key usage) to finish.
+// Requests still running after that are cancelled, and Listen only returns
+// once the bulk downloads stopped reading the store.
+func (api *API) Listen(ctx context.Context) error {
 	e := api.echo
 
+	workers, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+	var background sync.WaitGroup
+
+	extractor, err := api.ipExtractor()
+	if err != nil {
+		return err
+	}
+	e.IPExtractor = extractor
+
 	e.Pre(middleware.RemoveTrailingSlash())
 
 	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
@@ -77,34 +104,62 @@ func (api *API) Listen() {
 	}
 
 	e.Use(middleware.Recover())
+	if api.config.GetBool("tracing.enable") {
+		e.Use(traceRequests)
+	}
 	e.Use(middleware.RequestID())
+	if api.config.GetBool("api.access_log.enable") {
+		e.Use(api.newAccessLog().middleware)
+	}
 
 	enableRateLimit := api.config.GetBool("api.rate.limit.enable")
+	enableKeys := api.config.GetBool("api.keys.enable")
+	webhookURLs := api.config.GetStringSlice("changes.webhooks.urls")
+
+	// The IP rate limits, API key limits and quotas and the webhook sender
+	// lease share one store, which makes them hold across the replicas when
+	// it is redis or file.
+	var store ratelimit.Store
+	if enableRateLimit || enableKeys || len(webhookURLs) > 0 {
+		if store, err = api.rateLimitStore(); err != nil {
+			return err
+		}
+		defer store.Close()
+	}
+
+	var keyAuth *apiKeyAuth
+	if enableKeys {
+		keyAuth, err = api.newAPIKeyAuth(store)
+		if err != nil {
+			return err
+		}
+		e.Use(keyAuth.middleware)
+
+		interval := time.Duration(api.config.GetInt("api.keys.flush_interval_seconds")) * time.Second
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			keyAuth.registry.Run(workers, interval, func(err error) {
+				api.logger.Error("Failed to save API key usage", zap.Error(err))
+			})
+		}()
+
+		if interval := time.Duration(api.config.GetInt("api.keys.reload_interval_seconds")) * time.Second; interval > 0 {
+			background.Add(1)
+			go func() {
+				defer background.Done()
+				keyAuth.runReload(workers, interval)
+			}()
+		}
+	}
 
 	if enableRateLimit {
 		api.logger.Debug("Rate limiting enabled")
-		rateLimit := api.config.GetInt("api.rate.limit.max_allowed_requests_per_window")
-		rateLimit_burst := api.config.GetInt("api.rate.limit.requests_burst")
-		ratelimit_expire := api.config.GetDuration("api.rate.limit.expire_minutes")
-
-		config := middleware.RateLimiterConfig{
-			Skipper: middleware.DefaultSkipper,
-			Store: middleware.NewRateLimiterMemoryStoreWithConfig(
-				middleware.RateLimiterMemoryStoreConfig{Rate: rate.Limit(rateLimit), Burst: rateLimit_burst, ExpiresIn: ratelimit_expire * time.Minute},
-			),
-			IdentifierExtractor: func(ctx echo.Context) (string, error) {
-				id := ctx.RealIP()
-				return id, nil
-			},
-			ErrorHandler: func(context echo.Context, err error) error {
-				return context.JSON(http.StatusForbidden, nil)
-			},
-			DenyHandler: func(context echo.Context, identifier string, err error) error {
-				return context.JSON(http.StatusTooManyRequests, nil)
-			},
+		limiter, err := api.newIPRateLimiter(store)
+		if err != nil {
+			return err
 		}
-
-		e.Use(middleware.RateLimiterWithConfig(config))
+		e.Use(limiter.middleware)
 	}
 
 	enablePrometheus := api.config.GetBool("api.prometheus.enable")
@@ -126,12 +181,17 @@ func (api *API) Listen() {
 	}))
 
 	e.GET("/cep/:cep", api.findZipcode)
+	e.GET("/cep/:cep/historico", api.history)
+	e.GET("/changes", api.changes)
+	e.GET("/ceps", api.listCEPs)
+	e.GET("/stats", api.stats)
+	e.GET("/stats/municipios", api.municipalityStats)
+	api.registerBulk()
 	e.GET("/healthcheck", api.health)
-
-	if api.logger.Level() <= zap.DebugLevel {
-		e.GET("/debug/list", api.list)
-		e.GET("/debug/count", api.count)
-		e.GET("/debug/stats", api.stats)
+	e.GET("/health/live", api.live)
+	e.GET("/health/ready", api.ready)
+	if keyAuth != nil {
+		e.GET(apiKeyUsagePath, keyAuth.apiKeyUsage)
 	}
 
 	if api.logger.Level() <= zap.InfoLevel {
@@ -145,16 +205,170 @@ func (api *API) Listen() {
 	fmt.Printf("compiler: %s\n", api.buildInfo.Compiler)
 	fmt.Printf("\n")
 
-	port := api.config.GetInt("api.port")
+	if stats, err := zipcodes.GetStats(database.GetDB()); err != nil || stats == nil {
+		api.logger.Warn("Stats not available, seed the database again to compute them", zap.Error(err))
+	} else {
+		api.logger.Info("Total CEPs in database loaded", zap.Int("total_ceps", stats.Total))
+	}
+
+	if err := api.checkDataset(); err != nil {
+		return err
+	}
+
+	tlsConfig, reloader, err := api.tlsConfig()
+	if err != nil {
+		return err
+	}
+	listeners, specs, err := api.listen(api.publicListeners(), tlsConfig != nil, tlsConfig)
+	if err != nil {
+		return err
+	}
+	// Cancelling requests stops the bulk downloads that outlive the
+	// shutdown timeout.
+	requests, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	public := &http.Server{Handler: e, BaseContext: func(net.Listener) context.Context { return requests }}
+	if tlsConfig != nil && !api.config.GetBool("api.tls.http2") {
+		public.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	servers := []servedListeners{{server: public, listeners: listeners}}
+
+	api.logger.Info("Starting HTTP server", zap.Int("listeners", len(listeners)))
+	for _, spec := range specs {
+		api.logger.Info(fmt.Sprintf("Listening on %s", spec))
+	}
+
+	var dispatcher *WebhookDispatcher
+	if len(webhookURLs) > 0 {
+		dispatcher = NewWebhookDispatcher(api.config, api.logger, database.GetDB(), store)
+	}
+
+	if api.config.GetBool("api.admin.enable") {
+		adminListeners, adminSpecs, err := api.listen(api.config.GetStringSlice("api.admin.listeners"), false, tlsConfig)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return err
+		}
+		servers = append(servers, servedListeners{server: &http.Server{Handler: api.newAdmin(keyAuth, dispatcher)}, listeners: adminListeners})
+		for _, spec := range adminSpecs {
+			api.logger.Info(fmt.Sprintf("Admin server listening on %s", spec))
+		}
+	} else if enablePrometheus {
+		e.GET("/metrics", echoprometheus.NewHandler())
+	}
+
+	if reloader != nil {
+		interval := time.Duration(api.config.GetInt("api.tls.reload_interval_seconds")) * time.Second
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			reloader.Run(workers, interval)
+		}()
+	}
+
+	if dispatcher != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			dispatcher.Run(workers)
+		}()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		<-workers.Done()
+		background.Wait()
+		close(stopped)
+	}()
+
+	serving := 0
+	for _, s := range servers {
+		serving += len(s.listeners)
+	}
+	serveErr := make(chan error, serving)
+	for _, s := range servers {
+		for _, ln := range s.listeners {
+			go func(server *http.Server, ln net.Listener) {
+				serveErr <- server.Serve(ln)
+			}(s.server, ln)
+		}
+	}
+
+	select {
+	case err := <-serveErr:
+		for _, s := range servers {
+			s.server.Close()
+		}
+		cancelRequests()
+		api.closeStreams()
+		stopWorkers()
+		<-stopped
+		return err
+	case <-ctx.Done():
+	}
 
-	api.logger.Info("Starting HTTP server", zap.Int("port", port))
-	api.logger.Info(fmt.Sprintf("Listening on :%d", port))
+	timeout := time.Duration(api.config.GetInt("api.shutdown_timeout_seconds")) * time.Second
+	api.logger.Info("Shutting down HTTP server", zap.Duration("timeout", timeout))
 
-	count, _ := count()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	api.logger.Info("Total CEPs in database loaded", zap.Int("total_ceps", count))
+	// The admin server keeps answering probes and scrapes while the public
+	// one drains.
+	err = public.Shutdown(shutdownCtx)
+	if err != nil {
+		// Closing the connections also unblocks handlers stuck writing to a
+		// slow client.
+		api.logger.Warn("Cancelling requests still running after the shutdown timeout", zap.Error(err))
+		public.Close()
+	}
+	cancelRequests()
+	api.closeStreams()
+	for _, s := range servers[1:] {
+		if adminErr := s.server.Shutdown(shutdownCtx); err == nil {
+			err = adminErr
+		}
+	}
+	stopWorkers()
+	select {
+	case <-stopped:
+	case <-shutdownCtx.Done():
+		api.logger.Warn("Background workers did not stop before the shutdown timeout")
+	}
+	if err != nil {
+		return err
+	}
+	for range serving {
+		if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
 
-	e.Logger.Fatal(e.Start(fmt.Sprintf(":%d", port)))
+	api.logger.Info("HTTP server stopped")
+	return nil
+}
+
+// checkDataset warns when the last seed did not finish, or returns an error
+// refusing to start when api.require_complete_dataset is set.
+func (api *API) checkDataset() error {
+	info, err := zipcodes.GetDatasetInfo(database.GetDB())
+	if err != nil {
+		api.logger.Error("Failed to read dataset metadata", zap.Error(err))
+		return nil
+	}
+
+	switch {
+	case info == nil:
+		api.logger.Warn("No dataset metadata found, the database may be empty or seeded by an older version")
+	case !info.Complete() && api.config.GetBool("api.require_complete_dataset"):
+		return fmt.Errorf("dataset import of %s started at %s did not finish, refusing to serve partial data", info.Source, info.StartedAt.Format(time.RFC3339))
+	case !info.Complete():
+		api.logger.Warn("Dataset import did not finish, serving partial data", zap.String("source", info.Source), zap.Time("started_at", info.StartedAt))
+	default:
+		api.logger.Info("Dataset loaded", zap.String("source", info.Source), zap.Time("completed_at", info.CompletedAt))
+	}
+	return nil
 }
 
 func (api *API) findZipcode(c echo.Context) error {
@@ -162,11 +376,18 @@ func (api *API) findZipcode(c echo.Context) error {
 	cep = strings.ReplaceAll(cep, "-", "")
 
 	if cep == "" {
+		observeLookup(lookupInvalid, nil)
 		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "CEP não fornecido"})
 	}
 
 	c.Response().Header().Set("X-Served-From", "Brasil CEP API")
 
+	// Nothing but eight digits can be stored, so skip the read.
+	if !validCEP(cep) {
+		observeLookup(lookupInvalid, nil)
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "CEP não encontrado"})
+	}
+
 	var endereco zipcodes.CEPCompleto
 
 	db := database.GetDB()
@@ -175,175 +396,125 @@ func (api *API) findZipcode(c echo.Context) error {
 		return c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "database not ready"})
 	}
 
-	err := db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("cep:" + cep))
-		if err != nil {
+	if asOf := c.QueryParam("data"); asOf != "" {
+		if handled, err := api.findZipcodeAt(c, db, cep, asOf); handled {
 			return err
 		}
+	}
 
-		return item.Value(func(val []byte) error {
-			return json.Unmarshal(val, &endereco)
+	err := read(c.Request().Context(), "cep", func() error {
+		return db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte("cep:" + cep))
+			if err != nil {
+				return err
+			}
+
+			return item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &endereco)
+			})
 		})
 	})
 
 	if err == badger.ErrKeyNotFound {
+		observeLookup(lookupNotFound, nil)
 		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "CEP não encontrado"})
 	}
 
 	if err != nil {
-		api.logger.Error("Erro ao buscar CEP", zap.String("cep", cep), zap.Error(err))
+		api.requestLogger(c).Error("Erro ao buscar CEP", zap.String("cep", cep), zap.Error(err))
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Erro ao buscar CEP"})
 	}
 
+	observeLookup(lookupFound, &endereco)
 	return c.JSON(http.StatusOK, endereco)
 }
 
-func (api *API) health(c echo.Context) error {
-	resp := struct {
-		Status  string `json:"status"`
-		Version string `json:"version"`
-		Commit  string `json:"commit"`
-		Repo    string `json:"repo"`
-	}{
-		Status:  "ok",
-		Version: api.buildInfo.Version,
-		Commit:  api.buildInfo.Commit,
-		Repo:    api.buildInfo.Repo,
-	}
-
-	return c.JSON(http.StatusOK, resp)
-}
-
-func (api *API) list(c echo.Context) error {
-	limit := 100                     // Limite por página
-	prefix := c.QueryParam("prefix") // Ex: ?prefix=01310
-
-	db := database.GetDB()
-
-	var ceps []map[string]interface{}
-
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		searchPrefix := []byte("cep:")
-		if prefix != "" {
-			searchPrefix = []byte("cep:" + prefix)
-		}
-
-		count := 0
-		for it.Seek(searchPrefix); it.ValidForPrefix(searchPrefix) && count < limit; it.Next() {
-			item := it.Item()
-			key := string(item.Key())
-
-			err := item.Value(func(val []byte) error {
-				var data map[string]interface{}
-				if err := json.Unmarshal(val, &data); err != nil {
-					return err
-				}
-				data["_key"] = strings.TrimPrefix(key, "cep:")
-				ceps = append(ceps, data)
-				return nil
-			})
-
-			if err != nil {
-				log.Printf("Erro ao ler valor: %v", err)
-			}
-
-			count++
+func validCEP(cep string) bool {
+	if len(cep) != 8 {
+		return false
+	}
+	for _, r := range cep {
+		if r < '0' || r > '9' {
+			return false
 		}
-		return nil
-	})
-
-	if err != nil {
-		log.Printf("Erro: %v", err)
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Erro ao listar CEPs"})
 	}
-
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"total": len(ceps),
-		"data":  ceps,
-	})
+	return true
 }
 
-func (api *API) count(c echo.Context) error {
-
-	count, err := count()
-
+// findZipcodeAt serves the version of cep valid at the date asOf. It does
+// not handle CEPs without history, which are served from the current record.
+func (api *API) findZipcodeAt(c echo.Context, db *badger.DB, cep, asOf string) (bool, error) {
+	at, err := time.Parse(zipcodes.ReleaseDateLayout, asOf)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Erro ao contar CEPs"})
+		observeLookup(lookupInvalid, nil)
+		return true, c.JSON(http.StatusBadRequest, ErrorResponse{Error: "data inválida, use o formato AAAA-MM-DD"})
 	}
-
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"total_ceps": count,
-	})
-}
-
-func count() (int, error) {
-	var count int
-	db := database.GetDB()
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false // Não precisa dos valores, só contar
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		prefix := []byte("cep:")
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			count++
-		}
-		return nil
+	// The whole day counts, so a release imported that day is included.
+	at = at.Add(24*time.Hour - time.Nanosecond)
+
+	var version *zipcodes.CEPVersion
+	var ok bool
+	err = read(c.Request().Context(), "cep_at", func() (err error) {
+		version, ok, err = zipcodes.GetCEPAt(db, cep, at)
+		return err
 	})
 	if err != nil {
-		return 0, err
+		api.requestLogger(c).Error("Erro ao buscar histórico do CEP", zap.String("cep", cep), zap.Error(err))
+		return true, c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Erro ao buscar CEP"})
+	}
+	if !ok {
+		return false, nil
+	}
+	if version == nil {
+		observeLookup(lookupNotFound, nil)
+		return true, c.JSON(http.StatusNotFound, ErrorResponse{Error: "CEP não encontrado nesta data"})
 	}
+	observeLookup(lookupFound, version.Data)
 
-	return count, nil
+	c.Response().Header().Set("X-Valid-From", version.ValidFrom.Format(time.RFC3339))
+	return true, c.JSON(http.StatusOK, version.Data)
 }
 
-func (api *API) stats(c echo.Context) error {
-	db := database.GetDB()
-
-	stats := make(map[string]interface{})
-
-	// Estatísticas por UF
-	ufs := make(map[string]int)
-	totalCEPs := 0
-
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		prefix := []byte("cep:")
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
+// history lists every known version of a CEP, oldest first.
+func (api *API) history(c echo.Context) error {
+	cep := strings.ReplaceAll(c.Param("cep"), "-", "")
+	if cep == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "CEP não fornecido"})
+	}
 
-			err := item.Value(func(val []byte) error {
-				var cep zipcodes.CEPCompleto
-				if err := json.Unmarshal(val, &cep); err != nil {
-					return err
-				}
-				ufs[cep.UF]++
-				totalCEPs++
-				return nil
-			})
+	db := database.GetDB()
+	if db == nil {
+		return c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "database not ready"})
+	}
 
-			if err != nil {
-				log.Printf("Erro: %v", err)
-			}
-		}
-		return nil
+	var versions []zipcodes.CEPVersion
+	err := read(c.Request().Context(), "history", func() (err error) {
+		versions, err = zipcodes.GetHistory(db, cep)
+		return err
 	})
-
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Erro ao gerar estatísticas"})
+		api.requestLogger(c).Error("Erro ao buscar histórico do CEP", zap.String("cep", cep), zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Erro ao buscar histórico"})
+	}
+	if len(versions) == 0 {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Histórico não encontrado"})
 	}
 
-	stats["total_ceps"] = totalCEPs
-	stats["por_uf"] = ufs
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"cep":     cep,
+		"versoes": versions,
+	})
+}
 
-	return c.JSON(http.StatusOK, stats)
+// health is the original health check, kept for existing monitors. It now
+// reflects readiness; use /health/ready for the component details.
+func (api *API) health(c echo.Context) error {
+	status, _ := api.readiness()
+	code := http.StatusOK
+	if status == HealthUnavailable {
+		code = http.StatusServiceUnavailable
+	} else {
+		status = HealthOK
+	}
+	return c.JSON(code, api.healthResponse(status, nil))
 }
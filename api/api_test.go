@@ -0,0 +1,91 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brasilcep/api/config"
+	"github.com/brasilcep/api/database"
+	"github.com/brasilcep/api/logger"
+	"github.com/brasilcep/api/zipcodes"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+var testUFs = []string{
+	"AC", "AL", "AM", "AP", "BA", "CE", "DF", "ES", "GO", "MA", "MG", "MS", "MT", "PA",
+	"PB", "PE", "PI", "PR", "RJ", "RN", "RO", "RR", "RS", "SC", "SE", "SP", "TO",
+}
+
+// testLocalities are the localities of the DNE written by writeTestDNE.
+const testLocalities = "001@SP@Sao Paulo@@1@M@@SP@3550308\n002@RJ@Rio de Janeiro@@1@M@@RJ@3304557\n"
+
+// testStreets are four CEPs of SP and two of RJ.
+var testStreets = map[string]string{
+	"SP": "001@SP@001@@@Paulista@@01310-100@Avenida@S@\n" +
+		"002@SP@001@@@Augusta@@01310-200@Rua@S@\n" +
+		"003@SP@001@@@Consolacao@@01301-000@Rua@S@\n" +
+		"004@SP@001@@@Liberdade@@01503-000@Avenida@S@\n",
+	"RJ": "005@RJ@002@@@Atlantica@@22010-000@Avenida@S@\n" +
+		"006@RJ@002@@@Copacabana@@22020-001@Avenida@S@\n",
+}
+
+// newTestAPI returns an API with the default config overridden by settings.
+func newTestAPI(t *testing.T, settings map[string]any) *API {
+	t.Helper()
+	conf := config.NewConfig()
+	for key, value := range settings {
+		conf.Set(key, value)
+	}
+	return NewAPI(conf, logger.NewLogger("error"), BuildInfo{Version: "test"})
+}
+
+// observeLogs makes api log to the returned observer instead of stdout.
+func observeLogs(api *API) *observer.ObservedLogs {
+	core, logs := observer.New(zapcore.DebugLevel)
+	api.logger = &logger.Logger{Logger: zap.New(core)}
+	return logs
+}
+
+// openTestDatabase opens an empty store in a temporary directory as the
+// database of the process, closed when the test ends.
+func openTestDatabase(t *testing.T, conf *viper.Viper) {
+	t.Helper()
+	conf.Set("db.path", t.TempDir())
+	require.NoError(t, database.NewDatabase(conf, logger.NewLogger("error")))
+	t.Cleanup(func() { database.CloseDatabase() })
+}
+
+// writeTestDNE writes a DNE whose streets are LOG_LOGRADOURO_<UF>.TXT lines
+// keyed by UF, with the localities of testLocalities.
+func writeTestDNE(t *testing.T, streets map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"LOG_LOCALIDADE.TXT":     testLocalities,
+		"LOG_BAIRRO.TXT":         "",
+		"LOG_GRANDE_USUARIO.TXT": "",
+		"LOG_UNID_OPER.TXT":      "",
+		"LOG_CPC.TXT":            "",
+	}
+	for _, uf := range testUFs {
+		files["LOG_LOGRADOURO_"+uf+".TXT"] = streets[uf]
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	return dir
+}
+
+// seedTestDatabase imports the DNE of writeTestDNE into the open store.
+func seedTestDatabase(t *testing.T, api *API, streets map[string]string) {
+	t.Helper()
+	api.config.Set("seed.report.path", filepath.Join(t.TempDir(), "import-report.json"))
+	importer := zipcodes.NewZipCodeImporter(api.config, api.logger)
+	_, err := importer.PopulateZipcodes(writeTestDNE(t, streets))
+	require.NoError(t, err)
+}
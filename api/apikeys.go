@@ -0,0 +1,228 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/brasilcep/api/apikeys"
+	"github.com/brasilcep/api/database"
+	"github.com/brasilcep/api/logger"
+	"github.com/brasilcep/api/ratelimit"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// apiKeyContextKey holds the *apikeys.Key of an authenticated request.
+const apiKeyContextKey = "apikey"
+
+const apiKeyUsagePath = "/apikey/usage"
+
+// APIKeyUsageResponse is returned by GET /apikey/usage.
+type APIKeyUsageResponse struct {
+	Name         string        `json:"name"`
+	RateLimit    float64       `json:"rate_limit"`
+	Burst        int           `json:"burst"`
+	Policy       string        `json:"rate_limit_policy"`
+	DailyQuota   int64         `json:"daily_quota,omitempty"`
+	MonthlyQuota int64         `json:"monthly_quota,omitempty"`
+	Usage        apikeys.Usage `json:"usage"`
+}
+
+// apiKeyAuth authenticates requests by API key and applies the rate limit
+// and quotas of the key. Both are counted in the rate limit store, so they
+// hold across the replicas sharing it.
+type apiKeyAuth struct {
+	registry     *apikeys.Registry
+	store        ratelimit.Store
+	logger       *logger.Logger
+	file         string
+	header       string
+	queryParam   string
+	required     bool
+	defaultRate  float64
+	defaultBurst int
+}
+
+// newAPIKeyAuth loads the keys in the store and api.keys.file.
+func (api *API) newAPIKeyAuth(store ratelimit.Store) (*apiKeyAuth, error) {
+	a := &apiKeyAuth{
+		store:        store,
+		logger:       api.logger,
+		file:         api.config.GetString("api.keys.file"),
+		header:       api.config.GetString("api.keys.header"),
+		queryParam:   api.config.GetString("api.keys.query_param"),
+		required:     api.config.GetBool("api.keys.required"),
+		defaultRate:  api.config.GetFloat64("api.keys.default_rate_limit"),
+		defaultBurst: api.config.GetInt("api.keys.default_burst"),
+	}
+	fileKeys, err := a.fileKeys()
+	if err != nil {
+		return nil, err
+	}
+	if a.registry, err = apikeys.NewRegistry(database.GetDB(), store, fileKeys); err != nil {
+		return nil, err
+	}
+	api.logger.Info("API keys enabled", zap.Int("keys", a.registry.Len()), zap.Bool("required", api.config.GetBool("api.keys.required")))
+	return a, nil
+}
+
+func (a *apiKeyAuth) fileKeys() ([]apikeys.Key, error) {
+	if a.file == "" {
+		return nil, nil
+	}
+	return apikeys.LoadFile(a.file)
+}
+
+// reload picks up the keys created, changed or revoked since they were
+// loaded, in the store or in api.keys.file.
+func (a *apiKeyAuth) reload() error {
+	fileKeys, err := a.fileKeys()
+	if err != nil {
+		return err
+	}
+	return a.registry.Reload(fileKeys)
+}
+
+// runReload reloads the keys every interval until ctx is cancelled.
+func (a *apiKeyAuth) runReload(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.reload(); err != nil {
+				a.logger.Error("Failed to reload API keys, keeping the loaded ones", zap.Error(err))
+			}
+		}
+	}
+}
+
+// skip leaves health checks and metrics open to probes and scrapers, and
+// CORS preflights, which browsers send without custom headers.
+func (a *apiKeyAuth) skip(c echo.Context) bool {
+	if c.Request().Method == http.MethodOptions {
+		return true
+	}
+	return isProbe(c.Request().URL.Path)
+}
+
+func (a *apiKeyAuth) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if a.skip(c) {
+			return next(c)
+		}
+
+		secret := c.Request().Header.Get(a.header)
+		if secret == "" && a.queryParam != "" {
+			secret = c.QueryParam(a.queryParam)
+		}
+		if secret == "" {
+			if a.required {
+				return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "chave de API ausente"})
+			}
+			return next(c)
+		}
+
+		key := a.registry.Lookup(secret)
+		if key == nil {
+			return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "chave de API inválida"})
+		}
+		c.Set(apiKeyContextKey, key)
+
+		limiter := ratelimit.NewLimiter(a.store, []ratelimit.Policy{a.policy(key)}, func(err error) {
+			a.logger.Warn("Rate limit store failed, allowing request", zap.Error(err))
+		})
+		decision := limiter.Allow(apiKeyContextKey+":"+key.Name, 1)
+		setRateLimitHeaders(c.Response().Header(), decision)
+		if !decision.Allowed {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(secondsUntilReset(decision.Reset)))
+			return c.JSON(http.StatusTooManyRequests, ErrorResponse{Error: "limite de requisições excedido"})
+		}
+
+		// Checking the usage neither counts against nor is blocked by quotas.
+		if c.Request().URL.Path == apiKeyUsagePath {
+			return next(c)
+		}
+
+		now := time.Now()
+		status, err := a.registry.Consume(key, now)
+		if err != nil {
+			// Like the rate limits, quotas must not take the API down with
+			// the store.
+			a.logger.Warn("API key quota store failed, allowing request", zap.Error(err))
+			return next(c)
+		}
+		if status.Limit > 0 {
+			h := c.Response().Header()
+			h.Set("X-RateLimit-Quota-Period", status.Period)
+			h.Set("X-RateLimit-Quota-Limit", strconv.FormatInt(status.Limit, 10))
+			h.Set("X-RateLimit-Quota-Remaining", strconv.FormatInt(status.Remaining, 10))
+			h.Set("X-RateLimit-Quota-Reset", strconv.FormatInt(status.Reset.Unix(), 10))
+		}
+		if status.Exceeded {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(status.Reset.Sub(now).Seconds()))))
+			return c.JSON(http.StatusTooManyRequests, ErrorResponse{Error: fmt.Sprintf("cota da chave excedida (%s)", status.Period)})
+		}
+
+		return next(c)
+	}
+}
+
+// policy returns the rate limit of key, defaults applied: its burst of
+// requests per the time the rate takes to allow as many, e.g. 100 requests
+// per 2 seconds for 50 requests per second with a burst of 100.
+func (a *apiKeyAuth) policy(key *apikeys.Key) ratelimit.Policy {
+	limit, burst := a.limits(key)
+	window := max(time.Duration(math.Ceil(float64(burst)/limit))*time.Second, time.Second)
+	return ratelimit.Policy{
+		Limit:  max(int64(burst), int64(math.Round(limit*window.Seconds()))),
+		Window: window,
+	}
+}
+
+// limits returns the rate and burst of key, defaults applied.
+func (a *apiKeyAuth) limits(key *apikeys.Key) (float64, int) {
+	limit, burst := key.RateLimit, key.Burst
+	if limit <= 0 {
+		limit = a.defaultRate
+	}
+	if burst <= 0 {
+		burst = a.defaultBurst
+	}
+	return limit, burst
+}
+
+// apiKeyUsage returns the limits and counters of the key of the request.
+func (a *apiKeyAuth) apiKeyUsage(c echo.Context) error {
+	key, ok := c.Get(apiKeyContextKey).(*apikeys.Key)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "chave de API ausente"})
+	}
+
+	usage, err := a.registry.Usage(key, time.Now())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, a.usageResponse(key, usage))
+}
+
+// usageResponse reports the effective limits of key, defaults applied.
+func (a *apiKeyAuth) usageResponse(key *apikeys.Key, usage apikeys.Usage) APIKeyUsageResponse {
+	limit, burst := a.limits(key)
+	return APIKeyUsageResponse{
+		Name:         key.Name,
+		RateLimit:    limit,
+		Burst:        burst,
+		Policy:       a.policy(key).String(),
+		DailyQuota:   key.DailyQuota,
+		MonthlyQuota: key.MonthlyQuota,
+		Usage:        usage,
+	}
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brasilcep/api/apikeys"
+	"github.com/brasilcep/api/database"
+	"github.com/brasilcep/api/ratelimit"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupAPIKeys returns the key auth and public handler of a replica with
+// API keys required, counting in store.
+func setupAPIKeys(t *testing.T, api *API, store ratelimit.Store) (*apiKeyAuth, *echo.Echo) {
+	t.Helper()
+	keyAuth, err := api.newAPIKeyAuth(store)
+	require.NoError(t, err)
+
+	e := echo.New()
+	e.Use(keyAuth.middleware)
+	e.GET("/cep/:cep", func(c echo.Context) error { return c.String(http.StatusOK, "ok") })
+	e.GET("/health/live", func(c echo.Context) error { return c.String(http.StatusOK, "ok") })
+	e.GET(apiKeyUsagePath, keyAuth.apiKeyUsage)
+	return keyAuth, e
+}
+
+func newAPIKeysAPI(t *testing.T, settings map[string]any) *API {
+	settings["api.keys.enable"] = true
+	settings["api.keys.required"] = true
+	settings["api.admin.tokens"] = []string{"admin"}
+	api := newTestAPI(t, settings)
+	openTestDatabase(t, api.config)
+	return api
+}
+
+func doRequest(handler http.Handler, method, target, secret string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if secret != "" {
+		req.Header.Set("X-API-Key", secret)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	api := newAPIKeysAPI(t, map[string]any{})
+	secret, err := apikeys.Create(database.GetDB(), apikeys.Key{Name: "parceiro", RateLimit: 1, Burst: 3})
+	require.NoError(t, err)
+	_, e := setupAPIKeys(t, api, ratelimit.NewMemoryStore())
+
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, http.MethodGet, "/cep/01001000", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, http.MethodGet, "/cep/01001000", "bcep_errada").Code)
+	assert.Equal(t, http.StatusOK, doRequest(e, http.MethodGet, "/health/live", "").Code, "probes need no key")
+	assert.Equal(t, http.StatusOK, doRequest(e, http.MethodGet, "/cep/01001000?api_key="+secret, "").Code)
+
+	rec := doRequest(e, http.MethodGet, "/cep/01001000", secret)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "3/3s", rec.Header().Get("X-RateLimit-Policy"))
+	assert.Equal(t, "3", rec.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", rec.Header().Get("X-RateLimit-Remaining"))
+	assert.NotEmpty(t, rec.Header().Get("X-RateLimit-Reset"))
+	assert.Empty(t, rec.Header().Get("X-RateLimit-Quota-Limit"), "the key has no quotas")
+
+	doRequest(e, http.MethodGet, "/cep/01001000", secret)
+	rec = doRequest(e, http.MethodGet, "/cep/01001000", secret)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("X-RateLimit-Remaining"))
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+}
+
+func TestAPIKeyQuotas(t *testing.T) {
+	api := newAPIKeysAPI(t, map[string]any{})
+	secret, err := apikeys.Create(database.GetDB(), apikeys.Key{Name: "parceiro", RateLimit: 1000, Burst: 1000, DailyQuota: 2, MonthlyQuota: 100})
+	require.NoError(t, err)
+
+	// Two replicas sharing the store share the quota.
+	store := ratelimit.NewMemoryStore()
+	_, first := setupAPIKeys(t, api, store)
+	_, second := setupAPIKeys(t, api, store)
+
+	rec := doRequest(first, http.MethodGet, "/cep/01001000", secret)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "day", rec.Header().Get("X-RateLimit-Quota-Period"))
+	assert.Equal(t, "2", rec.Header().Get("X-RateLimit-Quota-Limit"))
+	assert.Equal(t, "1", rec.Header().Get("X-RateLimit-Quota-Remaining"))
+
+	require.Equal(t, http.StatusOK, doRequest(second, http.MethodGet, "/cep/01001000", secret).Code)
+
+	rec = doRequest(first, http.MethodGet, "/cep/01001000", secret)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("X-RateLimit-Quota-Remaining"))
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+	rec = doRequest(second, http.MethodGet, apiKeyUsagePath, secret)
+	require.Equal(t, http.StatusOK, rec.Code, "checking the usage is not blocked by quotas")
+	var usage APIKeyUsageResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &usage))
+	assert.Equal(t, int64(2), usage.Usage.Daily)
+	assert.Equal(t, int64(2), usage.Usage.Monthly)
+	assert.Equal(t, "1000/s", usage.Policy)
+}
+
+func TestAPIKeyAdmin(t *testing.T) {
+	api := newAPIKeysAPI(t, map[string]any{})
+	keyAuth, e := setupAPIKeys(t, api, ratelimit.NewMemoryStore())
+	admin := api.newAdmin(keyAuth, nil)
+
+	create := func(body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/apikeys", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, create(`{"name": "parceiro"}`, "").Code)
+	assert.Equal(t, http.StatusBadRequest, create(`{"rate_limit": 5}`, "admin").Code)
+
+	rec := create(`{"name": "parceiro", "rate_limit": 5, "burst": 10, "daily_quota": 1000}`, "admin")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var created CreateAPIKeyResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	assert.Equal(t, "parceiro", created.Name)
+	assert.Equal(t, int64(1000), created.DailyQuota)
+	require.True(t, strings.HasPrefix(created.Key, "bcep_"))
+
+	assert.Equal(t, http.StatusConflict, create(`{"name": "parceiro"}`, "admin").Code)
+	assert.Equal(t, http.StatusOK, doRequest(e, http.MethodGet, "/cep/01001000", created.Key).Code, "new keys work right away")
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/apikeys", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var keys []APIKeyUsageResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &keys))
+	require.Len(t, keys, 1)
+	assert.Equal(t, int64(1), keys[0].Usage.Daily)
+
+	req = httptest.NewRequest(http.MethodDelete, "/admin/apikeys/parceiro", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, http.MethodGet, "/cep/01001000", created.Key).Code, "revoked keys stop working right away")
+
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	t.Run("recreated keys start from zero", func(t *testing.T) {
+		rec := create(`{"name": "parceiro", "daily_quota": 1}`, "admin")
+		require.Equal(t, http.StatusCreated, rec.Code)
+		var recreated CreateAPIKeyResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &recreated))
+		assert.Zero(t, recreated.Usage.Daily)
+
+		assert.Equal(t, http.StatusOK, doRequest(e, http.MethodGet, "/cep/01001000", recreated.Key).Code, "the old key's requests do not count")
+		assert.Equal(t, http.StatusTooManyRequests, doRequest(e, http.MethodGet, "/cep/01001000", recreated.Key).Code)
+
+		rec = doRequest(e, http.MethodGet, apiKeyUsagePath, recreated.Key)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var usage APIKeyUsageResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &usage))
+		assert.Equal(t, int64(1), usage.Usage.Daily)
+		assert.Equal(t, int64(1), usage.Usage.Total)
+	})
+}
+
+func TestAPIKeyReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(file, []byte(`[{"name": "escritorio", "key": "segredo-1"}]`), 0o600))
+	api := newAPIKeysAPI(t, map[string]any{"api.keys.file": file})
+	keyAuth, e := setupAPIKeys(t, api, ratelimit.NewMemoryStore())
+
+	assert.Equal(t, http.StatusOK, doRequest(e, http.MethodGet, "/cep/01001000", "segredo-1").Code)
+
+	// The file was updated, e.g. a secret mounted in every replica.
+	require.NoError(t, os.WriteFile(file, []byte(`[{"name": "filial", "key": "segredo-2"}]`), 0o600))
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, http.MethodGet, "/cep/01001000", "segredo-2").Code)
+
+	require.NoError(t, keyAuth.reload())
+	assert.Equal(t, http.StatusOK, doRequest(e, http.MethodGet, "/cep/01001000", "segredo-2").Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(e, http.MethodGet, "/cep/01001000", "segredo-1").Code)
+
+	require.NoError(t, os.WriteFile(file, []byte(`not json`), 0o600))
+	assert.Error(t, keyAuth.reload())
+	assert.Equal(t, http.StatusOK, doRequest(e, http.MethodGet, "/cep/01001000", "segredo-2").Code, "a failed reload keeps the keys")
+}
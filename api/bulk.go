@@ -0,0 +1,156 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/brasilcep/api/database"
+	"github.com/brasilcep/api/zipcodes"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.uber.org/zap"
+)
+
+// bulkRangeUnit is the Range unit of the bulk downloads. Records are sorted
+// by CEP, so "Range: ceps=<last CEP received>-" resumes a broken download.
+const bulkRangeUnit = "ceps"
+
+// registerBulk adds the bulk download routes when tokens are configured.
+func (api *API) registerBulk() {
+	tokens := api.config.GetStringSlice("api.bulk.tokens")
+	if len(tokens) == 0 {
+		api.logger.Debug("Bulk download disabled")
+		return
+	}
+
+	g := api.echo.Group("/bulk", bearerAuth(tokens))
+	if !api.config.GetBool("api.enable.gzip") {
+		g.Use(middleware.GzipWithConfig(middleware.GzipConfig{
+			Level: api.config.GetInt("api.gzip.compression.level"),
+		}))
+	}
+	g.GET("/ceps.ndjson", api.bulkCEPs)
+	g.GET("/:uf/ceps.ndjson", api.bulkCEPs)
+	api.logger.Debug("Bulk download enabled")
+}
+
+// bearerAuth only lets requests with one of tokens as Bearer token through.
+func bearerAuth(tokens []string) echo.MiddlewareFunc {
+	return middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		Validator: func(key string, c echo.Context) (bool, error) {
+			for _, token := range tokens {
+				if subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+		ErrorHandler: func(err error, c echo.Context) error {
+			return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "token inválido ou ausente"})
+		},
+	})
+}
+
+// startStream registers a bulk download, unless Listen is shutting down.
+// Every successful call must be followed by streams.Done.
+func (api *API) startStream() bool {
+	api.streamsMu.Lock()
+	defer api.streamsMu.Unlock()
+	if api.streamsClosed {
+		return false
+	}
+	api.streams.Add(1)
+	return true
+}
+
+// closeStreams stops new bulk downloads and waits for the running ones.
+func (api *API) closeStreams() {
+	api.streamsMu.Lock()
+	api.streamsClosed = true
+	api.streamsMu.Unlock()
+	api.streams.Wait()
+}
+
+// bulkCEPs streams every CEP, or the ones of a UF, as NDJSON straight from
+// the store. The download resumes after a CEP with ?after= or a Range
+// header; If-Range with the ETag of the dataset guards against resuming
+// across imports.
+func (api *API) bulkCEPs(c echo.Context) error {
+	if !api.startStream() {
+		return c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "shutting down"})
+	}
+	defer api.streams.Done()
+
+	db := database.GetDB()
+	if db == nil {
+		return c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "database not ready"})
+	}
+
+	uf := strings.ToUpper(c.Param("uf"))
+	opts := zipcodes.ExportOptions{Dataset: zipcodes.DatasetCEPs, Format: zipcodes.ExportNDJSON, After: c.QueryParam("after")}
+	if uf != "" {
+		opts.UFs = []string{uf}
+	}
+
+	// A dataset being imported has no version to resume against, so it gets
+	// no ETag and If-Range never matches.
+	etag := ""
+	if info, err := zipcodes.GetDatasetInfo(db); err == nil && info != nil && info.Complete() {
+		etag = fmt.Sprintf(`"%d"`, info.CompletedAt.UnixNano())
+	}
+
+	status := http.StatusOK
+	if after, ok := parseBulkRange(c.Request().Header.Get("Range")); ok {
+		if ifRange := c.Request().Header.Get("If-Range"); ifRange == "" || (etag != "" && ifRange == etag) {
+			opts.After = after
+			status = http.StatusPartialContent
+		}
+	}
+
+	name := "ceps.ndjson"
+	if uf != "" {
+		name = "ceps-" + uf + ".ndjson"
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name))
+	res.Header().Set("Accept-Ranges", bulkRangeUnit)
+	if etag != "" {
+		res.Header().Set("ETag", etag)
+	}
+	if status == http.StatusPartialContent {
+		res.Header().Set("Content-Range", fmt.Sprintf("%s %s-/*", bulkRangeUnit, opts.After))
+	}
+	res.WriteHeader(status)
+
+	ctx := c.Request().Context()
+	var count int
+	err := read(ctx, "export", func() (err error) {
+		count, err = zipcodes.Export(ctx, db, res, opts)
+		return err
+	})
+	if err != nil {
+		// Headers are gone already; the client sees a truncated stream and
+		// resumes from the last complete line.
+		api.requestLogger(c).Warn("Bulk download interrupted", zap.String("uf", uf), zap.Int("count", count), zap.Error(err))
+		return nil
+	}
+	api.requestLogger(c).Debug("Bulk download completed", zap.String("uf", uf), zap.Int("count", count))
+	return nil
+}
+
+// parseBulkRange reads "ceps=<cep>-" and returns the CEP to resume after.
+func parseBulkRange(header string) (string, bool) {
+	spec, ok := strings.CutPrefix(header, bulkRangeUnit+"=")
+	if !ok {
+		return "", false
+	}
+	after, ok := strings.CutSuffix(strings.TrimSpace(spec), "-")
+	if !ok || after == "" || strings.Contains(after, "-") {
+		return "", false
+	}
+	return after, true
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brasilcep/api/database"
+	"github.com/brasilcep/api/zipcodes"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupBulk seeds testStreets and returns the API with /bulk enabled.
+func setupBulk(t *testing.T) *API {
+	t.Helper()
+	api := newTestAPI(t, map[string]any{"api.bulk.tokens": []string{"lote"}})
+	openTestDatabase(t, api.config)
+	seedTestDatabase(t, api, testStreets)
+	api.registerBulk()
+	return api
+}
+
+func bulkRequest(api *API, target string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Authorization", "Bearer lote")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	api.echo.ServeHTTP(rec, req)
+	return rec
+}
+
+// bulkCEPsOf returns the CEPs of an NDJSON body, in order.
+func bulkCEPsOf(t *testing.T, body string) []string {
+	t.Helper()
+	var ceps []string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		var cep zipcodes.CEPCompleto
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &cep))
+		ceps = append(ceps, cep.CEP)
+	}
+	return ceps
+}
+
+func TestBulkDownload(t *testing.T) {
+	api := setupBulk(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/bulk/ceps.ndjson", nil)
+	rec := httptest.NewRecorder()
+	api.echo.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = bulkRequest(api, "/bulk/ceps.ndjson", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+	assert.Equal(t, bulkRangeUnit, rec.Header().Get("Accept-Ranges"))
+	assert.NotEmpty(t, rec.Header().Get("ETag"))
+	assert.Equal(t, []string{"01301000", "01310100", "01310200", "01503000", "22010000", "22020001"}, bulkCEPsOf(t, rec.Body.String()))
+
+	rec = bulkRequest(api, "/bulk/rj/ceps.ndjson", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), `filename="ceps-RJ.ndjson"`)
+	assert.Equal(t, []string{"22010000", "22020001"}, bulkCEPsOf(t, rec.Body.String()))
+}
+
+func TestBulkResume(t *testing.T) {
+	api := setupBulk(t)
+	etag := bulkRequest(api, "/bulk/ceps.ndjson", nil).Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	rec := bulkRequest(api, "/bulk/ceps.ndjson?after=01310200", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"01503000", "22010000", "22020001"}, bulkCEPsOf(t, rec.Body.String()))
+
+	rec = bulkRequest(api, "/bulk/sp/ceps.ndjson", map[string]string{"Range": "ceps=01310100-"})
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "ceps 01310100-/*", rec.Header().Get("Content-Range"))
+	assert.Equal(t, []string{"01310200", "01503000"}, bulkCEPsOf(t, rec.Body.String()))
+
+	rec = bulkRequest(api, "/bulk/ceps.ndjson", map[string]string{"Range": "ceps=01503000-", "If-Range": etag})
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, []string{"22010000", "22020001"}, bulkCEPsOf(t, rec.Body.String()))
+
+	// The dataset changed since the download started: start over.
+	rec = bulkRequest(api, "/bulk/ceps.ndjson", map[string]string{"Range": "ceps=01503000-", "If-Range": `"1"`})
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Range"))
+	assert.Len(t, bulkCEPsOf(t, rec.Body.String()), 6)
+
+	for _, header := range []string{"bytes=100-", "ceps=01310100-01503000", "ceps=-"} {
+		rec = bulkRequest(api, "/bulk/ceps.ndjson", map[string]string{"Range": header})
+		assert.Equal(t, http.StatusOK, rec.Code, header)
+		assert.Len(t, bulkCEPsOf(t, rec.Body.String()), 6, header)
+	}
+}
+
+func TestBulkIncompleteDataset(t *testing.T) {
+	api := setupBulk(t)
+	info, err := zipcodes.GetDatasetInfo(database.GetDB())
+	require.NoError(t, err)
+	require.NotNil(t, info)
+	etag := bulkRequest(api, "/bulk/ceps.ndjson", nil).Header().Get("ETag")
+
+	// A new import started and has not finished.
+	info.Status = zipcodes.DatasetImporting
+	value, err := json.Marshal(info)
+	require.NoError(t, err)
+	require.NoError(t, database.GetDB().Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte("meta:dataset"), value)
+	}))
+
+	rec := bulkRequest(api, "/bulk/ceps.ndjson", map[string]string{"Range": "ceps=01503000-", "If-Range": etag})
+	require.Equal(t, http.StatusOK, rec.Code, "If-Range never matches while importing")
+	assert.Empty(t, rec.Header().Get("ETag"))
+	assert.Len(t, bulkCEPsOf(t, rec.Body.String()), 6)
+}
+
+func TestBulkDuringShutdown(t *testing.T) {
+	api := setupBulk(t)
+
+	// Downloads keep arriving while Listen waits for the running ones.
+	var wg sync.WaitGroup
+	codes := make(chan int, 100)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 25 {
+				rec := bulkRequest(api, "/bulk/ceps.ndjson", nil)
+				if rec.Code == http.StatusOK {
+					assert.Len(t, bulkCEPsOf(t, rec.Body.String()), 6)
+				}
+				codes <- rec.Code
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	api.closeStreams()
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		assert.Contains(t, []int{http.StatusOK, http.StatusServiceUnavailable}, code)
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, bulkRequest(api, "/bulk/ceps.ndjson", nil).Code, "no download starts after the wait")
+}
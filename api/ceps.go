@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/brasilcep/api/database"
+	"github.com/brasilcep/api/zipcodes"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// CEPPage is a page of GET /ceps. NextCursor is empty on the last page and
+// Total is omitted when the filters can not be counted from the stats.
+type CEPPage struct {
+	Data       []zipcodes.CEPCompleto `json:"data"`
+	Limit      int                    `json:"limit"`
+	NextCursor string                 `json:"next_cursor,omitempty"`
+	Total      *int                   `json:"total,omitempty"`
+}
+
+// listCEPs serves GET /ceps?uf=&prefixo=&cidade=&cursor=&limit=.
+func (api *API) listCEPs(c echo.Context) error {
+	opts := zipcodes.ListOptions{
+		UF:     strings.ToUpper(c.QueryParam("uf")),
+		Prefix: c.QueryParam("prefixo"),
+		Cidade: c.QueryParam("cidade"),
+		Limit:  api.config.GetInt("api.list.default_limit"),
+	}
+
+	if raw := c.QueryParam("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "limit inválido"})
+		}
+		opts.Limit = min(n, api.config.GetInt("api.list.max_limit"))
+	}
+
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "cursor inválido"})
+		}
+		opts.After = after
+	}
+
+	db := database.GetDB()
+	if db == nil {
+		return c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "database not ready"})
+	}
+
+	var ceps []zipcodes.CEPCompleto
+	var next string
+	err := read(c.Request().Context(), "list", func() (err error) {
+		ceps, next, err = zipcodes.ListCEPs(db, opts)
+		return err
+	})
+	if err != nil {
+		api.requestLogger(c).Error("Erro ao listar CEPs", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Erro ao listar CEPs"})
+	}
+
+	page := CEPPage{Data: ceps, Limit: opts.Limit}
+	if next != "" {
+		page.NextCursor = encodeCursor(next)
+	}
+
+	var stats *zipcodes.Stats
+	err = read(c.Request().Context(), "stats", func() (err error) {
+		stats, err = zipcodes.GetStats(db)
+		return err
+	})
+	if err != nil {
+		api.requestLogger(c).Warn("Erro ao ler estatísticas", zap.Error(err))
+	}
+	if stats != nil && opts.Prefix == "" {
+		total := stats.Total
+		switch {
+		case opts.Cidade != "":
+			err = read(c.Request().Context(), "city_total", func() (err error) {
+				total, err = zipcodes.CityTotal(db, opts.UF, opts.Cidade)
+				return err
+			})
+		case opts.UF != "":
+			total = stats.PorUF[opts.UF]
+		}
+		if err != nil {
+			api.requestLogger(c).Warn("Erro ao ler total da cidade", zap.Error(err))
+		} else {
+			page.Total = &total
+		}
+	}
+
+	return c.JSON(http.StatusOK, page)
+}
+
+// Cursors are opaque to clients; today they wrap the last CEP of a page.
+func encodeCursor(cep string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cep))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	return string(data), err
+}
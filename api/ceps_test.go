@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupCEPs seeds testStreets and returns the API serving GET /ceps.
+func setupCEPs(t *testing.T, settings map[string]any) *API {
+	t.Helper()
+	api := newTestAPI(t, settings)
+	openTestDatabase(t, api.config)
+	seedTestDatabase(t, api, testStreets)
+	api.echo.GET("/ceps", api.listCEPs)
+	return api
+}
+
+func listPage(t *testing.T, api *API, target string) (CEPPage, int) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	api.echo.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	var page CEPPage
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	}
+	return page, rec.Code
+}
+
+func pageCEPs(page CEPPage) []string {
+	ceps := make([]string, 0, len(page.Data))
+	for _, cep := range page.Data {
+		ceps = append(ceps, cep.CEP)
+	}
+	return ceps
+}
+
+func TestListCEPsCursor(t *testing.T) {
+	api := setupCEPs(t, map[string]any{})
+
+	var ceps []string
+	target := "/ceps?limit=4"
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3, "the cursor must advance")
+		page, status := listPage(t, api, target)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, 4, page.Limit)
+		require.NotNil(t, page.Total)
+		assert.Equal(t, 6, *page.Total)
+		ceps = append(ceps, pageCEPs(page)...)
+		if page.NextCursor == "" {
+			break
+		}
+		target = "/ceps?limit=4&cursor=" + page.NextCursor
+	}
+	assert.Equal(t, []string{"01301000", "01310100", "01310200", "01503000", "22010000", "22020001"}, ceps)
+}
+
+func TestListCEPsFilters(t *testing.T) {
+	api := setupCEPs(t, map[string]any{"api.list.max_limit": 2})
+
+	page, status := listPage(t, api, "/ceps?uf=rj&limit=10")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, page.Limit, "limit is capped at api.list.max_limit")
+	assert.Equal(t, []string{"22010000", "22020001"}, pageCEPs(page))
+	require.NotNil(t, page.Total)
+	assert.Equal(t, 2, *page.Total)
+
+	page, status = listPage(t, api, "/ceps?uf=SP&limit=2")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"01301000", "01310100"}, pageCEPs(page))
+	require.NotEmpty(t, page.NextCursor)
+	page, _ = listPage(t, api, "/ceps?uf=SP&limit=2&cursor="+page.NextCursor)
+	assert.Equal(t, []string{"01310200", "01503000"}, pageCEPs(page))
+
+	page, status = listPage(t, api, "/ceps?prefixo=0131")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"01310100", "01310200"}, pageCEPs(page))
+	assert.Nil(t, page.Total, "prefixes are not counted")
+
+	page, status = listPage(t, api, "/ceps?cidade=rio%20de%20janeiro&uf=RJ")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"22010000", "22020001"}, pageCEPs(page))
+	require.NotNil(t, page.Total)
+	assert.Equal(t, 2, *page.Total)
+}
+
+func TestListCEPsInvalid(t *testing.T) {
+	api := setupCEPs(t, map[string]any{})
+
+	for _, target := range []string{"/ceps?limit=0", "/ceps?limit=dez", "/ceps?cursor=***"} {
+		_, status := listPage(t, api, target)
+		assert.Equal(t, http.StatusBadRequest, status, target)
+	}
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/brasilcep/api/database"
+	"github.com/brasilcep/api/zipcodes"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+// ChangesResponse is a page of the change log. Clients pass NextCursor as
+// since to get the following page.
+type ChangesResponse struct {
+	Changes    []zipcodes.ChangeEvent `json:"changes"`
+	NextCursor uint64                 `json:"next_cursor"`
+	HasMore    bool                   `json:"has_more"`
+}
+
+// changes serves GET /changes?since=cursor&limit=n.
+func (api *API) changes(c echo.Context) error {
+	var since uint64
+	if raw := c.QueryParam("since"); raw != "" {
+		var err error
+		if since, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "since inválido"})
+		}
+	}
+
+	limit := defaultChangesLimit
+	if raw := c.QueryParam("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "limit inválido"})
+		}
+		limit = min(n, maxChangesLimit)
+	}
+
+	db := database.GetDB()
+	if db == nil {
+		return c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "database not ready"})
+	}
+
+	var events []zipcodes.ChangeEvent
+	var more bool
+	err := read(c.Request().Context(), "changes", func() (err error) {
+		events, more, err = zipcodes.GetChanges(db, since, limit)
+		return err
+	})
+	if err != nil {
+		api.requestLogger(c).Error("Erro ao listar mudanças", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Erro ao listar mudanças"})
+	}
+
+	next := since
+	if len(events) > 0 {
+		next = events[len(events)-1].Cursor
+	}
+	return c.JSON(http.StatusOK, ChangesResponse{Changes: events, NextCursor: next, HasMore: more})
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// Headers accepted in api.proxy.header.
+const (
+	proxyHeaderNone           = ""
+	proxyHeaderXForwardedFor  = "x-forwarded-for"
+	proxyHeaderXRealIP        = "x-real-ip"
+	proxyHeaderForwarded      = "forwarded"
+	proxyHeaderCFConnectingIP = "cf-connecting-ip"
+)
+
+// ipExtractor returns how c.RealIP() finds the client address, used by the
+// rate limits, logs and metrics. Headers are only read from requests sent
+// by a peer in api.proxy.trusted_cidrs; without a header the address of
+// the peer is the client.
+func (api *API) ipExtractor() (echo.IPExtractor, error) {
+	trusted, err := parseCIDRs(api.config.GetStringSlice("api.proxy.trusted_cidrs"))
+	if err != nil {
+		return nil, err
+	}
+	header := strings.ToLower(api.config.GetString("api.proxy.header"))
+
+	if header != proxyHeaderNone && len(trusted) == 0 {
+		api.logger.Warn("Client IP header set without trusted proxies, it will be ignored", zap.String("header", header))
+	}
+	api.logger.Debug("Client IP extraction", zap.String("header", header), zap.Int("trusted_proxies", len(trusted)))
+
+	// Echo trusts loopback, link-local and private addresses by default;
+	// only the configured proxies are trusted here.
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, network := range trusted {
+		options = append(options, echo.TrustIPRange(network))
+	}
+
+	switch header {
+	case proxyHeaderNone:
+		return echo.ExtractIPDirect(), nil
+	case proxyHeaderXForwardedFor:
+		return echo.ExtractIPFromXFFHeader(options...), nil
+	case proxyHeaderXRealIP:
+		return echo.ExtractIPFromRealIPHeader(options...), nil
+	case proxyHeaderForwarded:
+		return extractIPFromForwarded(trusted), nil
+	case proxyHeaderCFConnectingIP:
+		return extractIPFromHeader("CF-Connecting-IP", trusted), nil
+	default:
+		return nil, fmt.Errorf("unknown client IP header %q", header)
+	}
+}
+
+// extractIPFromHeader reads a header holding a single address, set by a
+// trusted proxy such as Cloudflare.
+func extractIPFromHeader(name string, trusted []*net.IPNet) echo.IPExtractor {
+	return func(req *http.Request) string {
+		direct := remoteIP(req)
+		if !containsIP(trusted, net.ParseIP(direct)) {
+			return direct
+		}
+		if ip := net.ParseIP(strings.TrimSpace(req.Header.Get(name))); ip != nil {
+			return ip.String()
+		}
+		return direct
+	}
+}
+
+// extractIPFromForwarded reads the for= parameters of the RFC 7239
+// Forwarded header from the closest hop backwards, stopping at the first
+// address that is not a trusted proxy.
+func extractIPFromForwarded(trusted []*net.IPNet) echo.IPExtractor {
+	return func(req *http.Request) string {
+		client := remoteIP(req)
+		if !containsIP(trusted, net.ParseIP(client)) {
+			return client
+		}
+
+		hops := forwardedFor(req.Header.Values("Forwarded"))
+		for n := len(hops) - 1; n >= 0; n-- {
+			ip := net.ParseIP(hops[n])
+			if ip == nil {
+				// Obfuscated or "unknown" node: nothing behind it can be trusted.
+				break
+			}
+			client = ip.String()
+			if !containsIP(trusted, ip) {
+				break
+			}
+		}
+		return client
+	}
+}
+
+// forwardedFor returns the addresses of the for= parameters, in order,
+// without quotes, brackets and ports.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				hops = append(hops, forwardedNode(strings.Trim(val, `"`)))
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedNode strips the port of "192.0.2.43:47011" and the brackets and
+// port of "[2001:db8::1]:4711".
+func forwardedNode(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
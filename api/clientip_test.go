@@ -0,0 +1,147 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	const proxies = "10.0.0.0/8 2001:db8:ffff::/48"
+
+	tests := []struct {
+		name    string
+		header  string
+		trusted string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{
+			name:    "no header",
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.7"},
+			want:    "10.0.0.1",
+		},
+		{
+			name:    "header without trusted proxies",
+			header:  "forwarded",
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"Forwarded": "for=203.0.113.7"},
+			want:    "10.0.0.1",
+		},
+		{
+			name:    "forwarded from a trusted proxy",
+			header:  "forwarded",
+			trusted: proxies,
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"Forwarded": `for=198.51.100.9, for="203.0.113.7:47011";proto=https, for=10.0.0.2`},
+			want:    "203.0.113.7",
+		},
+		{
+			name:    "forwarded IPv6",
+			header:  "forwarded",
+			trusted: proxies,
+			remote:  "[2001:db8:ffff::1]:4000",
+			headers: map[string]string{"Forwarded": `For="[2001:db8:cafe::17]:4711"`},
+			want:    "2001:db8:cafe::17",
+		},
+		{
+			name:    "forwarded from an untrusted peer",
+			header:  "forwarded",
+			trusted: proxies,
+			remote:  "192.0.2.1:4000",
+			headers: map[string]string{"Forwarded": "for=203.0.113.7"},
+			want:    "192.0.2.1",
+		},
+		{
+			name:    "forwarded unknown node",
+			header:  "forwarded",
+			trusted: proxies,
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"Forwarded": "for=203.0.113.7, for=unknown, for=10.0.0.2"},
+			want:    "10.0.0.2",
+		},
+		{
+			name:    "forwarded missing",
+			header:  "forwarded",
+			trusted: proxies,
+			remote:  "10.0.0.1:4000",
+			want:    "10.0.0.1",
+		},
+		{
+			name:    "cf-connecting-ip from a trusted proxy",
+			header:  "cf-connecting-ip",
+			trusted: proxies,
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"CF-Connecting-IP": "203.0.113.7"},
+			want:    "203.0.113.7",
+		},
+		{
+			name:    "cf-connecting-ip from an untrusted peer",
+			header:  "CF-Connecting-IP",
+			trusted: proxies,
+			remote:  "192.0.2.1:4000",
+			headers: map[string]string{"CF-Connecting-IP": "203.0.113.7"},
+			want:    "192.0.2.1",
+		},
+		{
+			name:    "cf-connecting-ip invalid",
+			header:  "cf-connecting-ip",
+			trusted: proxies,
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"CF-Connecting-IP": "not an address"},
+			want:    "10.0.0.1",
+		},
+		{
+			name:    "x-forwarded-for skips trusted proxies",
+			header:  "x-forwarded-for",
+			trusted: proxies,
+			remote:  "10.0.0.1:4000",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.9, 203.0.113.7, 10.0.0.2"},
+			want:    "203.0.113.7",
+		},
+		{
+			name:    "x-forwarded-for from a private untrusted peer",
+			header:  "x-forwarded-for",
+			trusted: proxies,
+			remote:  "192.168.0.1:4000",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.7"},
+			want:    "192.168.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI(t, map[string]any{"api.proxy.header": tt.header, "api.proxy.trusted_cidrs": tt.trusted})
+			extract, err := api.ipExtractor()
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/cep/01001000", nil)
+			req.RemoteAddr = tt.remote
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			assert.Equal(t, tt.want, extract(req))
+		})
+	}
+}
+
+func TestClientIPInvalidSettings(t *testing.T) {
+	_, err := newTestAPI(t, map[string]any{"api.proxy.header": "x-client-ip"}).ipExtractor()
+	assert.ErrorContains(t, err, `unknown client IP header "x-client-ip"`)
+
+	_, err = newTestAPI(t, map[string]any{"api.proxy.trusted_cidrs": "10.0.0.0/33"}).ipExtractor()
+	assert.Error(t, err)
+}
+
+func TestClientIPWarning(t *testing.T) {
+	api := newTestAPI(t, map[string]any{"api.proxy.header": "forwarded"})
+	logs := observeLogs(api)
+	_, err := api.ipExtractor()
+	require.NoError(t, err)
+	assert.Equal(t, 1, logs.FilterMessage("Client IP header set without trusted proxies, it will be ignored").Len())
+}
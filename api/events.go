@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/brasilcep/api/logger"
+	"github.com/brasilcep/api/zipcodes"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// sseHeartbeat keeps idle event streams from being closed by proxies.
+const sseHeartbeat = 15 * time.Second
+
+// ImportEventsServer streams the progress of a running seed as Server-Sent
+// Events on GET /events. It binds seed.events.host, loopback by default, and
+// requires one of api.admin.tokens when set.
+type ImportEventsServer struct {
+	echo    *echo.Echo
+	logger  *logger.Logger
+	address string
+}
+
+func NewImportEventsServer(config *viper.Viper, logger *logger.Logger, bus *zipcodes.EventBus) *ImportEventsServer {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Use(middleware.Recover())
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: config.GetStringSlice("api.cors.allow.origins"),
+		AllowHeaders: config.GetStringSlice("api.cors.allow.headers"),
+		AllowMethods: config.GetStringSlice("api.cors.allow.methods"),
+	}))
+	if tokens := config.GetStringSlice("api.admin.tokens"); len(tokens) > 0 {
+		e.Use(bearerAuth(tokens))
+	}
+	e.GET("/events", streamEvents(bus))
+
+	return &ImportEventsServer{
+		echo:    e,
+		logger:  logger,
+		address: net.JoinHostPort(config.GetString("seed.events.host"), strconv.Itoa(config.GetInt("seed.events.port"))),
+	}
+}
+
+// Start serves in the background.
+func (s *ImportEventsServer) Start() {
+	s.logger.Info("Serving import events", zap.String("url", fmt.Sprintf("http://%s/events", s.address)))
+	go func() {
+		if err := s.echo.Start(s.address); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("Import events server failed", zap.Error(err))
+		}
+	}()
+}
+
+// Shutdown waits for the open streams to end, so close the bus first.
+func (s *ImportEventsServer) Shutdown(ctx context.Context) error {
+	return s.echo.Shutdown(ctx)
+}
+
+// streamEvents serves bus as text/event-stream. Clients reconnecting with
+// Last-Event-ID (or ?last_event_id=) get the events they missed, as long as
+// the bus still holds them.
+func streamEvents(bus *zipcodes.EventBus) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		lastID := c.Request().Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = c.QueryParam("last_event_id")
+		}
+		var since uint64
+		if lastID != "" {
+			var err error
+			if since, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+				return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Last-Event-ID inválido"})
+			}
+		}
+
+		events, cancel := bus.Subscribe(since)
+		defer cancel()
+
+		res := c.Response()
+		res.Header().Set(echo.HeaderContentType, "text/event-stream")
+		res.Header().Set(echo.HeaderCacheControl, "no-cache")
+		res.Header().Set(echo.HeaderConnection, "keep-alive")
+		res.Header().Set("X-Accel-Buffering", "no")
+		res.WriteHeader(http.StatusOK)
+		res.Flush()
+
+		heartbeat := time.NewTicker(sseHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-c.Request().Context().Done():
+				return nil
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(res, ": heartbeat\n\n"); err != nil {
+					return nil
+				}
+				res.Flush()
+			case event, ok := <-events:
+				if !ok {
+					return nil
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+					return nil
+				}
+				res.Flush()
+			}
+		}
+	}
+}
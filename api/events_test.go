@@ -0,0 +1,130 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brasilcep/api/zipcodes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sseEvent is a frame of a text/event-stream.
+type sseEvent struct {
+	id, event string
+	data      zipcodes.ProgressEvent
+}
+
+// readEvents returns the frames of an event stream until it ends.
+func readEvents(t *testing.T, res *http.Response) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var current sseEvent
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		field, value, _ := strings.Cut(scanner.Text(), ": ")
+		switch field {
+		case "id":
+			current.id = value
+		case "event":
+			current.event = value
+		case "data":
+			require.NoError(t, json.Unmarshal([]byte(value), &current.data))
+		case "":
+			if current.id != "" {
+				events = append(events, current)
+			}
+			current = sseEvent{}
+		}
+	}
+	return events
+}
+
+func setupEvents(t *testing.T, settings map[string]any) (*zipcodes.EventBus, *httptest.Server) {
+	t.Helper()
+	api := newTestAPI(t, settings)
+	bus := zipcodes.NewEventBus(10)
+	server := httptest.NewServer(NewImportEventsServer(api.config, api.logger, bus).echo)
+	t.Cleanup(server.Close)
+	return bus, server
+}
+
+func TestImportEvents(t *testing.T) {
+	bus, server := setupEvents(t, map[string]any{})
+	bus.Publish(zipcodes.ProgressEvent{Type: zipcodes.EventImportStarted, Source: "dne"})
+	bus.Publish(zipcodes.ProgressEvent{Type: zipcodes.EventFileProgress, File: "LOG_LOGRADOURO_SP.TXT", Records: 100})
+
+	res, err := http.Get(server.URL + "/events")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+
+	bus.Publish(zipcodes.ProgressEvent{Type: zipcodes.EventImportFinished})
+	bus.Close()
+
+	events := readEvents(t, res)
+	require.Len(t, events, 3, "kept events are replayed before the new ones")
+	assert.Equal(t, "1", events[0].id)
+	assert.Equal(t, zipcodes.EventImportStarted, events[0].event)
+	assert.Equal(t, "dne", events[0].data.Source)
+	assert.Equal(t, 100, events[1].data.Records)
+	assert.Equal(t, "3", events[2].id)
+	assert.Equal(t, zipcodes.EventImportFinished, events[2].event)
+}
+
+func TestImportEventsResume(t *testing.T) {
+	bus, server := setupEvents(t, map[string]any{})
+	for range 3 {
+		bus.Publish(zipcodes.ProgressEvent{Type: zipcodes.EventFileProgress})
+	}
+	bus.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "1")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	events := readEvents(t, res)
+	require.Len(t, events, 2)
+	assert.Equal(t, "2", events[0].id)
+
+	res, err = http.Get(server.URL + "/events?last_event_id=2")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	events = readEvents(t, res)
+	require.Len(t, events, 1)
+	assert.Equal(t, "3", events[0].id)
+
+	res, err = http.Get(server.URL + "/events?last_event_id=abc")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestImportEventsAccess(t *testing.T) {
+	api := newTestAPI(t, map[string]any{"seed.events.port": 8081})
+	assert.Equal(t, "127.0.0.1:8081", NewImportEventsServer(api.config, api.logger, zipcodes.NewEventBus(1)).address, "only local clients by default")
+
+	bus, server := setupEvents(t, map[string]any{"api.admin.tokens": []string{"admin"}})
+	bus.Close()
+
+	res, err := http.Get(server.URL + "/events")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin")
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
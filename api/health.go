@@ -0,0 +1,183 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/brasilcep/api/database"
+	"github.com/brasilcep/api/zipcodes"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/labstack/echo/v4"
+)
+
+// Component and overall health states. A warning does not make the service
+// unready.
+const (
+	HealthOK          = "ok"
+	HealthWarn        = "warn"
+	HealthFail        = "fail"
+	HealthDegraded    = "degraded"
+	HealthUnavailable = "unavailable"
+)
+
+// isProbe reports whether path is a health check or the metrics, which
+// probes and scrapers call without API keys and must never be throttled.
+func isProbe(path string) bool {
+	return path == "/metrics" || path == "/healthcheck" || strings.HasPrefix(path, "/health/")
+}
+
+// ComponentHealth is the result of a single readiness check.
+type ComponentHealth struct {
+	Status    string                 `json:"status"`
+	Detail    string                 `json:"detail,omitempty"`
+	LatencyMS float64                `json:"latency_ms"`
+	Info      map[string]interface{} `json:"info,omitempty"`
+}
+
+// HealthResponse is returned by the health endpoints.
+type HealthResponse struct {
+	Status     string                     `json:"status"`
+	Version    string                     `json:"version"`
+	Commit     string                     `json:"commit"`
+	Repo       string                     `json:"repo"`
+	Components map[string]ComponentHealth `json:"components,omitempty"`
+}
+
+// live only tells the process is up and serving; it never checks
+// dependencies, so a slow store does not get the pod restarted.
+func (api *API) live(c echo.Context) error {
+	return c.JSON(http.StatusOK, api.healthResponse(HealthOK, nil))
+}
+
+// ready checks everything needed to answer lookups and returns 503 when
+// any component fails.
+func (api *API) ready(c echo.Context) error {
+	status, components := api.readiness()
+	code := http.StatusOK
+	if status == HealthUnavailable {
+		code = http.StatusServiceUnavailable
+	}
+	return c.JSON(code, api.healthResponse(status, components))
+}
+
+func (api *API) healthResponse(status string, components map[string]ComponentHealth) HealthResponse {
+	return HealthResponse{
+		Status:     status,
+		Version:    api.buildInfo.Version,
+		Commit:     api.buildInfo.Commit,
+		Repo:       api.buildInfo.Repo,
+		Components: components,
+	}
+}
+
+// readiness runs the checks and returns the overall status.
+func (api *API) readiness() (string, map[string]ComponentHealth) {
+	db := database.GetDB()
+	components := map[string]ComponentHealth{
+		"database": timed(func() ComponentHealth { return checkDatabase(db) }),
+	}
+	if db != nil {
+		components["canary"] = timed(func() ComponentHealth { return api.checkCanary(db) })
+		components["dataset"] = timed(func() ComponentHealth { return api.datasetHealth(db) })
+	}
+
+	status := HealthOK
+	for _, component := range components {
+		switch component.Status {
+		case HealthFail:
+			return HealthUnavailable, components
+		case HealthWarn:
+			status = HealthDegraded
+		}
+	}
+	return status, components
+}
+
+func timed(check func() ComponentHealth) ComponentHealth {
+	start := time.Now()
+	result := check()
+	result.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	return result
+}
+
+func checkDatabase(db *badger.DB) ComponentHealth {
+	if db == nil {
+		return ComponentHealth{Status: HealthFail, Detail: "database not initialized"}
+	}
+	if db.IsClosed() {
+		return ComponentHealth{Status: HealthFail, Detail: "database closed"}
+	}
+	return ComponentHealth{Status: HealthOK}
+}
+
+// checkCanary looks up api.health.canary_cep, or any CEP when it is empty,
+// to make sure the store actually answers.
+func (api *API) checkCanary(db *badger.DB) ComponentHealth {
+	canary := api.config.GetString("api.health.canary_cep")
+	err := db.View(func(txn *badger.Txn) error {
+		if canary != "" {
+			_, err := txn.Get([]byte("cep:" + canary))
+			return err
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := []byte("cep:")
+		it.Seek(prefix)
+		if !it.ValidForPrefix(prefix) {
+			return badger.ErrKeyNotFound
+		}
+		return nil
+	})
+
+	switch {
+	case err == badger.ErrKeyNotFound && canary == "":
+		return ComponentHealth{Status: HealthFail, Detail: "no CEPs in the database"}
+	case err == badger.ErrKeyNotFound:
+		return ComponentHealth{Status: HealthFail, Detail: fmt.Sprintf("canary CEP %s not found", canary)}
+	case err != nil:
+		return ComponentHealth{Status: HealthFail, Detail: err.Error()}
+	}
+	return ComponentHealth{Status: HealthOK, Info: map[string]interface{}{"cep": canary}}
+}
+
+// datasetHealth reports the imported release. An unfinished import fails
+// only with api.require_complete_dataset; a stale one only warns.
+func (api *API) datasetHealth(db *badger.DB) ComponentHealth {
+	info, err := zipcodes.GetDatasetInfo(db)
+	if err != nil {
+		return ComponentHealth{Status: HealthFail, Detail: err.Error()}
+	}
+	if info == nil {
+		return ComponentHealth{Status: HealthWarn, Detail: "no dataset metadata, seeded by an older version"}
+	}
+
+	result := ComponentHealth{
+		Status: HealthOK,
+		Info: map[string]interface{}{
+			"status":     info.Status,
+			"source":     info.Source,
+			"started_at": info.StartedAt,
+		},
+	}
+	if !info.Complete() {
+		result.Status = HealthWarn
+		if api.config.GetBool("api.require_complete_dataset") {
+			result.Status = HealthFail
+		}
+		result.Detail = "dataset import did not finish"
+		return result
+	}
+
+	result.Info["completed_at"] = info.CompletedAt
+	maxAge := time.Duration(api.config.GetInt("api.health.max_dataset_age_days")) * 24 * time.Hour
+	if maxAge > 0 && time.Since(info.CompletedAt) > maxAge {
+		result.Status = HealthWarn
+		result.Detail = fmt.Sprintf("dataset older than %d days", api.config.GetInt("api.health.max_dataset_age_days"))
+	}
+	return result
+}
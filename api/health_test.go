@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brasilcep/api/database"
+	"github.com/brasilcep/api/zipcodes"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupHealth returns the API serving the health checks on an empty store.
+func setupHealth(t *testing.T, settings map[string]any) *API {
+	t.Helper()
+	api := newTestAPI(t, settings)
+	openTestDatabase(t, api.config)
+	api.echo.GET("/healthcheck", api.health)
+	api.echo.GET("/health/live", api.live)
+	api.echo.GET("/health/ready", api.ready)
+	return api
+}
+
+func healthRequest(t *testing.T, api *API, path string) (HealthResponse, int) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	api.echo.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var health HealthResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &health))
+	return health, rec.Code
+}
+
+func TestHealthEmptyStore(t *testing.T) {
+	api := setupHealth(t, map[string]any{"api.health.canary_cep": ""})
+
+	health, status := healthRequest(t, api, "/health/live")
+	assert.Equal(t, http.StatusOK, status, "liveness never checks the store")
+	assert.Equal(t, HealthOK, health.Status)
+	assert.Equal(t, "test", health.Version)
+	assert.Empty(t, health.Components)
+
+	health, status = healthRequest(t, api, "/health/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, HealthUnavailable, health.Status)
+	assert.Equal(t, HealthOK, health.Components["database"].Status)
+	assert.Equal(t, HealthFail, health.Components["canary"].Status)
+	assert.Equal(t, "no CEPs in the database", health.Components["canary"].Detail)
+	assert.Equal(t, HealthWarn, health.Components["dataset"].Status)
+
+	_, status = healthRequest(t, api, "/healthcheck")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestHealthReady(t *testing.T) {
+	api := setupHealth(t, map[string]any{"api.health.canary_cep": "01310100"})
+	seedTestDatabase(t, api, testStreets)
+
+	health, status := healthRequest(t, api, "/health/ready")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, HealthOK, health.Status)
+	for _, name := range []string{"database", "canary", "dataset"} {
+		assert.Equal(t, HealthOK, health.Components[name].Status, name)
+	}
+	assert.Equal(t, zipcodes.DatasetComplete, health.Components["dataset"].Info["status"])
+
+	api.config.Set("api.health.canary_cep", "99999999")
+	health, status = healthRequest(t, api, "/health/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "canary CEP 99999999 not found", health.Components["canary"].Detail)
+}
+
+func TestHealthDataset(t *testing.T) {
+	api := setupHealth(t, map[string]any{"api.health.canary_cep": "01310100", "api.health.max_dataset_age_days": 30})
+	seedTestDatabase(t, api, testStreets)
+
+	setDataset := func(update func(*zipcodes.DatasetInfo)) {
+		info, err := zipcodes.GetDatasetInfo(database.GetDB())
+		require.NoError(t, err)
+		update(info)
+		value, err := json.Marshal(info)
+		require.NoError(t, err)
+		require.NoError(t, database.GetDB().Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte("meta:dataset"), value)
+		}))
+	}
+
+	setDataset(func(info *zipcodes.DatasetInfo) { info.CompletedAt = time.Now().AddDate(0, 0, -31) })
+	health, status := healthRequest(t, api, "/health/ready")
+	assert.Equal(t, http.StatusOK, status, "a stale dataset only warns")
+	assert.Equal(t, HealthDegraded, health.Status)
+	assert.Equal(t, "dataset older than 30 days", health.Components["dataset"].Detail)
+
+	health, status = healthRequest(t, api, "/healthcheck")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, HealthOK, health.Status, "the original check only reports ok or unavailable")
+
+	setDataset(func(info *zipcodes.DatasetInfo) { info.Status = zipcodes.DatasetImporting })
+	health, status = healthRequest(t, api, "/health/ready")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "dataset import did not finish", health.Components["dataset"].Detail)
+
+	api.config.Set("api.require_complete_dataset", true)
+	health, status = healthRequest(t, api, "/health/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, HealthFail, health.Components["dataset"].Status)
+}
+
+func TestHealthClosedStore(t *testing.T) {
+	api := setupHealth(t, map[string]any{})
+	database.CloseDatabase()
+
+	_, status := healthRequest(t, api, "/health/live")
+	assert.Equal(t, http.StatusOK, status)
+	health, status := healthRequest(t, api, "/health/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "database closed", health.Components["database"].Detail)
+}
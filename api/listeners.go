@@ -0,0 +1,133 @@
+package api
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// servedListeners are the listeners a server accepts connections from.
+type servedListeners struct {
+	server    *http.Server
+	listeners []net.Listener
+}
+
+// listenerSpec is an entry of api.listeners: http://host:port,
+// https://host:port, unix:///path/to.sock or a bare host:port, which is
+// served over TLS when api.tls.enable is set.
+type listenerSpec struct {
+	network string
+	address string
+	tls     bool
+}
+
+func (s listenerSpec) String() string {
+	switch {
+	case s.network == "unix":
+		return "unix://" + s.address
+	case s.tls:
+		return "https://" + s.address
+	default:
+		return "http://" + s.address
+	}
+}
+
+func parseListener(entry string, tlsByDefault bool) (listenerSpec, error) {
+	scheme, address, ok := strings.Cut(entry, "://")
+	if !ok {
+		return listenerSpec{network: "tcp", address: entry, tls: tlsByDefault}, nil
+	}
+	switch scheme {
+	case "http":
+		return listenerSpec{network: "tcp", address: address}, nil
+	case "https":
+		return listenerSpec{network: "tcp", address: address, tls: true}, nil
+	case "unix":
+		if address == "" {
+			return listenerSpec{}, fmt.Errorf("listener %q has no socket path", entry)
+		}
+		return listenerSpec{network: "unix", address: address}, nil
+	default:
+		return listenerSpec{}, fmt.Errorf("listener %q has unknown scheme %q", entry, scheme)
+	}
+}
+
+// publicListeners returns api.listeners, or :<api.port> when it is empty.
+func (api *API) publicListeners() []string {
+	entries := api.config.GetStringSlice("api.listeners")
+	if len(entries) == 0 {
+		entries = []string{":" + strconv.Itoa(api.config.GetInt("api.port"))}
+	}
+	return entries
+}
+
+// listen opens a listener for every entry; bare addresses are served over
+// TLS when tlsByDefault is set. On error the listeners already opened are
+// closed.
+func (api *API) listen(entries []string, tlsByDefault bool, tlsConfig *tls.Config) ([]net.Listener, []listenerSpec, error) {
+	var listeners []net.Listener
+	var specs []listenerSpec
+	fail := func(err error) ([]net.Listener, []listenerSpec, error) {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		return nil, nil, err
+	}
+
+	for _, entry := range entries {
+		spec, err := parseListener(entry, tlsByDefault)
+		if err != nil {
+			return fail(err)
+		}
+		if spec.tls && tlsConfig == nil {
+			return fail(fmt.Errorf("listener %s needs api.tls.enable and a certificate", spec))
+		}
+
+		ln, err := api.openListener(spec)
+		if err != nil {
+			return fail(err)
+		}
+		if spec.tls {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		listeners = append(listeners, ln)
+		specs = append(specs, spec)
+	}
+	return listeners, specs, nil
+}
+
+func (api *API) openListener(spec listenerSpec) (net.Listener, error) {
+	if spec.network != "unix" {
+		return net.Listen(spec.network, spec.address)
+	}
+
+	// A socket left behind by a crash would make the bind fail.
+	if info, err := os.Lstat(spec.address); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(spec.address); err != nil {
+			return nil, err
+		}
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", spec.address)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := strconv.ParseUint(api.config.GetString("api.unix_socket_mode"), 8, 32)
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("invalid api.unix_socket_mode: %w", err)
+	}
+	if err := os.Chmod(spec.address, fs.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
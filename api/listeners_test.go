@@ -0,0 +1,183 @@
+package api
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brasilcep/api/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListener(t *testing.T) {
+	tests := []struct {
+		entry string
+		tls   bool
+		want  listenerSpec
+	}{
+		{":8080", false, listenerSpec{network: "tcp", address: ":8080"}},
+		{":8443", true, listenerSpec{network: "tcp", address: ":8443", tls: true}},
+		{"http://127.0.0.1:8080", true, listenerSpec{network: "tcp", address: "127.0.0.1:8080"}},
+		{"https://:8443", false, listenerSpec{network: "tcp", address: ":8443", tls: true}},
+		{"unix:///run/brasilcep.sock", true, listenerSpec{network: "unix", address: "/run/brasilcep.sock"}},
+	}
+	for _, tt := range tests {
+		spec, err := parseListener(tt.entry, tt.tls)
+		require.NoError(t, err, tt.entry)
+		assert.Equal(t, tt.want, spec, tt.entry)
+	}
+
+	_, err := parseListener("unix://", false)
+	assert.ErrorContains(t, err, "has no socket path")
+	_, err = parseListener("ftp://:21", false)
+	assert.ErrorContains(t, err, `unknown scheme "ftp"`)
+}
+
+func TestPublicListeners(t *testing.T) {
+	api := newTestAPI(t, map[string]any{"api.port": 8080})
+	assert.Equal(t, []string{":8080"}, api.publicListeners())
+
+	api.config.Set("api.listeners", []string{"unix:///run/brasilcep.sock", "http://:9090"})
+	assert.Equal(t, []string{"unix:///run/brasilcep.sock", "http://:9090"}, api.publicListeners())
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	api := newTestAPI(t, map[string]any{"api.unix_socket_mode": "0660"})
+
+	// A socket left behind by a crash is replaced.
+	stale, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listeners, specs, err := api.listen([]string{"unix://" + socket, "http://127.0.0.1:0"}, false, nil)
+	require.NoError(t, err)
+	require.Len(t, listeners, 2)
+	assert.Equal(t, "unix://"+socket, specs[0].String())
+
+	info, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, fs.FileMode(0o660), info.Mode().Perm())
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	for _, ln := range listeners {
+		go server.Serve(ln)
+	}
+	defer server.Shutdown(context.Background())
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	res, err := client.Get("http://unix/health/live")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res, err = http.Get("http://" + listeners[1].Addr().String() + "/health/live")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+}
+
+func TestListenErrors(t *testing.T) {
+	api := newTestAPI(t, map[string]any{})
+
+	_, _, err := api.listen([]string{"http://127.0.0.1:0", "https://127.0.0.1:0"}, false, nil)
+	assert.ErrorContains(t, err, "needs api.tls.enable and a certificate")
+	_, _, err = api.listen([]string{"127.0.0.1:0"}, true, nil)
+	assert.Error(t, err, "bare addresses use TLS when it is enabled")
+
+	// The listeners opened before the failure are closed.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := ln.Addr().String()
+	ln.Close()
+	_, _, err = api.listen([]string{address, "ftp://:21"}, false, nil)
+	require.Error(t, err)
+	ln, err = net.Listen("tcp", address)
+	require.NoError(t, err, "the first listener was released")
+	ln.Close()
+
+	api.config.Set("api.unix_socket_mode", "rw")
+	_, _, err = api.listen([]string{"unix://" + filepath.Join(t.TempDir(), "api.sock")}, false, nil)
+	assert.ErrorContains(t, err, "invalid api.unix_socket_mode")
+}
+
+func TestListenCancel(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	api := newTestAPI(t, map[string]any{
+		"api.listeners":           []string{"unix://" + socket},
+		"api.admin.enable":        false,
+		"api.prometheus.enable":   false,
+		"api.keys.enable":         true,
+		"changes.webhooks.urls":   []string{"http://127.0.0.1:1/hook"},
+		"changes.webhooks.secret": "s3cret",
+	})
+	openTestDatabase(t, api.config)
+	seedTestDatabase(t, api, testStreets)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listenErr := make(chan error, 1)
+	go func() { listenErr <- api.Listen(ctx) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	require.Eventually(t, func() bool {
+		res, err := client.Get("http://unix/health/live")
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		return res.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NotZero(t, goroutinesIn("api.(*WebhookDispatcher)"))
+	require.NotZero(t, goroutinesIn("api.(*apiKeyAuth).runReload"))
+	require.Equal(t, 2, goroutinesIn("database.garbageCollector", "database.NewDatabase.func"))
+
+	cancel()
+	select {
+	case err := <-listenErr:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listen did not return after the context was cancelled")
+	}
+	assert.Zero(t, goroutinesIn("api.(*WebhookDispatcher)", "api.(*apiKeyAuth).runReload"), "Listen stops its background workers")
+
+	require.NoError(t, database.CloseDatabase())
+	assert.Eventually(t, func() bool {
+		return goroutinesIn("database.garbageCollector", "database.NewDatabase.func") == 0
+	}, time.Second, 10*time.Millisecond, "closing the database stops the GC and stats goroutines")
+}
+
+// goroutinesIn counts the goroutines running one of the named functions.
+func goroutinesIn(functions ...string) int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	count := 0
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		for _, function := range functions {
+			if strings.Contains(stack, function) {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
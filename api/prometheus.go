@@ -1,31 +1,139 @@
 package api
 
 import (
-	"log"
+	"time"
 
+	"github.com/brasilcep/api/database"
+	"github.com/brasilcep/api/zipcodes"
+	"github.com/dgraph-io/ristretto/v2"
 	"github.com/labstack/echo-contrib/echoprometheus"
-	"github.com/labstack/echo/v4"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+const metricsNamespace = "brasilcep"
+
+// Results of a CEP lookup.
+const (
+	lookupFound    = "found"
+	lookupNotFound = "not_found"
+	lookupInvalid  = "invalid"
+)
+
+var (
+	lookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "lookups_total",
+		Help:      "CEP lookups, partitioned by result: found, not_found or invalid.",
+	}, []string{"result"})
+
+	lookupsFoundTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "lookups_found_total",
+		Help:      "CEPs found, partitioned by UF and source type (tipo_origem).",
+	}, []string{"uf", "tipo_origem"})
+
+	dbReadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "db_read_duration_seconds",
+		Help:      "Latency of Badger reads, partitioned by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.00005, 2, 14),
+	}, []string{"operation"})
+)
+
+// EnablePrometheus registers the domain metrics and the HTTP middleware.
+// /metrics itself is served by the admin server.
 func (api *API) EnablePrometheus() {
-	e := api.echo
-	customCounter := prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "custom_requests_total",
-			Help: "How many HTTP requests processed, partitioned by status code and HTTP method.",
-		},
-	)
-	if err := prometheus.Register(customCounter); err != nil {
-		log.Fatal(err)
+	prometheus.MustRegister(lookupsTotal, lookupsFoundTotal, dbReadDuration, &storeCollector{})
+	api.echo.Use(echoprometheus.NewMiddleware("echo"))
+}
+
+// observeLookup counts a lookup of the CEP endpoint; found is nil unless
+// result is lookupFound.
+func observeLookup(result string, found *zipcodes.CEPCompleto) {
+	lookupsTotal.WithLabelValues(result).Inc()
+	if found != nil {
+		lookupsFoundTotal.WithLabelValues(found.UF, found.TipoOrigem).Inc()
 	}
+}
 
-	e.Use(echoprometheus.NewMiddlewareWithConfig(echoprometheus.MiddlewareConfig{
-		AfterNext: func(c echo.Context, err error) {
-			customCounter.Inc()
-		},
-	}))
+// observeRead records the latency of a read that started at start.
+func observeRead(operation string, start time.Time) {
+	dbReadDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+var (
+	lsmSizeDesc = prometheus.NewDesc(metricsNamespace+"_badger_lsm_size_bytes",
+		"Size of the Badger LSM tree.", nil, nil)
+	vlogSizeDesc = prometheus.NewDesc(metricsNamespace+"_badger_vlog_size_bytes",
+		"Size of the Badger value log.", nil, nil)
+	cacheHitsDesc = prometheus.NewDesc(metricsNamespace+"_badger_cache_hits_total",
+		"Hits of the Badger block and index caches.", []string{"cache"}, nil)
+	cacheMissesDesc = prometheus.NewDesc(metricsNamespace+"_badger_cache_misses_total",
+		"Misses of the Badger block and index caches.", []string{"cache"}, nil)
+	cacheRatioDesc = prometheus.NewDesc(metricsNamespace+"_badger_cache_hit_ratio",
+		"Hit ratio of the Badger block and index caches.", []string{"cache"}, nil)
+	gcRunsDesc = prometheus.NewDesc(metricsNamespace+"_badger_gc_runs_total",
+		"Value log garbage collection passes.", nil, nil)
+	gcRewritesDesc = prometheus.NewDesc(metricsNamespace+"_badger_gc_rewrites_total",
+		"Value log garbage collection passes that rewrote a file.", nil, nil)
+	datasetInfoDesc = prometheus.NewDesc(metricsNamespace+"_dataset_info",
+		"Source and status of the last import, always 1.", []string{"source", "status"}, nil)
+	datasetCompletedDesc = prometheus.NewDesc(metricsNamespace+"_dataset_completed_timestamp_seconds",
+		"Time the last complete import finished.", nil, nil)
+	datasetAgeDesc = prometheus.NewDesc(metricsNamespace+"_dataset_age_seconds",
+		"Seconds since the last complete import finished.", nil, nil)
+	datasetCEPsDesc = prometheus.NewDesc(metricsNamespace+"_dataset_ceps",
+		"CEPs counted by the last import.", nil, nil)
+)
 
-	e.GET("/metrics", echoprometheus.NewHandler()) // adds route to serve gathered metrics
+// storeCollector reads the Badger and dataset gauges when scraped, so they
+// never go stale and cost nothing between scrapes.
+type storeCollector struct{}
 
+func (storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		lsmSizeDesc, vlogSizeDesc, cacheHitsDesc, cacheMissesDesc, cacheRatioDesc,
+		gcRunsDesc, gcRewritesDesc, datasetInfoDesc, datasetCompletedDesc, datasetAgeDesc, datasetCEPsDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (storeCollector) Collect(ch chan<- prometheus.Metric) {
+	runs, rewrites := database.GCStats()
+	ch <- prometheus.MustNewConstMetric(gcRunsDesc, prometheus.CounterValue, float64(runs))
+	ch <- prometheus.MustNewConstMetric(gcRewritesDesc, prometheus.CounterValue, float64(rewrites))
+
+	db := database.GetDB()
+	if db == nil || db.IsClosed() {
+		return
+	}
+
+	lsm, vlog := db.Size()
+	ch <- prometheus.MustNewConstMetric(lsmSizeDesc, prometheus.GaugeValue, float64(lsm))
+	ch <- prometheus.MustNewConstMetric(vlogSizeDesc, prometheus.GaugeValue, float64(vlog))
+	collectCache(ch, "block", db.BlockCacheMetrics())
+	collectCache(ch, "index", db.IndexCacheMetrics())
+
+	if info, err := zipcodes.GetDatasetInfo(db); err == nil && info != nil {
+		ch <- prometheus.MustNewConstMetric(datasetInfoDesc, prometheus.GaugeValue, 1, info.Source, info.Status)
+		if info.Complete() && !info.CompletedAt.IsZero() {
+			ch <- prometheus.MustNewConstMetric(datasetCompletedDesc, prometheus.GaugeValue, float64(info.CompletedAt.Unix()))
+			ch <- prometheus.MustNewConstMetric(datasetAgeDesc, prometheus.GaugeValue, time.Since(info.CompletedAt).Seconds())
+		}
+	}
+	if stats, err := zipcodes.GetStats(db); err == nil && stats != nil {
+		ch <- prometheus.MustNewConstMetric(datasetCEPsDesc, prometheus.GaugeValue, float64(stats.Total))
+	}
+}
+
+// collectCache exports a ristretto cache; metrics is nil when the cache is
+// disabled.
+func collectCache(ch chan<- prometheus.Metric, cache string, metrics *ristretto.Metrics) {
+	if metrics == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(metrics.Hits()), cache)
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(metrics.Misses()), cache)
+	ch <- prometheus.MustNewConstMetric(cacheRatioDesc, prometheus.GaugeValue, metrics.Ratio(), cache)
 }
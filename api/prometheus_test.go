@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brasilcep/api/database"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// metricValue gathers collector and returns the value of the metric name
+// with labels: a counter or gauge value, or the sample count of a
+// histogram.
+func metricValue(t *testing.T, collector prometheus.Collector, name string, labels map[string]string) (float64, bool) {
+	t.Helper()
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(collector))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if want, ok := labels[label.GetName()]; ok && want != label.GetValue() {
+					continue metrics
+				}
+			}
+			switch {
+			case metric.Counter != nil:
+				return metric.GetCounter().GetValue(), true
+			case metric.Histogram != nil:
+				return float64(metric.GetHistogram().GetSampleCount()), true
+			default:
+				return metric.GetGauge().GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestLookupMetrics(t *testing.T) {
+	api := newTestAPI(t, map[string]any{})
+	openTestDatabase(t, api.config)
+	seedTestDatabase(t, api, testStreets)
+	api.echo.GET("/cep/:cep", api.findZipcode)
+
+	value := func(collector prometheus.Collector, name string, labels map[string]string) float64 {
+		v, _ := metricValue(t, collector, name, labels)
+		return v
+	}
+	lookups := func(result string) float64 {
+		return value(lookupsTotal, "brasilcep_lookups_total", map[string]string{"result": result})
+	}
+	foundSP := func() float64 {
+		return value(lookupsFoundTotal, "brasilcep_lookups_found_total", map[string]string{"uf": "SP", "tipo_origem": "logradouro"})
+	}
+	reads := func() float64 {
+		return value(dbReadDuration, "brasilcep_db_read_duration_seconds", map[string]string{"operation": "cep"})
+	}
+	found, notFound, invalid, sp, read := lookups(lookupFound), lookups(lookupNotFound), lookups(lookupInvalid), foundSP(), reads()
+
+	for _, path := range []string{"/cep/01310-100", "/cep/01310200", "/cep/99999999", "/cep/123"} {
+		rec := httptest.NewRecorder()
+		api.echo.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	assert.Equal(t, found+2, lookups(lookupFound))
+	assert.Equal(t, notFound+1, lookups(lookupNotFound))
+	assert.Equal(t, invalid+1, lookups(lookupInvalid))
+	assert.Equal(t, sp+2, foundSP())
+	assert.Equal(t, read+3, reads(), "invalid CEPs are not read")
+}
+
+func TestStoreCollector(t *testing.T) {
+	api := newTestAPI(t, map[string]any{})
+	openTestDatabase(t, api.config)
+	seedTestDatabase(t, api, testStreets)
+
+	for _, name := range []string{
+		"brasilcep_badger_lsm_size_bytes", "brasilcep_badger_vlog_size_bytes", "brasilcep_badger_gc_runs_total",
+		"brasilcep_dataset_age_seconds", "brasilcep_dataset_completed_timestamp_seconds",
+	} {
+		_, ok := metricValue(t, &storeCollector{}, name, nil)
+		assert.True(t, ok, name)
+	}
+
+	ceps, ok := metricValue(t, &storeCollector{}, "brasilcep_dataset_ceps", nil)
+	require.True(t, ok)
+	assert.Equal(t, 6.0, ceps)
+	_, ok = metricValue(t, &storeCollector{}, "brasilcep_dataset_info", map[string]string{"status": "complete"})
+	assert.True(t, ok)
+
+	require.NoError(t, database.CloseDatabase())
+	_, ok = metricValue(t, &storeCollector{}, "brasilcep_dataset_ceps", nil)
+	assert.False(t, ok, "a closed store is not read")
+	_, ok = metricValue(t, &storeCollector{}, "brasilcep_badger_gc_runs_total", nil)
+	assert.True(t, ok)
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brasilcep/api/ratelimit"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// routeCost is how many hits a request to a route counts as. route is an
+// Echo route path; a trailing * matches every route with that prefix.
+type routeCost struct {
+	route string
+	cost  int64
+}
+
+// ipRateLimiter limits the requests without an API key by client IP.
+type ipRateLimiter struct {
+	*ratelimit.Limiter
+	costs     []routeCost
+	allowlist []*net.IPNet
+}
+
+// defaultIPRatePolicy applies without api.rate.limit.policies, keeping
+// about the throughput of the token bucket the policies replaced: 100
+// requests per second.
+var defaultIPRatePolicy = ratelimit.Policy{Limit: 100, Window: time.Second}
+
+// newIPRateLimiter builds the limiter from api.rate.limit.*. Without
+// api.rate.limit.policies, the policy is defaultIPRatePolicy, or
+// api.rate.limit.max_allowed_requests_per_window requests per
+// api.rate.limit.expire_minutes when one of those is set.
+func (api *API) newIPRateLimiter(store ratelimit.Store) (*ipRateLimiter, error) {
+	var policies []ratelimit.Policy
+	for _, s := range api.config.GetStringSlice("api.rate.limit.policies") {
+		p, err := ratelimit.ParsePolicy(s)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	if len(policies) == 0 {
+		// Before the policies, max_allowed_requests_per_window was a rate
+		// per second with a burst; keep operators from silently getting a
+		// far stricter limit.
+		legacy := false
+		for _, key := range []string{"max_allowed_requests_per_window", "requests_burst", "expire_minutes"} {
+			legacy = legacy || envSet("api.rate.limit."+key)
+		}
+		policies = []ratelimit.Policy{defaultIPRatePolicy}
+		if legacy {
+			policies[0] = ratelimit.Policy{
+				Limit:  api.config.GetInt64("api.rate.limit.max_allowed_requests_per_window"),
+				Window: time.Duration(api.config.GetInt("api.rate.limit.expire_minutes")) * time.Minute,
+			}
+			api.logger.Warn("Rate limit configured with the legacy settings: max_allowed_requests_per_window now counts requests per expire_minutes window, not per second, and requests_burst is ignored; set api.rate.limit.policies instead",
+				zap.String("policy", policies[0].String()))
+		}
+	}
+
+	costs, err := parseRouteCosts(api.config.GetStringSlice("api.rate.limit.route_costs"))
+	if err != nil {
+		return nil, err
+	}
+	allowlist, err := parseCIDRs(api.config.GetStringSlice("api.rate.limit.allow_cidrs"))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(policies))
+	for n, p := range policies {
+		names[n] = p.String()
+	}
+	api.logger.Info("Rate limiting by IP", zap.String("store", api.config.GetString("api.rate.limit.store")), zap.Strings("policies", names),
+		zap.Strings("route_costs", api.config.GetStringSlice("api.rate.limit.route_costs")))
+
+	limiter := ratelimit.NewLimiter(store, policies, func(err error) {
+		api.logger.Warn("Rate limit store failed, allowing request", zap.Error(err))
+	})
+	return &ipRateLimiter{Limiter: limiter, costs: costs, allowlist: allowlist}, nil
+}
+
+// rateLimitStore returns the store selected by api.rate.limit.store. Only
+// redis and file make the limits hold across replicas.
+func (api *API) rateLimitStore() (ratelimit.Store, error) {
+	switch kind := api.config.GetString("api.rate.limit.store"); kind {
+	case "memory":
+		return ratelimit.NewMemoryStore(), nil
+	case "redis":
+		return ratelimit.NewRedisStore(ratelimit.RedisConfig{
+			Addr:     api.config.GetString("api.rate.limit.redis.addr"),
+			Password: api.config.GetString("api.rate.limit.redis.password"),
+			DB:       api.config.GetInt("api.rate.limit.redis.db"),
+			Timeout:  time.Duration(api.config.GetInt("api.rate.limit.redis.timeout_ms")) * time.Millisecond,
+			PoolSize: api.config.GetInt("api.rate.limit.redis.pool_size"),
+			Prefix:   api.config.GetString("api.rate.limit.redis.prefix"),
+		}), nil
+	case "file":
+		return ratelimit.NewFileStore(api.config.GetString("api.rate.limit.file.path"))
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", kind)
+	}
+}
+
+func (l *ipRateLimiter) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// Requests with an API key are limited by the key instead, and a
+		// throttled probe would take the replica out of rotation.
+		if c.Get(apiKeyContextKey) != nil || isProbe(c.Request().URL.Path) {
+			return next(c)
+		}
+
+		ip := c.RealIP()
+		if containsIP(l.allowlist, net.ParseIP(ip)) {
+			return next(c)
+		}
+
+		decision := l.Allow(ip, l.cost(c.Path()))
+		setRateLimitHeaders(c.Response().Header(), decision)
+		if !decision.Allowed {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(secondsUntilReset(decision.Reset)))
+			return c.JSON(http.StatusTooManyRequests, ErrorResponse{Error: fmt.Sprintf("limite de requisições excedido (%s)", decision.Policy)})
+		}
+		return next(c)
+	}
+}
+
+func (l *ipRateLimiter) cost(route string) int64 {
+	for _, rc := range l.costs {
+		if matchRoute(rc.route, route) {
+			return rc.cost
+		}
+	}
+	return 1
+}
+
+// matchRoute reports whether path matches pattern; a trailing * in pattern
+// matches any suffix.
+func matchRoute(pattern, path string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(path, prefix)
+	}
+	return pattern == path
+}
+
+// parseRouteCosts parses "<route>=<cost>" entries.
+func parseRouteCosts(entries []string) ([]routeCost, error) {
+	costs := make([]routeCost, 0, len(entries))
+	for _, entry := range entries {
+		route, cost, ok := strings.Cut(entry, "=")
+		n, err := strconv.ParseInt(cost, 10, 64)
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid route cost %q, expected <route>=<cost>", entry)
+		}
+		costs = append(costs, routeCost{route: route, cost: n})
+	}
+	return costs, nil
+}
+
+// parseCIDRs parses networks in CIDR notation or single IPs.
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// setRateLimitHeaders describes the policy closest to its limit. Nothing is
+// set when the store failed and no policy was counted.
+func setRateLimitHeaders(h http.Header, decision ratelimit.Decision) {
+	if decision.Policy.Limit == 0 {
+		return
+	}
+	h.Set("X-RateLimit-Policy", decision.Policy.String())
+	h.Set("X-RateLimit-Limit", strconv.FormatInt(decision.Policy.Limit, 10))
+	h.Set("X-RateLimit-Remaining", strconv.FormatInt(decision.Remaining, 10))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(secondsUntilReset(decision.Reset)))
+}
+
+// envSet reports whether the environment sets key, which IsSet does not
+// tell apart from a default.
+func envSet(key string) bool {
+	_, ok := os.LookupEnv(strings.ToUpper(strings.ReplaceAll(key, ".", "_")))
+	return ok
+}
+
+// secondsUntilReset rounds up, so clients retrying after it are not denied.
+func secondsUntilReset(t time.Time) int {
+	return max(int(math.Ceil(time.Until(t).Seconds())), 0)
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/brasilcep/api/ratelimit"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupIPRateLimit returns a handler limited by IP with the given settings.
+func setupIPRateLimit(t *testing.T, settings map[string]any) *echo.Echo {
+	t.Helper()
+	api := newTestAPI(t, settings)
+	limiter, err := api.newIPRateLimiter(ratelimit.NewMemoryStore())
+	require.NoError(t, err)
+
+	e := echo.New()
+	e.IPExtractor = echo.ExtractIPDirect()
+	e.Use(limiter.middleware)
+	ok := func(c echo.Context) error { return c.String(http.StatusOK, "ok") }
+	e.GET("/cep/:cep", ok)
+	e.GET("/ceps", ok)
+	e.GET("/bulk/ceps.ndjson", ok)
+	e.GET("/healthcheck", ok)
+	e.GET("/health/ready", ok)
+	return e
+}
+
+func requestFrom(e *echo.Echo, ip, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.RemoteAddr = net.JoinHostPort(ip, "40000")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIPRateLimitPolicies(t *testing.T) {
+	e := setupIPRateLimit(t, map[string]any{"api.rate.limit.policies": []string{"3/s", "5/h"}})
+
+	rec := requestFrom(e, "203.0.113.1", "/cep/01001000")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "3/s", rec.Header().Get("X-RateLimit-Policy"), "the policy closest to its limit")
+	assert.Equal(t, "3", rec.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "2", rec.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "1", rec.Header().Get("X-RateLimit-Reset"))
+
+	for n := 0; n < 4; n++ {
+		rec = requestFrom(e, "203.0.113.1", "/cep/01001000")
+		if rec.Code != http.StatusOK {
+			break
+		}
+	}
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get("X-RateLimit-Remaining"))
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.Positive(t, retryAfter)
+	assert.Contains(t, rec.Body.String(), "limite de requisições excedido")
+
+	assert.Equal(t, http.StatusOK, requestFrom(e, "203.0.113.2", "/cep/01001000").Code, "IPs are limited apart")
+}
+
+func TestIPRateLimitRouteCosts(t *testing.T) {
+	e := setupIPRateLimit(t, map[string]any{
+		"api.rate.limit.policies":    []string{"10/h"},
+		"api.rate.limit.route_costs": []string{"/ceps=4", "/bulk/*=100"},
+	})
+
+	rec := requestFrom(e, "203.0.113.1", "/ceps")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "6", rec.Header().Get("X-RateLimit-Remaining"))
+
+	rec = requestFrom(e, "203.0.113.1", "/cep/01001000")
+	assert.Equal(t, "5", rec.Header().Get("X-RateLimit-Remaining"), "unlisted routes cost one")
+
+	rec = requestFrom(e, "203.0.113.1", "/bulk/ceps.ndjson")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "10/h", rec.Header().Get("X-RateLimit-Policy"))
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+}
+
+func TestIPRateLimitExemptions(t *testing.T) {
+	e := setupIPRateLimit(t, map[string]any{
+		"api.rate.limit.policies":    []string{"1/h"},
+		"api.rate.limit.allow_cidrs": []string{"10.0.0.0/8", "2001:db8::1"},
+	})
+
+	for n := 0; n < 3; n++ {
+		for _, ip := range []string{"10.1.2.3", "2001:db8::1"} {
+			rec := requestFrom(e, ip, "/cep/01001000")
+			assert.Equal(t, http.StatusOK, rec.Code, ip)
+			assert.Empty(t, rec.Header().Get("X-RateLimit-Limit"), ip)
+		}
+	}
+
+	assert.Equal(t, http.StatusOK, requestFrom(e, "203.0.113.1", "/cep/01001000").Code)
+	assert.Equal(t, http.StatusTooManyRequests, requestFrom(e, "203.0.113.1", "/cep/01001000").Code)
+	for _, path := range []string{"/healthcheck", "/health/ready"} {
+		assert.Equal(t, http.StatusOK, requestFrom(e, "203.0.113.1", path).Code, "probes are never limited: %s", path)
+	}
+}
+
+func TestIPRateLimitLegacySettings(t *testing.T) {
+	api := newTestAPI(t, map[string]any{})
+	logs := observeLogs(api)
+	limiter, err := api.newIPRateLimiter(ratelimit.NewMemoryStore())
+	require.NoError(t, err)
+	assert.Zero(t, logs.FilterMessageSnippet("legacy").Len(), "the defaults alone do not warn")
+	assert.Equal(t, "100/s", limiter.Allow("203.0.113.1", 1).Policy.String(), "the default keeps about the old throughput")
+	entries := logs.FilterMessage("Rate limiting by IP").All()
+	require.Len(t, entries, 1, "the effective policy is logged")
+	assert.Equal(t, []any{"100/s"}, entries[0].ContextMap()["policies"])
+
+	t.Setenv("API_RATE_LIMIT_MAX_ALLOWED_REQUESTS_PER_WINDOW", "100")
+	t.Setenv("API_RATE_LIMIT_REQUESTS_BURST", "20")
+	api = newTestAPI(t, map[string]any{})
+	logs = observeLogs(api)
+	limiter, err = api.newIPRateLimiter(ratelimit.NewMemoryStore())
+	require.NoError(t, err)
+	assert.Equal(t, 1, logs.FilterMessageSnippet("legacy").Len())
+	assert.Equal(t, "100/15m0s", limiter.Allow("203.0.113.1", 1).Policy.String())
+
+	api = newTestAPI(t, map[string]any{"api.rate.limit.policies": []string{"100/s"}})
+	logs = observeLogs(api)
+	_, err = api.newIPRateLimiter(ratelimit.NewMemoryStore())
+	require.NoError(t, err)
+	assert.Zero(t, logs.FilterMessageSnippet("legacy").Len(), "policies replace the legacy settings")
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/brasilcep/api/database"
+	"github.com/brasilcep/api/zipcodes"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+// stats serves the counters computed by the last import.
+func (api *API) stats(c echo.Context) error {
+	db := database.GetDB()
+	if db == nil {
+		return c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "database not ready"})
+	}
+
+	var stats *zipcodes.Stats
+	err := read(c.Request().Context(), "stats", func() (err error) {
+		stats, err = zipcodes.GetStats(db)
+		return err
+	})
+	if err != nil {
+		api.requestLogger(c).Error("Erro ao ler estatísticas", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Erro ao gerar estatísticas"})
+	}
+	if stats == nil {
+		return c.JSON(http.StatusNotFound, ErrorResponse{Error: "Estatísticas indisponíveis, importe a base novamente"})
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
+
+// MunicipalityPage is a page of GET /stats/municipios. NextCursor is empty
+// on the last page.
+type MunicipalityPage struct {
+	Data       []zipcodes.MunicipalityStats `json:"data"`
+	Limit      int                          `json:"limit"`
+	NextCursor string                       `json:"next_cursor,omitempty"`
+}
+
+// municipalityStats serves GET /stats/municipios?uf=&cursor=&limit=, the
+// per-municipality counts of the last import.
+func (api *API) municipalityStats(c echo.Context) error {
+	limit := api.config.GetInt("api.list.default_limit")
+	if raw := c.QueryParam("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "limit inválido"})
+		}
+		limit = min(n, api.config.GetInt("api.list.max_limit"))
+	}
+
+	var after string
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		var err error
+		if after, err = decodeCursor(cursor); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorResponse{Error: "cursor inválido"})
+		}
+	}
+
+	db := database.GetDB()
+	if db == nil {
+		return c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "database not ready"})
+	}
+
+	var municipalities []zipcodes.MunicipalityStats
+	var next string
+	err := read(c.Request().Context(), "municipality_stats", func() (err error) {
+		municipalities, next, err = zipcodes.ListMunicipalityStats(db, c.QueryParam("uf"), after, limit)
+		return err
+	})
+	if err != nil {
+		api.requestLogger(c).Error("Erro ao ler estatísticas por município", zap.Error(err))
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Erro ao gerar estatísticas"})
+	}
+
+	page := MunicipalityPage{Data: municipalities, Limit: limit}
+	if next != "" {
+		page.NextCursor = encodeCursor(next)
+	}
+	return c.JSON(http.StatusOK, page)
+}
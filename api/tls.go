@@ -0,0 +1,181 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/brasilcep/api/logger"
+	"go.uber.org/zap"
+)
+
+// Values of api.tls.client_auth.
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequire  = "require"
+)
+
+// certReloader serves the certificate, key and client CAs from disk and
+// reloads them when the files change, so renewed certificates are picked
+// up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	base     *tls.Config
+	logger   *logger.Logger
+
+	mu      sync.RWMutex
+	config  *tls.Config
+	modTime map[string]time.Time
+}
+
+// tlsConfig returns the TLS configuration of the API listener, or nil when
+// api.tls.enable is off.
+func (api *API) tlsConfig() (*tls.Config, *certReloader, error) {
+	if !api.config.GetBool("api.tls.enable") {
+		return nil, nil, nil
+	}
+
+	base := &tls.Config{NextProtos: []string{"http/1.1"}}
+	if api.config.GetBool("api.tls.http2") {
+		base.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	switch v := api.config.GetString("api.tls.min_version"); v {
+	case "1.2":
+		base.MinVersion = tls.VersionTLS12
+	case "1.3":
+		base.MinVersion = tls.VersionTLS13
+	default:
+		return nil, nil, fmt.Errorf("unsupported TLS version %q, use 1.2 or 1.3", v)
+	}
+
+	caFile := api.config.GetString("api.tls.client_ca_file")
+	switch mode := api.config.GetString("api.tls.client_auth"); mode {
+	case clientAuthNone:
+		base.ClientAuth = tls.NoClientCert
+	case clientAuthOptional:
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	case clientAuthRequire:
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, nil, fmt.Errorf("unknown TLS client auth %q, use none, optional or require", mode)
+	}
+	if base.ClientAuth != tls.NoClientCert && caFile == "" {
+		return nil, nil, errors.New("api.tls.client_ca_file is required to verify client certificates")
+	}
+
+	reloader := &certReloader{
+		certFile: api.config.GetString("api.tls.cert_file"),
+		keyFile:  api.config.GetString("api.tls.key_file"),
+		caFile:   caFile,
+		base:     base,
+		logger:   api.logger,
+	}
+	if err := reloader.load(); err != nil {
+		return nil, nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:         base.MinVersion,
+		NextProtos:         base.NextProtos,
+		GetConfigForClient: reloader.configForClient,
+	}
+	return config, reloader, nil
+}
+
+func (r *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.config, nil
+}
+
+// load reads the files and swaps the configuration served to new
+// connections. On error the previous configuration stays in use.
+func (r *certReloader) load() error {
+	modTime := make(map[string]time.Time)
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTime[path] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	config := r.base.Clone()
+	config.Certificates = []tls.Certificate{cert}
+
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.caFile)
+		}
+		config.ClientCAs = pool
+	}
+
+	r.mu.Lock()
+	r.config = config
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		r.logger.Info("TLS certificate loaded", zap.Strings("names", leaf.DNSNames), zap.Time("not_after", leaf.NotAfter))
+	}
+	return nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// changed reports whether any file was modified since the last load.
+func (r *certReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Equal(r.modTime[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run checks the files every interval until ctx is cancelled.
+func (r *certReloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.load(); err != nil {
+				r.logger.Error("Failed to reload TLS certificate, keeping the current one", zap.Error(err))
+			}
+		}
+	}
+}
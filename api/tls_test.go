@@ -0,0 +1,203 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCert is a certificate signed by parent, or self-signed without one.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and key as PEM files.
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600))
+	if keyFile == "" {
+		return
+	}
+	key, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0o600))
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// setupTLS serves the API listener TLS config with the given settings and
+// returns the server and its certificate and key files.
+func setupTLS(t *testing.T, settings map[string]any) (*httptest.Server, *certReloader, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	newTestCert(t, "primeiro.example", nil).write(t, certFile, keyFile)
+
+	settings["api.tls.enable"] = true
+	settings["api.tls.cert_file"] = certFile
+	settings["api.tls.key_file"] = keyFile
+	api := newTestAPI(t, settings)
+	observeLogs(api)
+	config, reloader, err := api.tlsConfig()
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = config
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, reloader, certFile, keyFile
+}
+
+// servedName returns the common name of the certificate the server
+// presents to a new connection.
+func servedName(t *testing.T, server *httptest.Server, clientCerts ...tls.Certificate) (string, error) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: clientCerts})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+	// TLS 1.3 reports a rejected client certificate on the first read.
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err != nil && !isTimeout(err) {
+		return "", err
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func isTimeout(err error) bool {
+	timeout, ok := err.(interface{ Timeout() bool })
+	return ok && timeout.Timeout()
+}
+
+func TestTLSReload(t *testing.T) {
+	server, reloader, certFile, keyFile := setupTLS(t, map[string]any{})
+
+	name, err := servedName(t, server)
+	require.NoError(t, err)
+	assert.Equal(t, "primeiro.example", name)
+	assert.False(t, reloader.changed())
+
+	// A renewed certificate, with a later modification time.
+	newTestCert(t, "segundo.example", nil).write(t, certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.True(t, reloader.changed())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		reloader.Run(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		name, err := servedName(t, server)
+		return err == nil && name == "segundo.example"
+	}, 2*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	// A certificate that does not match its key keeps the current one.
+	newTestCert(t, "terceiro.example", nil).write(t, certFile, "")
+	assert.Error(t, reloader.load())
+	name, err = servedName(t, server)
+	require.NoError(t, err)
+	assert.Equal(t, "segundo.example", name)
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	ca := newTestCert(t, "ca.example", nil)
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	ca.write(t, caFile, "")
+
+	server, _, _, _ := setupTLS(t, map[string]any{
+		"api.tls.client_auth":    clientAuthRequire,
+		"api.tls.client_ca_file": caFile,
+		"api.tls.min_version":    "1.3",
+	})
+
+	_, err := servedName(t, server)
+	assert.Error(t, err, "a client certificate is required")
+	_, err = servedName(t, server, newTestCert(t, "intruso.example", nil).tlsCertificate())
+	assert.Error(t, err, "the client certificate must be signed by the CA")
+	name, err := servedName(t, server, newTestCert(t, "parceiro.example", ca).tlsCertificate())
+	require.NoError(t, err)
+	assert.Equal(t, "primeiro.example", name)
+}
+
+func TestTLSInvalidSettings(t *testing.T) {
+	tests := map[string]struct {
+		settings map[string]any
+		err      string
+	}{
+		"min version":         {map[string]any{"api.tls.min_version": "1.1"}, `unsupported TLS version "1.1"`},
+		"client auth":         {map[string]any{"api.tls.client_auth": "always"}, `unknown TLS client auth "always"`},
+		"missing CA":          {map[string]any{"api.tls.client_auth": clientAuthOptional}, "api.tls.client_ca_file is required"},
+		"missing certificate": {map[string]any{"api.tls.cert_file": "/nonexistent/tls.crt"}, "no such file"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			tt.settings["api.tls.enable"] = true
+			_, _, err := newTestAPI(t, tt.settings).tlsConfig()
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+
+	config, reloader, err := newTestAPI(t, map[string]any{}).tlsConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, config, "TLS is off by default")
+	assert.Nil(t, reloader)
+}
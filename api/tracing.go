@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/brasilcep/api/tracing"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+var tracer = otel.Tracer("github.com/brasilcep/api/api")
+
+// traceRequests starts a server span for every request, continuing the
+// trace of the caller. It runs before the RequestID middleware and hands
+// it the trace ID when the client sent no X-Request-ID, so the ID in the
+// response finds the trace.
+func traceRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+		name := req.Method
+		attrs := []attribute.KeyValue{
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLPath(req.URL.Path),
+			semconv.ClientAddress(c.RealIP()),
+			semconv.UserAgentOriginal(req.UserAgent()),
+		}
+		if route := c.Path(); route != "" {
+			name += " " + route
+			attrs = append(attrs, semconv.HTTPRoute(route))
+		}
+		ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+		defer span.End()
+
+		if sc := span.SpanContext(); sc.IsValid() && req.Header.Get(echo.HeaderXRequestID) == "" {
+			req.Header.Set(echo.HeaderXRequestID, sc.TraceID().String())
+		}
+		c.SetRequest(req.WithContext(ctx))
+
+		err := handleError(c, next(c))
+
+		status := c.Response().Status
+		span.SetAttributes(
+			semconv.HTTPResponseStatusCode(status),
+			attribute.String("http.request.id", c.Response().Header().Get(echo.HeaderXRequestID)),
+		)
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		return nil
+	}
+}
+
+// handledErrorKey keeps the error of a request once a middleware handed it
+// to the error handler.
+const handledErrorKey = "handled_error"
+
+// handleError hands err to the error handler, so middleware sees the status
+// it writes, and returns the error of the request: err, or the one an inner
+// middleware already handled. Middleware calling it returns nil, so the
+// handler runs once.
+func handleError(c echo.Context, err error) error {
+	if err == nil {
+		err, _ = c.Get(handledErrorKey).(error)
+		return err
+	}
+	c.Error(err)
+	c.Set(handledErrorKey, err)
+	return err
+}
+
+// read runs a read of the store in its own span and records its latency.
+// A missing key is not an error of the read.
+func read(ctx context.Context, operation string, fn func() error) error {
+	_, span := tracer.Start(ctx, "badger."+operation, trace.WithAttributes(
+		semconv.DBSystemNameKey.String("badger"),
+		semconv.DBOperationName(operation),
+	))
+	start := time.Now()
+	err := fn()
+	observeRead(operation, start)
+
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		tracing.End(span, nil)
+	} else {
+		tracing.End(span, err)
+	}
+	return err
+}
+
+// requestLogger returns the logger of a request, with its trace and
+// request IDs.
+func (api *API) requestLogger(c echo.Context) *zap.Logger {
+	fields := tracing.Fields(c.Request().Context())
+	if id := c.Response().Header().Get(echo.HeaderXRequestID); id != "" {
+		fields = append(fields, zap.String("request_id", id))
+	}
+	return api.logger.With(fields...)
+}
@@ -0,0 +1,384 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/brasilcep/api/logger"
+	"github.com/brasilcep/api/ratelimit"
+	"github.com/brasilcep/api/zipcodes"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+const (
+	// webhookCursorPrefix keys store, per webhook URL, the cursor of the
+	// last change delivered.
+	webhookCursorPrefix = "meta:webhook:"
+	// webhookFailedPrefix keys store the batches given up on:
+	// meta:webhook_failed:<url hash>:<first cursor>.
+	webhookFailedPrefix = "meta:webhook_failed:"
+	// webhookLeaseKey names the lease of the replica sending the webhooks.
+	webhookLeaseKey = "webhooks:sender"
+	// webhookSharedCursorPrefix and webhookSharedFailedPrefix name, per URL
+	// hash, the cursor and the JSON list of failed batches in a shared
+	// store.
+	webhookSharedCursorPrefix = "webhooks:cursor:"
+	webhookSharedFailedPrefix = "webhooks:failed:"
+	// webhookFailuresKept is how many failed batches a shared store keeps
+	// per URL, the latest ones.
+	webhookFailuresKept = 1000
+)
+
+// Headers sent with every webhook delivery. The signature is the hex
+// HMAC-SHA256 of "<timestamp>.<body>" with the configured secret.
+const (
+	WebhookSignatureHeader = "X-BrasilCEP-Signature"
+	WebhookTimestampHeader = "X-BrasilCEP-Timestamp"
+)
+
+// WebhookDispatcher delivers the change log to the configured URLs, in
+// order and at least once. Each URL has its own persisted cursor and
+// backoff, so a failing endpoint does not hold back the others. Batches
+// still failing after max_attempts are recorded as failed and skipped.
+//
+// Replicas sharing the rate limit store elect a single sender through a
+// lease in it; the others only take over when the sender stops renewing.
+// The cursors and failed batches are kept next to the lease, so the next
+// sender continues where the last one stopped; with the memory store they
+// stay in the local store, which survives restarts.
+type WebhookDispatcher struct {
+	db          *badger.DB
+	shared      ratelimit.Store
+	logger      *logger.Logger
+	client      *http.Client
+	lease       *ratelimit.Lease
+	term        time.Duration
+	urls        []string
+	secret      []byte
+	batchSize   int
+	maxAttempts int
+	interval    time.Duration
+	maxBackoff  time.Duration
+	backoff     time.Duration
+}
+
+// WebhookFailure is a batch of changes given up on after max_attempts.
+type WebhookFailure struct {
+	URL   string    `json:"url"`
+	From  uint64    `json:"from_cursor"`
+	To    uint64    `json:"to_cursor"`
+	Error string    `json:"error"`
+	At    time.Time `json:"at"`
+}
+
+func NewWebhookDispatcher(config *viper.Viper, logger *logger.Logger, db *badger.DB, store ratelimit.Store) *WebhookDispatcher {
+	term := time.Duration(max(config.GetInt("changes.webhooks.lease_seconds"), 1)) * time.Second
+	d := &WebhookDispatcher{
+		db:          db,
+		logger:      logger,
+		client:      &http.Client{Timeout: time.Duration(config.GetInt("changes.webhooks.timeout_seconds")) * time.Second},
+		lease:       ratelimit.NewLease(store, webhookLeaseKey, term),
+		term:        term,
+		urls:        config.GetStringSlice("changes.webhooks.urls"),
+		secret:      []byte(config.GetString("changes.webhooks.secret")),
+		batchSize:   max(config.GetInt("changes.webhooks.batch_size"), 1),
+		maxAttempts: max(config.GetInt("changes.webhooks.max_attempts"), 1),
+		interval:    time.Duration(config.GetInt("changes.webhooks.poll_interval_seconds")) * time.Second,
+		maxBackoff:  time.Duration(config.GetInt("changes.webhooks.max_backoff_seconds")) * time.Second,
+		backoff:     time.Second,
+	}
+	if config.GetString("api.rate.limit.store") != "memory" {
+		d.shared = store
+	}
+	return d
+}
+
+// Run delivers changes until ctx is done.
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	if len(d.secret) == 0 {
+		d.logger.Warn("Webhook secret is empty, deliveries can not be authenticated")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer func() { done <- struct{}{} }()
+		d.renewLease(ctx)
+	}()
+	for _, url := range d.urls {
+		go func(url string) {
+			defer func() { done <- struct{}{} }()
+			d.run(ctx, url)
+		}(url)
+	}
+	for range len(d.urls) + 1 {
+		<-done
+	}
+}
+
+// renewLease checks the lease every third of its term, so the sender keeps
+// it while the URLs wait out their backoff.
+func (d *WebhookDispatcher) renewLease(ctx context.Context) {
+	ticker := time.NewTicker(max(d.term/3, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		if _, err := d.lease.Held(); err != nil {
+			d.logger.Warn("Failed to renew the webhook lease", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *WebhookDispatcher) run(ctx context.Context, url string) {
+	d.logger.Info("Webhook delivery started", zap.String("url", url))
+	failures := 0
+	for {
+		wait := d.interval
+		switch held, err := d.lease.Held(); {
+		case err != nil:
+			d.logger.Warn("Failed to check the webhook lease, not sending", zap.String("url", url), zap.Error(err))
+		case held:
+			delivered, err := d.deliverNext(ctx, url)
+			if err != nil {
+				failures++
+				wait = d.failureBackoff(failures)
+				d.logger.Error("Webhook delivery failed", zap.String("url", url), zap.Int("failures", failures), zap.Duration("retry_in", wait), zap.Error(err))
+			} else {
+				failures = 0
+				if delivered {
+					continue
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// failureBackoff returns how long a URL waits after failing that many
+// batches in a row: the poll interval, doubled on every failure up to
+// max_backoff_seconds.
+func (d *WebhookDispatcher) failureBackoff(failures int) time.Duration {
+	wait := d.interval
+	for n := 1; n < failures && wait < d.maxBackoff; n++ {
+		wait *= 2
+	}
+	return min(wait, max(d.maxBackoff, d.interval))
+}
+
+// deliverNext sends the next batch of changes to url and advances its
+// cursor. A batch that fails max_attempts times is recorded as failed and
+// skipped, and its error returned. It reports whether there was anything
+// to send.
+func (d *WebhookDispatcher) deliverNext(ctx context.Context, url string) (bool, error) {
+	cursor, err := d.cursor(url)
+	if err != nil {
+		return false, err
+	}
+	events, more, err := zipcodes.GetChanges(d.db, cursor, d.batchSize)
+	if err != nil || len(events) == 0 {
+		return false, err
+	}
+
+	last := events[len(events)-1].Cursor
+	body, err := json.Marshal(ChangesResponse{Changes: events, NextCursor: last, HasMore: more})
+	if err != nil {
+		return true, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = d.post(ctx, url, body)
+		if err == nil {
+			break
+		}
+		if attempt == d.maxAttempts {
+			err = fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			failure := WebhookFailure{URL: url, From: events[0].Cursor, To: last, Error: err.Error(), At: time.Now()}
+			if saveErr := d.saveFailure(failure); saveErr != nil {
+				return true, errors.Join(err, saveErr)
+			}
+			return true, errors.Join(err, d.setCursor(url, last))
+		}
+		d.logger.Warn("Webhook delivery attempt failed", zap.String("url", url), zap.Int("attempt", attempt), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case <-time.After(d.backoff << (attempt - 1)):
+		}
+	}
+
+	d.logger.Debug("Webhook delivered", zap.String("url", url), zap.Int("changes", len(events)), zap.Uint64("cursor", last))
+	return true, d.setCursor(url, last)
+}
+
+func (d *WebhookDispatcher) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(d.secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SignWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>".
+// Receivers recompute it to authenticate a delivery.
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookURLHash shortens url for the keys of its cursor and failures.
+func webhookURLHash(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:8])
+}
+
+func webhookCursorKey(url string) []byte {
+	return []byte(webhookCursorPrefix + webhookURLHash(url))
+}
+
+// cursor returns the cursor of the last change delivered to url. A shared
+// store without one yet continues from the local cursor, kept before the
+// store was shared.
+func (d *WebhookDispatcher) cursor(url string) (uint64, error) {
+	if d.shared != nil {
+		value, err := d.shared.Get(webhookSharedCursorPrefix+webhookURLHash(url), time.Now())
+		if err != nil {
+			return 0, err
+		}
+		if value != nil {
+			return strconv.ParseUint(string(value), 10, 64)
+		}
+	}
+
+	var cursor uint64
+	err := d.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(webhookCursorKey(url))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			cursor, err = strconv.ParseUint(string(val), 10, 64)
+			return err
+		})
+	})
+	return cursor, err
+}
+
+func (d *WebhookDispatcher) setCursor(url string, cursor uint64) error {
+	value := []byte(strconv.FormatUint(cursor, 10))
+	if d.shared != nil {
+		return d.shared.Set(webhookSharedCursorPrefix+webhookURLHash(url), value, time.Time{}, time.Now())
+	}
+	return d.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(webhookCursorKey(url), value)
+	})
+}
+
+func (d *WebhookDispatcher) saveFailure(failure WebhookFailure) error {
+	if d.shared != nil {
+		// Only the sender writes, so reading and rewriting the list is safe.
+		failures, err := d.sharedFailures(failure.URL)
+		if err != nil {
+			return err
+		}
+		failures = append(failures, failure)
+		data, err := json.Marshal(failures[max(len(failures)-webhookFailuresKept, 0):])
+		if err != nil {
+			return err
+		}
+		return d.shared.Set(webhookSharedFailedPrefix+webhookURLHash(failure.URL), data, time.Time{}, time.Now())
+	}
+
+	data, err := json.Marshal(failure)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s%s:%020d", webhookFailedPrefix, webhookURLHash(failure.URL), failure.From)
+	return d.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), data)
+	})
+}
+
+func (d *WebhookDispatcher) sharedFailures(url string) ([]WebhookFailure, error) {
+	data, err := d.shared.Get(webhookSharedFailedPrefix+webhookURLHash(url), time.Now())
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var failures []WebhookFailure
+	err = json.Unmarshal(data, &failures)
+	return failures, err
+}
+
+// Failures returns the batches given up on, oldest first per URL.
+func (d *WebhookDispatcher) Failures() ([]WebhookFailure, error) {
+	failures := []WebhookFailure{}
+	for _, url := range d.urls {
+		if d.shared != nil {
+			shared, err := d.sharedFailures(url)
+			if err != nil {
+				return nil, err
+			}
+			failures = append(failures, shared...)
+			continue
+		}
+
+		err := d.db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+
+			prefix := []byte(webhookFailedPrefix + webhookURLHash(url) + ":")
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				var failure WebhookFailure
+				if err := it.Item().Value(func(val []byte) error {
+					return json.Unmarshal(val, &failure)
+				}); err != nil {
+					return err
+				}
+				failures = append(failures, failure)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return failures, nil
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brasilcep/api/database"
+	"github.com/brasilcep/api/ratelimit"
+	"github.com/brasilcep/api/zipcodes"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver records the deliveries it gets, answering with the
+// queued statuses and then 200.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bodies = append(r.bodies, body)
+	r.headers = append(r.headers, req.Header.Clone())
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (r *webhookReceiver) deliveries() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.bodies)
+}
+
+// setupWebhooks seeds a store with three change events and returns a
+// dispatcher sending them to a receiver.
+func setupWebhooks(t *testing.T, settings map[string]any) (*WebhookDispatcher, *webhookReceiver, string) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	settings["seed.changes.enable"] = true
+	settings["changes.webhooks.urls"] = []string{server.URL}
+	settings["changes.webhooks.secret"] = "s3cret"
+	api := newTestAPI(t, settings)
+	openTestDatabase(t, api.config)
+	seedTestDatabase(t, api, map[string]string{
+		"SP": "001@SP@001@@@Paulista@@01310-100@Avenida@S@\n002@SP@001@@@Augusta@@01310-200@Rua@S@\n003@SP@001@@@Consolacao@@01301-000@Rua@S@\n",
+	})
+
+	store := ratelimit.NewMemoryStore()
+	dispatcher := NewWebhookDispatcher(api.config, api.logger, database.GetDB(), store)
+	dispatcher.backoff = time.Millisecond
+	return dispatcher, receiver, server.URL
+}
+
+func TestWebhookSignature(t *testing.T) {
+	dispatcher, receiver, url := setupWebhooks(t, map[string]any{})
+
+	delivered, err := dispatcher.deliverNext(context.Background(), url)
+	require.NoError(t, err)
+	require.True(t, delivered)
+	require.Equal(t, 1, receiver.deliveries())
+
+	body, header := receiver.bodies[0], receiver.headers[0]
+	timestamp := header.Get(WebhookTimestampHeader)
+	require.NotEmpty(t, timestamp)
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), header.Get(WebhookSignatureHeader))
+	assert.Equal(t, "sha256="+SignWebhook([]byte("s3cret"), timestamp, body), header.Get(WebhookSignatureHeader))
+	assert.NotEqual(t, SignWebhook([]byte("other"), timestamp, body), SignWebhook([]byte("s3cret"), timestamp, body))
+
+	var payload ChangesResponse
+	require.NoError(t, json.Unmarshal(body, &payload))
+	assert.Len(t, payload.Changes, 3)
+	assert.False(t, payload.HasMore)
+}
+
+func TestWebhookRetry(t *testing.T) {
+	dispatcher, receiver, url := setupWebhooks(t, map[string]any{
+		"changes.webhooks.batch_size":   2,
+		"changes.webhooks.max_attempts": 3,
+	})
+	receiver.statuses = []int{http.StatusInternalServerError, http.StatusBadGateway}
+
+	delivered, err := dispatcher.deliverNext(context.Background(), url)
+	require.NoError(t, err)
+	assert.True(t, delivered)
+	assert.Equal(t, 3, receiver.deliveries())
+
+	var first ChangesResponse
+	require.NoError(t, json.Unmarshal(receiver.bodies[2], &first))
+	require.Len(t, first.Changes, 2)
+	assert.True(t, first.HasMore)
+
+	cursor, err := dispatcher.cursor(url)
+	require.NoError(t, err)
+	assert.Equal(t, first.NextCursor, cursor)
+
+	delivered, err = dispatcher.deliverNext(context.Background(), url)
+	require.NoError(t, err)
+	assert.True(t, delivered)
+
+	var second ChangesResponse
+	require.NoError(t, json.Unmarshal(receiver.bodies[3], &second))
+	require.Len(t, second.Changes, 1)
+	assert.Greater(t, second.Changes[0].Cursor, first.NextCursor)
+
+	delivered, err = dispatcher.deliverNext(context.Background(), url)
+	require.NoError(t, err)
+	assert.False(t, delivered)
+	assert.Equal(t, 4, receiver.deliveries())
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	// The failures are kept in the local store with the memory store, and
+	// next to the lease otherwise.
+	for _, store := range []string{"memory", "file"} {
+		t.Run(store, func(t *testing.T) {
+			dispatcher, receiver, url := setupWebhooks(t, map[string]any{
+				"api.rate.limit.store":          store,
+				"changes.webhooks.max_attempts": 2,
+			})
+			receiver.statuses = []int{http.StatusInternalServerError, http.StatusInternalServerError}
+
+			delivered, err := dispatcher.deliverNext(context.Background(), url)
+			require.Error(t, err)
+			assert.True(t, delivered)
+			assert.Contains(t, err.Error(), "giving up after 2 attempts")
+
+			events, _, err := zipcodes.GetChanges(database.GetDB(), 0, 100)
+			require.NoError(t, err)
+			require.Len(t, events, 3)
+
+			cursor, err := dispatcher.cursor(url)
+			require.NoError(t, err)
+			assert.Equal(t, events[2].Cursor, cursor, "the failed batch is skipped")
+
+			failures, err := dispatcher.Failures()
+			require.NoError(t, err)
+			require.Len(t, failures, 1)
+			assert.Equal(t, url, failures[0].URL)
+			assert.Equal(t, events[0].Cursor, failures[0].From)
+			assert.Equal(t, events[2].Cursor, failures[0].To)
+			assert.True(t, strings.Contains(failures[0].Error, "unexpected status 500"))
+
+			delivered, err = dispatcher.deliverNext(context.Background(), url)
+			require.NoError(t, err)
+			assert.False(t, delivered)
+			assert.Equal(t, 2, receiver.deliveries())
+		})
+	}
+}
+
+func TestWebhookFailureBackoff(t *testing.T) {
+	dispatcher := &WebhookDispatcher{interval: 30 * time.Second, maxBackoff: 5 * time.Minute}
+
+	assert.Equal(t, 30*time.Second, dispatcher.failureBackoff(1))
+	assert.Equal(t, time.Minute, dispatcher.failureBackoff(2))
+	assert.Equal(t, 4*time.Minute, dispatcher.failureBackoff(4))
+	assert.Equal(t, 5*time.Minute, dispatcher.failureBackoff(5))
+	assert.Equal(t, 5*time.Minute, dispatcher.failureBackoff(100))
+
+	dispatcher.maxBackoff = 0
+	assert.Equal(t, 30*time.Second, dispatcher.failureBackoff(3))
+}
+
+func TestWebhookLease(t *testing.T) {
+	dispatcher, receiver, url := setupWebhooks(t, map[string]any{
+		"changes.webhooks.lease_seconds":         3600,
+		"changes.webhooks.poll_interval_seconds": 1,
+	})
+	// Another replica holds the current term.
+	store := ratelimit.NewMemoryStore()
+	held, err := ratelimit.NewLease(store, webhookLeaseKey, time.Hour).Held()
+	require.NoError(t, err)
+	require.True(t, held)
+	dispatcher.lease = ratelimit.NewLease(store, webhookLeaseKey, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	dispatcher.run(ctx, url)
+
+	assert.Zero(t, receiver.deliveries())
+	cursor, err := dispatcher.cursor(url)
+	require.NoError(t, err)
+	assert.Zero(t, cursor)
+}
+
+func TestWebhookSendersShareState(t *testing.T) {
+	first, receiver, url := setupWebhooks(t, map[string]any{
+		"api.rate.limit.store":                   "file",
+		"changes.webhooks.batch_size":            1,
+		"changes.webhooks.poll_interval_seconds": 1,
+	})
+	require.NotNil(t, first.shared)
+
+	// Two replicas on one store, with terms short enough to change hands
+	// during the test.
+	const term = 200 * time.Millisecond
+	second := *first
+	first.lease = ratelimit.NewLease(first.shared, webhookLeaseKey, term)
+	second.lease = ratelimit.NewLease(first.shared, webhookLeaseKey, term)
+	first.term, second.term = term, term
+
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, run := range []struct {
+		ctx        context.Context
+		dispatcher *WebhookDispatcher
+	}{{firstCtx, first}, {secondCtx, &second}} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run.dispatcher.Run(run.ctx)
+		}()
+	}
+
+	require.Eventually(t, func() bool { return receiver.deliveries() == 3 }, 5*time.Second, 10*time.Millisecond)
+	// The sender keeps the lease across terms, then the other one takes
+	// over from the shared cursor once it stops.
+	time.Sleep(2 * term)
+	stopFirst()
+	time.Sleep(3 * term)
+	stopSecond()
+	wg.Wait()
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	require.Len(t, receiver.bodies, 3, "every change is delivered once")
+	seen := map[uint64]bool{}
+	for _, body := range receiver.bodies {
+		var payload ChangesResponse
+		require.NoError(t, json.Unmarshal(body, &payload))
+		require.Len(t, payload.Changes, 1)
+		assert.False(t, seen[payload.Changes[0].Cursor], "change %d delivered twice", payload.Changes[0].Cursor)
+		seen[payload.Changes[0].Cursor] = true
+	}
+
+	shared, err := first.shared.Get(webhookSharedCursorPrefix+webhookURLHash(url), time.Now())
+	require.NoError(t, err)
+	assert.NotNil(t, shared, "the cursor is kept next to the lease")
+	err = database.GetDB().View(func(txn *badger.Txn) error {
+		_, err := txn.Get(webhookCursorKey(url))
+		return err
+	})
+	assert.ErrorIs(t, err, badger.ErrKeyNotFound, "the cursor is not kept locally")
+}
@@ -0,0 +1,215 @@
+package apikeys
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brasilcep/api/ratelimit"
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTestDB(t *testing.T) *badger.DB {
+	opts := badger.DefaultOptions(t.TempDir()).WithLoggingLevel(badger.ERROR)
+	db, err := badger.Open(opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestCreateAndRevoke(t *testing.T) {
+	db := setupTestDB(t)
+
+	secret, err := Create(db, Key{Name: "parceiro", RateLimit: 5, DailyQuota: 100})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(secret, keySecretPrefix))
+
+	_, err = Create(db, Key{Name: "parceiro"})
+	assert.ErrorIs(t, err, ErrDuplicateName)
+
+	keys, err := List(db)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, Hash(secret), keys[0].Hash)
+	assert.Equal(t, int64(100), keys[0].DailyQuota)
+
+	registry, err := NewRegistry(db, ratelimit.NewMemoryStore(), nil)
+	require.NoError(t, err)
+	require.NotNil(t, registry.Lookup(secret))
+	assert.Nil(t, registry.Lookup(secret+"x"))
+
+	found, err := Revoke(db, "parceiro")
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = Revoke(db, "parceiro")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	keys, err = List(db)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"name":"escritorio","key":"segredo","burst":50}]`), 0o600))
+
+	keys, err := LoadFile(path)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, Hash("segredo"), keys[0].Hash)
+	assert.Equal(t, 50, keys[0].Burst)
+
+	require.NoError(t, os.WriteFile(path, []byte(`[{"name":"sem-chave"}]`), 0o600))
+	_, err = LoadFile(path)
+	assert.Error(t, err)
+
+	db := setupTestDB(t)
+	_, err = Create(db, Key{Name: "escritorio"})
+	require.NoError(t, err)
+	_, err = NewRegistry(db, ratelimit.NewMemoryStore(), keys)
+	assert.Error(t, err, "names must be unique across the store and the file")
+}
+
+func TestConsumeQuotas(t *testing.T) {
+	db := setupTestDB(t)
+	store := ratelimit.NewMemoryStore()
+	registry, err := NewRegistry(db, store, []Key{{Name: "k", Hash: Hash("k"), DailyQuota: 2, MonthlyQuota: 3}})
+	require.NoError(t, err)
+	k := registry.Lookup("k")
+	require.NotNil(t, k)
+
+	day := time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC)
+
+	status, err := registry.Consume(k, day)
+	require.NoError(t, err)
+	assert.Equal(t, QuotaStatus{Period: PeriodDay, Limit: 2, Remaining: 1, Reset: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)}, status)
+
+	status, err = registry.Consume(k, day)
+	require.NoError(t, err)
+	assert.False(t, status.Exceeded)
+	assert.Equal(t, int64(0), status.Remaining)
+
+	status, err = registry.Consume(k, day)
+	require.NoError(t, err)
+	assert.True(t, status.Exceeded)
+
+	// A new day (and month) resets both counters.
+	next := day.Add(24 * time.Hour)
+	status, err = registry.Consume(k, next)
+	require.NoError(t, err)
+	assert.False(t, status.Exceeded)
+
+	t.Run("monthly quota is the tightest", func(t *testing.T) {
+		for n := 0; n < 2; n++ {
+			_, err := registry.Consume(k, next.Add(time.Duration(n+1)*24*time.Hour))
+			require.NoError(t, err)
+		}
+		status, err := registry.Consume(k, next.Add(3*24*time.Hour))
+		require.NoError(t, err)
+		assert.True(t, status.Exceeded)
+		assert.Equal(t, PeriodMonth, status.Period)
+		assert.Equal(t, time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC), status.Reset)
+	})
+
+	t.Run("counters survive a restart", func(t *testing.T) {
+		require.NoError(t, registry.Flush())
+
+		reloaded, err := NewRegistry(db, store, []Key{*k})
+		require.NoError(t, err)
+		usage, err := reloaded.Usage(k, next.Add(3*24*time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), usage.Monthly)
+		assert.Equal(t, int64(5), usage.Total)
+	})
+}
+
+func TestForget(t *testing.T) {
+	db := setupTestDB(t)
+	store := ratelimit.NewMemoryStore()
+	registry, err := NewRegistry(db, store, []Key{{Name: "k", Hash: Hash("k"), DailyQuota: 1}})
+	require.NoError(t, err)
+	k := registry.Lookup("k")
+	now := time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC)
+
+	_, err = registry.Consume(k, now)
+	require.NoError(t, err)
+	status, err := registry.Consume(k, now)
+	require.NoError(t, err)
+	require.True(t, status.Exceeded)
+
+	require.NoError(t, registry.Forget("k", now))
+	require.NoError(t, registry.Flush())
+	usage, err := registry.Usage(k, now)
+	require.NoError(t, err)
+	assert.Zero(t, usage.Daily)
+	assert.Zero(t, usage.Monthly)
+	assert.Zero(t, usage.Total, "the total is not flushed back")
+
+	status, err = registry.Consume(k, now)
+	require.NoError(t, err)
+	assert.False(t, status.Exceeded)
+}
+
+func TestConsumeWithoutQuotas(t *testing.T) {
+	registry, err := NewRegistry(nil, ratelimit.NewMemoryStore(), []Key{{Name: "livre", Hash: Hash("livre")}})
+	require.NoError(t, err)
+
+	status, err := registry.Consume(registry.Lookup("livre"), time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, status.Limit)
+	assert.False(t, status.Exceeded)
+	assert.NoError(t, registry.Flush())
+}
+
+func TestQuotasSharedByReplicas(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	keys := []Key{{Name: "k", Hash: Hash("k"), DailyQuota: 3}}
+	first, err := NewRegistry(nil, store, keys)
+	require.NoError(t, err)
+	second, err := NewRegistry(nil, store, keys)
+	require.NoError(t, err)
+
+	now := time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC)
+	for _, registry := range []*Registry{first, second, first} {
+		status, err := registry.Consume(registry.Lookup("k"), now)
+		require.NoError(t, err)
+		assert.False(t, status.Exceeded)
+	}
+	status, err := second.Consume(second.Lookup("k"), now)
+	require.NoError(t, err)
+	assert.True(t, status.Exceeded)
+
+	usage, err := second.Usage(second.Lookup("k"), now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), usage.Daily, "denied requests are not counted")
+	assert.Equal(t, int64(1), usage.Total, "totals are per replica")
+}
+
+func TestReload(t *testing.T) {
+	db := setupTestDB(t)
+	registry, err := NewRegistry(db, ratelimit.NewMemoryStore(), nil)
+	require.NoError(t, err)
+
+	secret, err := Create(db, Key{Name: "nova"})
+	require.NoError(t, err)
+	assert.Nil(t, registry.Lookup(secret))
+
+	require.NoError(t, registry.Reload([]Key{{Name: "arquivo", Hash: Hash("arquivo")}}))
+	assert.NotNil(t, registry.Lookup(secret))
+	assert.True(t, registry.Has("arquivo"))
+	assert.Equal(t, 2, registry.Len())
+
+	assert.Error(t, registry.Reload([]Key{{Name: "nova", Hash: Hash("outra")}}))
+	assert.Equal(t, 2, registry.Len(), "a failed reload keeps the keys")
+
+	_, err = Revoke(db, "nova")
+	require.NoError(t, err)
+	require.NoError(t, registry.Reload(nil))
+	assert.Nil(t, registry.Lookup(secret))
+	assert.False(t, registry.Has("arquivo"))
+}
@@ -0,0 +1,353 @@
+package apikeys
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/brasilcep/api/ratelimit"
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Quota periods, in UTC.
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+// Usage counts the requests of a key in the current day and month, and in
+// total.
+type Usage struct {
+	Day        string    `json:"day"`
+	Daily      int64     `json:"daily"`
+	Month      string    `json:"month"`
+	Monthly    int64     `json:"monthly"`
+	Total      int64     `json:"total"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+}
+
+// QuotaStatus is the state of the tightest quota of a key after a request.
+// Limit is zero when the key has no quotas.
+type QuotaStatus struct {
+	Period    string
+	Limit     int64
+	Remaining int64
+	Reset     time.Time
+	Exceeded  bool
+}
+
+// Registry resolves key secrets and counts their usage. The daily and
+// monthly counters live in a ratelimit.Store, so quotas hold across the
+// replicas sharing it; the total and last use of every key are kept in
+// memory and written to the database of the replica by Flush.
+type Registry struct {
+	db    *badger.DB
+	store ratelimit.Store
+
+	keysMu sync.RWMutex
+	byHash map[string]*Key
+
+	mu    sync.Mutex
+	usage map[string]*Usage
+	dirty map[string]bool
+}
+
+// NewRegistry returns a registry with the keys in the store plus extra ones,
+// e.g. from LoadFile, counting quotas in store. db may be nil, then totals
+// are not persisted.
+func NewRegistry(db *badger.DB, store ratelimit.Store, extra []Key) (*Registry, error) {
+	r := &Registry{
+		db:    db,
+		store: store,
+		usage: make(map[string]*Usage),
+		dirty: make(map[string]bool),
+	}
+	if err := r.Reload(extra); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload replaces the known keys with the ones in the store plus extra, so
+// keys created or revoked since are picked up. On error the keys are left
+// as they were.
+func (r *Registry) Reload(extra []Key) error {
+	var keys []Key
+	if r.db != nil {
+		stored, err := List(r.db)
+		if err != nil {
+			return err
+		}
+		keys = stored
+	}
+	keys = append(keys, extra...)
+
+	byHash := make(map[string]*Key, len(keys))
+	names := make(map[string]bool)
+	for n := range keys {
+		k := &keys[n]
+		if names[k.Name] {
+			return fmt.Errorf("apikeys: duplicate key name %q", k.Name)
+		}
+		names[k.Name] = true
+		byHash[k.Hash] = k
+	}
+
+	r.keysMu.Lock()
+	r.byHash = byHash
+	r.keysMu.Unlock()
+	return nil
+}
+
+// Len returns the number of known keys.
+func (r *Registry) Len() int {
+	r.keysMu.RLock()
+	defer r.keysMu.RUnlock()
+	return len(r.byHash)
+}
+
+// Keys returns every known key, sorted by name.
+func (r *Registry) Keys() []Key {
+	r.keysMu.RLock()
+	keys := make([]Key, 0, len(r.byHash))
+	for _, k := range r.byHash {
+		keys = append(keys, *k)
+	}
+	r.keysMu.RUnlock()
+
+	sort.Slice(keys, func(a, b int) bool { return keys[a].Name < keys[b].Name })
+	return keys
+}
+
+// Lookup returns the key with the given secret, or nil.
+func (r *Registry) Lookup(secret string) *Key {
+	r.keysMu.RLock()
+	defer r.keysMu.RUnlock()
+	return r.byHash[Hash(secret)]
+}
+
+// Has reports whether a key called name is known.
+func (r *Registry) Has(name string) bool {
+	r.keysMu.RLock()
+	defer r.keysMu.RUnlock()
+	for _, k := range r.byHash {
+		if k.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Consume counts a request of k at now unless one of its quotas is
+// exhausted, and returns the quota closest to running out.
+func (r *Registry) Consume(k *Key, now time.Time) (QuotaStatus, error) {
+	daily, monthly, err := r.count(k, 1, now)
+	if err != nil {
+		return QuotaStatus{}, err
+	}
+
+	status := quotaStatus(k, daily, monthly, now)
+	if status.Exceeded {
+		// Denied requests do not use up the quota.
+		_, _, err := r.count(k, -1, now)
+		return status, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, err := r.load(k.Name)
+	if err != nil {
+		return QuotaStatus{}, err
+	}
+	u.Day, u.Daily = now.UTC().Format(dayLayout), daily
+	u.Month, u.Monthly = now.UTC().Format(monthLayout), monthly
+	u.Total++
+	u.LastUsedAt = now
+	r.dirty[k.Name] = true
+	return status, nil
+}
+
+// Usage returns the counters of k.
+func (r *Registry) Usage(k *Key, now time.Time) (Usage, error) {
+	daily, monthly, err := r.count(k, 0, now)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, err := r.load(k.Name)
+	if err != nil {
+		return Usage{}, err
+	}
+	usage := *u
+	usage.Day, usage.Daily = now.UTC().Format(dayLayout), daily
+	usage.Month, usage.Monthly = now.UTC().Format(monthLayout), monthly
+	return usage, nil
+}
+
+// count adds n requests of k to its counters of the day and month of now,
+// in UTC, and returns them.
+func (r *Registry) count(k *Key, n int64, now time.Time) (daily, monthly int64, err error) {
+	now = now.UTC()
+	day, month := now.Format(dayLayout), now.Format(monthLayout)
+	if daily, err = r.store.Add(usagePrefix+k.Name+":"+day, n, dayReset(now), now); err != nil {
+		return 0, 0, err
+	}
+	if monthly, err = r.store.Add(usagePrefix+k.Name+":"+month, n, monthReset(now), now); err != nil {
+		return 0, 0, err
+	}
+	return daily, monthly, nil
+}
+
+// Forget resets the counters of the key called name, in the store and in
+// memory, so a key later created with the same name starts from zero. It
+// is meant for revoked keys; Revoke deletes the total kept in the database.
+func (r *Registry) Forget(name string, now time.Time) error {
+	r.mu.Lock()
+	delete(r.usage, name)
+	delete(r.dirty, name)
+	r.mu.Unlock()
+
+	// The counters of past days and months expire on their own.
+	now = now.UTC()
+	for key, reset := range map[string]time.Time{
+		usagePrefix + name + ":" + now.Format(dayLayout):   dayReset(now),
+		usagePrefix + name + ":" + now.Format(monthLayout): monthReset(now),
+	} {
+		count, err := r.store.Add(key, 0, reset, now)
+		if err != nil {
+			return err
+		}
+		if _, err := r.store.Add(key, -count, reset, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dayReset(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+func monthReset(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Flush writes the counters that changed since the last flush.
+func (r *Registry) Flush() error {
+	if r.db == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	pending := make(map[string][]byte, len(r.dirty))
+	for name := range r.dirty {
+		data, err := json.Marshal(r.usage[name])
+		if err != nil {
+			r.mu.Unlock()
+			return err
+		}
+		pending[name] = data
+	}
+	r.dirty = make(map[string]bool)
+	r.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	wb := r.db.NewWriteBatch()
+	defer wb.Cancel()
+	for name, data := range pending {
+		if err := wb.Set([]byte(usagePrefix+name), data); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// Run flushes the counters every interval until ctx is cancelled, then a
+// last time.
+func (r *Registry) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := r.Flush(); err != nil {
+				onError(err)
+			}
+			return
+		case <-ticker.C:
+			if err := r.Flush(); err != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// load returns the counters of name, reading them from the store the first
+// time. r.mu must be held.
+func (r *Registry) load(name string) (*Usage, error) {
+	if u, ok := r.usage[name]; ok {
+		return u, nil
+	}
+
+	u := &Usage{}
+	if r.db != nil {
+		err := r.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(usagePrefix + name))
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return item.Value(func(val []byte) error {
+				return json.Unmarshal(val, u)
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.usage[name] = u
+	return u, nil
+}
+
+// quotaStatus returns the quota of k closest to running out, given the
+// requests counted so far in the day and month of now.
+func quotaStatus(k *Key, daily, monthly int64, now time.Time) QuotaStatus {
+	var status QuotaStatus
+	now = now.UTC()
+
+	if k.MonthlyQuota > 0 {
+		status = QuotaStatus{
+			Period:    PeriodMonth,
+			Limit:     k.MonthlyQuota,
+			Remaining: k.MonthlyQuota - monthly,
+			Reset:     monthReset(now),
+		}
+	}
+	if k.DailyQuota > 0 && (status.Limit == 0 || k.DailyQuota-daily <= status.Remaining) {
+		status = QuotaStatus{
+			Period:    PeriodDay,
+			Limit:     k.DailyQuota,
+			Remaining: k.DailyQuota - daily,
+			Reset:     dayReset(now),
+		}
+	}
+
+	if status.Limit > 0 && status.Remaining < 0 {
+		status.Remaining = 0
+		status.Exceeded = true
+	}
+	return status
+}
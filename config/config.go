@@ -3,6 +3,7 @@ package config
 import (
 	"strings"
 
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -12,27 +13,131 @@ func NewConfig() *viper.Viper {
 
 	conf.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 
-	conf.SetDefault("mode", "listen") //listen, seed
+	conf.SetDefault("mode", "listen") //listen, seed, validate, diff, export, apikey
 
 	conf.SetDefault("api.port", 8080)
+	conf.SetDefault("api.listeners", []string{}) // e.g. unix:///run/brasilcep.sock http://:9090; empty listens on api.port
+	conf.SetDefault("api.unix_socket_mode", "0660")
+	conf.SetDefault("api.shutdown_timeout_seconds", 30)
+	conf.SetDefault("api.require_complete_dataset", false)
+	conf.SetDefault("api.health.canary_cep", "01001000") // empty checks for any CEP
+	conf.SetDefault("api.health.max_dataset_age_days", 0)
 
 	conf.SetDefault("api.prometheus.enable", true)
+
+	conf.SetDefault("api.access_log.enable", true)
+	conf.SetDefault("api.access_log.sample_ratio", 1.0) // server errors are always logged
+	conf.SetDefault("api.access_log.exclude_paths", []string{"/metrics", "/healthcheck", "/health/*"})
+	conf.SetDefault("api.access_log.masked_query_params", []string{}) // "*" masks every value; api.keys.query_param always is
+
+	conf.SetDefault("api.admin.enable", true) // false serves /metrics on the public listeners
+	conf.SetDefault("api.admin.listeners", []string{"127.0.0.1:9091"})
+	conf.SetDefault("api.admin.tokens", []string{}) // empty serves only health checks and metrics
+	conf.SetDefault("api.admin.pprof", true)
 	conf.SetDefault("api.enable.gzip", true)
 
 	conf.SetDefault("api.gzip.compression.level", 5)
 
 	conf.SetDefault("api.rate.limit.enable", true)
 	conf.SetDefault("api.rate.limit.max_allowed_requests_per_window", 100)
-	conf.SetDefault("api.rate.limit.requests_burst", 20)
 	conf.SetDefault("api.rate.limit.expire_minutes", 15)
+	conf.SetDefault("api.rate.limit.policies", []string{}) // e.g. 20/s 600/m 50000/d; empty uses 100/s, or the two settings above when set
+	conf.SetDefault("api.rate.limit.route_costs", []string{"/ceps=5", "/changes=5", "/bulk/*=100"})
+	conf.SetDefault("api.rate.limit.allow_cidrs", []string{})
+	conf.SetDefault("api.rate.limit.store", "memory") // memory, redis, file
+	conf.SetDefault("api.rate.limit.redis.addr", "localhost:6379")
+	conf.SetDefault("api.rate.limit.redis.password", "")
+	conf.SetDefault("api.rate.limit.redis.db", 0)
+	conf.SetDefault("api.rate.limit.redis.timeout_ms", 200)
+	conf.SetDefault("api.rate.limit.redis.pool_size", 16)
+	conf.SetDefault("api.rate.limit.redis.prefix", "brasilcep:ratelimit:")
+	conf.SetDefault("api.rate.limit.file.path", "./ratelimit")
+
+	conf.SetDefault("api.tls.enable", false)
+	conf.SetDefault("api.tls.cert_file", "")
+	conf.SetDefault("api.tls.key_file", "")
+	conf.SetDefault("api.tls.client_ca_file", "")
+	conf.SetDefault("api.tls.client_auth", "none") // none, optional, require
+	conf.SetDefault("api.tls.min_version", "1.2")
+	conf.SetDefault("api.tls.http2", true)
+	conf.SetDefault("api.tls.reload_interval_seconds", 30)
+
+	conf.SetDefault("api.proxy.header", "") // x-forwarded-for, x-real-ip, forwarded, cf-connecting-ip; empty uses the peer address
+	conf.SetDefault("api.proxy.trusted_cidrs", []string{})
+
+	conf.SetDefault("api.keys.enable", false)
+	conf.SetDefault("api.keys.required", false) // false lets requests without a key through, limited by IP
+	conf.SetDefault("api.keys.file", "")        // JSON file with extra keys, besides the ones in the database
+	conf.SetDefault("api.keys.header", "X-API-Key")
+	conf.SetDefault("api.keys.query_param", "api_key") // empty only accepts the header
+	conf.SetDefault("api.keys.default_rate_limit", 50) // requests per second
+	conf.SetDefault("api.keys.default_burst", 100)
+	conf.SetDefault("api.keys.flush_interval_seconds", 10)
+	conf.SetDefault("api.keys.reload_interval_seconds", 60) // 0 only loads the keys at startup
+
+	conf.SetDefault("api.list.default_limit", 50)
+	conf.SetDefault("api.list.max_limit", 500)
+
+	conf.SetDefault("api.bulk.tokens", []string{}) // empty disables /bulk
 
 	conf.SetDefault("api.cors.allow.origins", []string{"*"})
 	conf.SetDefault("api.cors.allow.methods", []string{"GET", "HEAD", "PUT", "PATCH", "POST", "DELETE"})
-	conf.SetDefault("api.cors.allow.headers", []string{"Origin", "Content-Type", "Accept", "Authorization"})
+	conf.SetDefault("api.cors.allow.headers", []string{"Origin", "Content-Type", "Accept", "Authorization", "X-API-Key"})
 
 	conf.SetDefault("db.path", "./data")
 	conf.SetDefault("db.raw.path", "./dne")
 
+	conf.SetDefault("seed.workers", 4)
+	conf.SetDefault("seed.report.path", "./import-report.json")
+	conf.SetDefault("seed.report.max_rejected_ratio", 0.01)
+	conf.SetDefault("seed.report.max_orphaned_ratio", 0.01)
+	conf.SetDefault("seed.strict", false)
+	conf.SetDefault("seed.resume", true)
+	conf.SetDefault("seed.history.enable", false)
+	conf.SetDefault("seed.history.retention_days", 0) // 0 keeps every version
+	conf.SetDefault("seed.release_date", "")          // YYYY-MM-DD, defaults to the import date
+	conf.SetDefault("seed.changes.enable", false)
+	conf.SetDefault("seed.changes.retention_days", 90) // 0 keeps every event
+	conf.SetDefault("seed.events.port", 0)             // 0 disables the progress stream, which only runs during a seed
+	conf.SetDefault("seed.events.host", "127.0.0.1")   // empty listens on every interface; api.admin.tokens apply
+	conf.SetDefault("seed.events.buffer", 256)
+	conf.SetDefault("seed.validation.report.path", "./validation-report.json")
+
+	conf.SetDefault("changes.webhooks.urls", []string{})
+	conf.SetDefault("changes.webhooks.secret", "")
+	conf.SetDefault("changes.webhooks.batch_size", 100)
+	conf.SetDefault("changes.webhooks.max_attempts", 5)
+	conf.SetDefault("changes.webhooks.timeout_seconds", 10)
+	conf.SetDefault("changes.webhooks.poll_interval_seconds", 30)
+	conf.SetDefault("changes.webhooks.max_backoff_seconds", 3600)
+	conf.SetDefault("changes.webhooks.lease_seconds", 30) // renewed every third
+
+	conf.SetDefault("diff.old.path", "")
+	conf.SetDefault("diff.new.path", "")
+	conf.SetDefault("diff.output.path", "./dne-diff.json")
+	conf.SetDefault("diff.format", "json")
+	conf.SetDefault("diff.scratch.path", "") // where releases are imported to be compared; empty uses the system temp dir
+
+	conf.SetDefault("export.dataset", "ceps") // ceps, localidades, bairros
+	conf.SetDefault("export.format", "csv")   // csv, ndjson, sql
+	conf.SetDefault("export.output.path", "") // defaults to ./<dataset>.<format>
+	conf.SetDefault("export.uf", []string{})
+	conf.SetDefault("export.prefix", "")
+	conf.SetDefault("export.tipo_origem", "")
+
+	conf.SetDefault("apikey.name", "") // empty lists the keys
+	conf.SetDefault("apikey.revoke", false)
+	conf.SetDefault("apikey.rate_limit", 0)
+	conf.SetDefault("apikey.burst", 0)
+	conf.SetDefault("apikey.daily_quota", 0)
+	conf.SetDefault("apikey.monthly_quota", 0)
+
+	conf.SetDefault("tracing.enable", false)
+	conf.SetDefault("tracing.endpoint", "") // e.g. http://collector:4318; empty uses OTEL_EXPORTER_OTLP_* or localhost:4318
+	conf.SetDefault("tracing.insecure", false)
+	conf.SetDefault("tracing.service_name", "brasilcep-api")
+	conf.SetDefault("tracing.sample_ratio", 1.0)
+
 	conf.SetDefault("log.format", "json")
 	conf.SetDefault("log.level", "info")
 
@@ -40,3 +145,59 @@ func NewConfig() *viper.Viper {
 
 	return conf
 }
+
+// BindFlags parses the command line on top of the env configuration. The
+// first positional argument selects the mode, e.g. "wserver seed --strict".
+func BindFlags(conf *viper.Viper, args []string) error {
+	flags := pflag.NewFlagSet("wserver", pflag.ContinueOnError)
+	flags.Bool("strict", false, "validate the DNE files before seeding and abort on any issue")
+	flags.String("old", "", "diff: DNE release to compare from (empty compares against the store)")
+	flags.String("new", "", "diff: DNE release to compare to (defaults to db.raw.path)")
+	flags.String("output", "", "diff, export: output file, - for stdout")
+	flags.String("format", "", "diff: json or csv; export: csv, ndjson or sql")
+	flags.String("dataset", "", "export: ceps, localidades or bairros")
+	flags.StringSlice("uf", nil, "export: only these UFs")
+	flags.String("prefix", "", "export: only CEPs starting with this prefix")
+	flags.String("tipo-origem", "", "export: only CEPs from this source type")
+	flags.String("name", "", "apikey: name of the key to create or revoke")
+	flags.Bool("revoke", false, "apikey: revoke the key instead of creating it")
+	flags.Float64("rate", 0, "apikey: requests per second (0 uses api.keys.default_rate_limit)")
+	flags.Int("burst", 0, "apikey: burst size (0 uses api.keys.default_burst)")
+	flags.Int64("daily-quota", 0, "apikey: requests per day, 0 for unlimited")
+	flags.Int64("monthly-quota", 0, "apikey: requests per month, 0 for unlimited")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	bindings := map[string]string{
+		"seed.strict":          "strict",
+		"diff.old.path":        "old",
+		"diff.new.path":        "new",
+		"diff.output.path":     "output",
+		"diff.format":          "format",
+		"export.output.path":   "output",
+		"export.format":        "format",
+		"export.dataset":       "dataset",
+		"export.uf":            "uf",
+		"export.prefix":        "prefix",
+		"export.tipo_origem":   "tipo-origem",
+		"apikey.name":          "name",
+		"apikey.revoke":        "revoke",
+		"apikey.rate_limit":    "rate",
+		"apikey.burst":         "burst",
+		"apikey.daily_quota":   "daily-quota",
+		"apikey.monthly_quota": "monthly-quota",
+	}
+	for key, name := range bindings {
+		if err := conf.BindPFlag(key, flags.Lookup(name)); err != nil {
+			return err
+		}
+	}
+
+	if flags.NArg() > 0 {
+		conf.Set("mode", flags.Arg(0))
+	}
+
+	return nil
+}
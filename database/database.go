@@ -1,7 +1,10 @@
 package database
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/brasilcep/api/logger"
@@ -12,6 +15,22 @@ import (
 
 var db *badger.DB
 
+// stopBackground cancels the maintenance goroutines started by NewDatabase,
+// which CloseDatabase waits for before closing the store.
+var (
+	stopBackground context.CancelFunc
+	background     sync.WaitGroup
+)
+
+// Value log garbage collection counters, exposed as metrics.
+var gcRuns, gcRewrites atomic.Uint64
+
+// GCStats returns how many value log GC passes ran and how many of them
+// rewrote a file.
+func GCStats() (runs, rewrites uint64) {
+	return gcRuns.Load(), gcRewrites.Load()
+}
+
 type BadgerLogger struct {
 	logger *logger.Logger
 }
@@ -56,7 +75,6 @@ func NewDatabase(conf *viper.Viper, logger *logger.Logger) error {
 	var err error
 	db, err = badger.Open(opts)
 	if err != nil {
-		logger.Error("Failed to open database", zap.Error(err))
 		return err
 	}
 
@@ -65,39 +83,30 @@ func NewDatabase(conf *viper.Viper, logger *logger.Logger) error {
 
 	logger.Info("Database successfully opened", zap.Duration("duration", elapsed))
 
+	ctx, cancel := context.WithCancel(context.Background())
+	stopBackground = cancel
+
+	background.Add(2)
 	go func() {
+		defer background.Done()
 		ticker := time.NewTicker(10 * time.Minute)
 		defer ticker.Stop()
 
-		for range ticker.C {
-			var count int
-			var dbSize int64
-
-			err := db.View(func(txn *badger.Txn) error {
-				opts := badger.DefaultIteratorOptions
-				it := txn.NewIterator(opts)
-				defer it.Close()
-
-				for it.Rewind(); it.Valid(); it.Next() {
-					item := it.Item()
-					count++
-					dbSize += int64(item.EstimatedSize())
-				}
-				return nil
-			})
-
-			if err != nil {
-				logger.Error("Error while iterating over database", zap.Error(err))
-				continue
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				lsm, vlog := db.Size()
+				logger.Debug("Database statistics", zap.Int64("lsm_size_bytes", lsm), zap.Int64("vlog_size_bytes", vlog))
 			}
-
-			logger.Debug("Database statistics", zap.Int("total_ceps", count), zap.Int64("database_size_bytes", dbSize))
 		}
 	}()
 
 	go func() {
+		defer background.Done()
 		logger.Info("Starting garbage collector")
-		garbageCollector(db, logger)
+		garbageCollector(ctx, db, logger)
 		logger.Info("Garbage collector stopped")
 	}()
 
@@ -108,20 +117,38 @@ func GetDB() *badger.DB {
 	return db
 }
 
-func CloseDatabase() {
-	if db != nil {
-		db.Close()
+// CloseDatabase stops the background goroutines and closes the store. It is
+// safe to call when NewDatabase was never called or failed.
+func CloseDatabase() error {
+	if stopBackground != nil {
+		stopBackground()
+		background.Wait()
+		stopBackground = nil
+	}
+	if db == nil || db.IsClosed() {
+		return nil
 	}
+	return db.Close()
 }
 
-func garbageCollector(db *badger.DB, logger *logger.Logger) {
+func garbageCollector(ctx context.Context, db *badger.DB, logger *logger.Logger) {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	again:
+		if ctx.Err() != nil {
+			return
+		}
 		err := db.RunValueLogGC(0.5)
+		gcRuns.Add(1)
 		if err == nil {
+			gcRewrites.Add(1)
 			logger.Info("Garbage collection completed successfully")
 			goto again
 		}
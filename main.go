@@ -1,11 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/brasilcep/api/api"
+	"github.com/brasilcep/api/apikeys"
 	"github.com/brasilcep/api/config"
 	"github.com/brasilcep/api/database"
 	"github.com/brasilcep/api/logger"
+	"github.com/brasilcep/api/tracing"
 	"github.com/brasilcep/api/zipcodes"
+	"go.uber.org/zap"
 )
 
 var (
@@ -16,7 +27,18 @@ var (
 )
 
 func main() {
-	config := config.NewConfig()
+	os.Exit(run())
+}
+
+// run executes the selected mode and returns the exit code of the process.
+// Failures are returned rather than exiting on the spot, so the database is
+// closed and the pending traces flushed on every path.
+func run() int {
+	conf := config.NewConfig()
+	if err := config.BindFlags(conf, os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
 
 	buildInfo := api.BuildInfo{
 		Version:  Version,
@@ -25,23 +47,193 @@ func main() {
 		Compiler: Compiler,
 	}
 
-	log_level := config.GetString("log.level")
+	log_level := conf.GetString("log.level")
 
 	logger := logger.NewLogger(log_level)
 
-	database.NewDatabase(config, logger)
+	shutdownTracing, err := tracing.Setup(context.Background(), conf, Version)
+	if err != nil {
+		logger.Error("Failed to set up tracing", zap.Error(err))
+		return 1
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("Failed to flush traces", zap.Error(err))
+		}
+	}()
+	defer func() {
+		if err := database.CloseDatabase(); err != nil {
+			logger.Error("Failed to close database", zap.Error(err))
+		}
+	}()
 
-	mode := config.GetString("mode")
+	mode := conf.GetString("mode")
 
 	switch mode {
 	case "listen":
-		api := api.NewAPI(config, logger, buildInfo)
-		api.Listen()
+		if err := database.NewDatabase(conf, logger); err != nil {
+			logger.Error("Failed to open database", zap.Error(err))
+			return 1
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		api := api.NewAPI(conf, logger, buildInfo)
+		err := api.Listen(ctx)
+		stop()
+		if err != nil {
+			logger.Error("HTTP server failed", zap.Error(err))
+			return 1
+		}
 	case "seed":
-		dnePath := config.GetString("db.raw.path")
-		zipcodesImporter := zipcodes.NewZipCodeImporter(logger)
-		zipcodesImporter.PopulateZipcodes(dnePath)
+		if err := database.NewDatabase(conf, logger); err != nil {
+			logger.Error("Failed to open database", zap.Error(err))
+			return 1
+		}
+		dnePath := conf.GetString("db.raw.path")
+		zipcodesImporter := zipcodes.NewZipCodeImporter(conf, logger)
+
+		var eventsServer *api.ImportEventsServer
+		bus := zipcodes.NewEventBus(conf.GetInt("seed.events.buffer"))
+		zipcodesImporter.PublishTo(bus)
+		if conf.GetInt("seed.events.port") > 0 {
+			eventsServer = api.NewImportEventsServer(conf, logger, bus)
+			eventsServer.Start()
+		}
+
+		report, err := zipcodesImporter.PopulateZipcodes(dnePath)
+
+		bus.Close()
+		if eventsServer != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			eventsServer.Shutdown(ctx)
+			cancel()
+		}
+
+		if err != nil {
+			logger.Error("Import failed", zap.Error(err))
+			return 1
+		}
+		if report.Failed {
+			logger.Error("Import finished above failure thresholds", zap.Strings("failures", report.Failures))
+			return 1
+		}
+	case "validate":
+		dnePath := conf.GetString("db.raw.path")
+		zipcodesImporter := zipcodes.NewZipCodeImporter(conf, logger)
+		report, err := zipcodesImporter.Validate(dnePath)
+		if err != nil {
+			logger.Error("Validation failed", zap.Error(err))
+			return 1
+		}
+		if !report.Valid {
+			logger.Error("DNE files are not valid", zap.Any("issues", report.Totals))
+			return 1
+		}
+	case "diff":
+		oldPath := conf.GetString("diff.old.path")
+		newPath := conf.GetString("diff.new.path")
+		if newPath == "" {
+			newPath = conf.GetString("db.raw.path")
+		}
+		if oldPath == "" {
+			if err := database.NewDatabase(conf, logger); err != nil {
+				logger.Error("Failed to open database", zap.Error(err))
+				return 1
+			}
+		}
+		zipcodesImporter := zipcodes.NewZipCodeImporter(conf, logger)
+		report, err := zipcodesImporter.Diff(oldPath, newPath)
+		if err != nil {
+			logger.Error("Diff failed", zap.Error(err))
+			return 1
+		}
+		report.Log(logger)
+		output := conf.GetString("diff.output.path")
+		if err := report.WriteFile(output, conf.GetString("diff.format")); err != nil {
+			logger.Error("Failed to write diff", zap.String("path", output), zap.Error(err))
+			return 1
+		}
+	case "export":
+		if err := database.NewDatabase(conf, logger); err != nil {
+			logger.Error("Failed to open database", zap.Error(err))
+			return 1
+		}
+		output := conf.GetString("export.output.path")
+		if output == "" {
+			output = fmt.Sprintf("./%s.%s", conf.GetString("export.dataset"), conf.GetString("export.format"))
+		}
+		out := os.Stdout
+		if output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				logger.Error("Failed to create export file", zap.String("path", output), zap.Error(err))
+				return 1
+			}
+			defer f.Close()
+			out = f
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		count, err := zipcodes.Export(ctx, database.GetDB(), out, zipcodes.ExportOptions{
+			Dataset:    conf.GetString("export.dataset"),
+			Format:     conf.GetString("export.format"),
+			UFs:        conf.GetStringSlice("export.uf"),
+			Prefix:     conf.GetString("export.prefix"),
+			TipoOrigem: conf.GetString("export.tipo_origem"),
+		})
+		if err != nil {
+			logger.Error("Export failed", zap.Error(err))
+			return 1
+		}
+		logger.Info("Export completed", zap.String("dataset", conf.GetString("export.dataset")), zap.Int("count", count), zap.String("path", output))
+	case "apikey":
+		if err := database.NewDatabase(conf, logger); err != nil {
+			logger.Error("Failed to open database", zap.Error(err))
+			return 1
+		}
+		db := database.GetDB()
+		name := conf.GetString("apikey.name")
+		switch {
+		case name == "":
+			keys, err := apikeys.List(db)
+			if err != nil {
+				logger.Error("Failed to list API keys", zap.Error(err))
+				return 1
+			}
+			enc := json.NewEncoder(os.Stdout)
+			for _, k := range keys {
+				enc.Encode(k)
+			}
+		case conf.GetBool("apikey.revoke"):
+			found, err := apikeys.Revoke(db, name)
+			if err != nil {
+				logger.Error("Failed to revoke API key", zap.Error(err))
+				return 1
+			}
+			if !found {
+				logger.Error("API key not found", zap.String("name", name))
+				return 1
+			}
+			logger.Info("API key revoked", zap.String("name", name))
+		default:
+			secret, err := apikeys.Create(db, apikeys.Key{
+				Name:         name,
+				RateLimit:    conf.GetFloat64("apikey.rate_limit"),
+				Burst:        conf.GetInt("apikey.burst"),
+				DailyQuota:   conf.GetInt64("apikey.daily_quota"),
+				MonthlyQuota: conf.GetInt64("apikey.monthly_quota"),
+			})
+			if err != nil {
+				logger.Error("Failed to create API key", zap.Error(err))
+				return 1
+			}
+			logger.Info("API key created, store it now: it can not be shown again", zap.String("name", name))
+			fmt.Println(secret)
+		}
 	default:
-		logger.Fatal("Invalid mode specified")
+		logger.Error("Invalid mode specified")
+		return 2
 	}
+	return 0
 }
@@ -0,0 +1,184 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sweepEvery is how many increments a FileStore does between removals of
+// the files of ended windows.
+const sweepEvery = 1000
+
+// FileStore keeps one small counter file per key and window in a directory
+// shared by the replicas, e.g. a volume mounted in every container of a
+// host. Updates are serialized with advisory file locks.
+type FileStore struct {
+	dir        string
+	increments atomic.Int64
+}
+
+// NewFileStore returns a store in dir, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Increment implements Store.
+func (s *FileStore) Increment(key string, n int64, window time.Duration, now time.Time) (int64, error) {
+	return s.add(fileName(key, window, now), n, now)
+}
+
+// Add implements Store. The counter file is named as a window of length
+// expires that ends at expires, so Sweep removes it once it expired.
+func (s *FileStore) Add(key string, n int64, expires, now time.Time) (int64, error) {
+	sum := sha256.Sum256([]byte(key))
+	return s.add(hex.EncodeToString(sum[:16])+"-"+strconv.FormatInt(expires.UnixMilli(), 10)+"-0", n, now)
+}
+
+// Set implements Store. The value file holds the expiry in Unix
+// milliseconds, zero for none, followed by the value. It is replaced with a
+// rename, so readers never see half of it.
+func (s *FileStore) Set(key string, value []byte, expires, now time.Time) error {
+	var ms int64
+	if !expires.IsZero() {
+		ms = expires.UnixMilli()
+	}
+	data := binary.BigEndian.AppendUint64(nil, uint64(ms))
+	data = append(data, value...)
+
+	f, err := os.CreateTemp(s.dir, ".value-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.dir, valueName(key)))
+}
+
+// Get implements Store.
+func (s *FileStore) Get(key string, now time.Time) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, valueName(key)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 {
+		return nil, fmt.Errorf("ratelimit: malformed value file for %q", key)
+	}
+	if ms := int64(binary.BigEndian.Uint64(data)); ms != 0 && !time.UnixMilli(ms).After(now) {
+		return nil, nil
+	}
+	return data[8:], nil
+}
+
+// add counts n hits in the counter file name.
+func (s *FileStore) add(name string, n int64, now time.Time) (int64, error) {
+	if s.increments.Add(1)%sweepEvery == 0 {
+		go s.Sweep(now)
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return 0, err
+	}
+	defer unlockFile(f)
+
+	var buf [8]byte
+	if _, err := f.ReadAt(buf[:], 0); err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	count := int64(binary.BigEndian.Uint64(buf[:])) + n
+	binary.BigEndian.PutUint64(buf[:], uint64(count))
+	if _, err := f.WriteAt(buf[:], 0); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Sweep removes the counters of windows that ended before now and the
+// values that expired.
+func (s *FileStore) Sweep(now time.Time) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".value") {
+			s.sweepValue(entry.Name(), now)
+			continue
+		}
+		parts := strings.Split(entry.Name(), "-")
+		if len(parts) != 3 {
+			continue
+		}
+		window, err1 := strconv.ParseInt(parts[1], 10, 64)
+		index, err2 := strconv.ParseInt(parts[2], 10, 64)
+		if err1 != nil || err2 != nil || window <= 0 {
+			continue
+		}
+		if time.UnixMilli((index + 1) * window).Before(now) {
+			os.Remove(filepath.Join(s.dir, entry.Name()))
+		}
+	}
+	return nil
+}
+
+// sweepValue removes the value file name if it expired before now.
+func (s *FileStore) sweepValue(name string, now time.Time) {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return
+	}
+	var buf [8]byte
+	_, err = io.ReadFull(f, buf[:])
+	f.Close()
+	if ms := int64(binary.BigEndian.Uint64(buf[:])); err == nil && ms != 0 && time.UnixMilli(ms).Before(now) {
+		os.Remove(filepath.Join(s.dir, name))
+	}
+}
+
+// Close implements Store.
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// valueName is <key hash>.value, which Sweep leaves alone.
+func valueName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16]) + ".value"
+}
+
+// fileName is <key hash>-<window ms>-<window index>, so identifiers of any
+// shape are safe file names.
+func fileName(key string, window time.Duration, now time.Time) string {
+	sum := sha256.Sum256([]byte(key))
+	ms := window.Milliseconds()
+	return hex.EncodeToString(sum[:16]) + "-" + strconv.FormatInt(ms, 10) + "-" + strconv.FormatInt(now.UnixMilli()/ms, 10)
+}
@@ -0,0 +1,75 @@
+package ratelimit
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Lease elects a single holder among the replicas sharing a Store, one term
+// at a time. The holder claims the next term while the current one runs,
+// and the others only try to claim a term once it started, so the lease
+// stays with its holder as long as it checks at least once per term and
+// only moves after a whole term without checks. Checking every third of a
+// term leaves room for slow stores and clock skew.
+type Lease struct {
+	store Store
+	key   string
+	term  time.Duration
+	now   func() time.Time
+
+	mu    sync.Mutex
+	held  int64 // index of the last term held
+	next  bool  // whether the term after held is held too
+	tried int64 // index of the last term claimed
+}
+
+// NewLease returns a lease named key with terms of the given length.
+func NewLease(store Store, key string, term time.Duration) *Lease {
+	return &Lease{store: store, key: key, term: term, now: time.Now, held: -2, tried: -1}
+}
+
+// Held reports whether this replica holds the lease for the current term,
+// claiming it when it is free and claiming the next term when it does. It
+// is safe for concurrent use.
+func (l *Lease) Held() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	index := now.UnixNano() / int64(l.term)
+	switch {
+	case index == l.held:
+	case index == l.held+1 && l.next:
+		l.held, l.next = index, false
+	case index == l.tried:
+		return false, nil
+	default:
+		ok, err := l.claim(index, now)
+		if err != nil || !ok {
+			return false, err
+		}
+		l.held, l.next = index, false
+	}
+
+	if l.tried <= index {
+		// A failed claim of the next term is retried on the next check;
+		// this one is held either way.
+		if ok, err := l.claim(index+1, now); err == nil {
+			l.next = ok
+		}
+	}
+	return true, nil
+}
+
+// claim claims the term index, reporting whether no other replica did
+// before. Every term is claimed once per replica.
+func (l *Lease) claim(index int64, now time.Time) (bool, error) {
+	end := time.Unix(0, (index+1)*int64(l.term))
+	count, err := l.store.Add(l.key+":"+strconv.FormatInt(index, 10), 1, end.Add(l.term), now)
+	if err != nil {
+		return false, err
+	}
+	l.tried = index
+	return count == 1, nil
+}
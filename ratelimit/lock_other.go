@@ -0,0 +1,18 @@
+//go:build !unix
+
+package ratelimit
+
+import (
+	"errors"
+	"os"
+)
+
+var errLockUnsupported = errors.New("ratelimit: the file store needs file locks, only available on unix")
+
+func lockFile(f *os.File) error {
+	return errLockUnsupported
+}
+
+func unlockFile(f *os.File) error {
+	return errLockUnsupported
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps the counters in the process. Counters of ended windows
+// are dropped every sweepEvery increments.
+type MemoryStore struct {
+	mu         sync.Mutex
+	counters   map[string]memoryCounter
+	values     map[string]memoryValue
+	increments int
+}
+
+type memoryCounter struct {
+	count   int64
+	expires time.Time
+}
+
+type memoryValue struct {
+	value   []byte
+	expires time.Time
+}
+
+func (v memoryValue) expired(now time.Time) bool {
+	return !v.expires.IsZero() && !v.expires.After(now)
+}
+
+// NewMemoryStore returns an empty store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{counters: make(map[string]memoryCounter), values: make(map[string]memoryValue)}
+}
+
+// Increment implements Store.
+func (s *MemoryStore) Increment(key string, n int64, window time.Duration, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	return s.add(windowKey(key, window, now), n, windowEnd(window, now), now), nil
+}
+
+// Add implements Store.
+func (s *MemoryStore) Add(key string, n int64, expires, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	return s.add(key, n, expires, now), nil
+}
+
+// Set implements Store.
+func (s *MemoryStore) Set(key string, value []byte, expires, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	s.values[key] = memoryValue{value: append([]byte(nil), value...), expires: expires}
+	return nil
+}
+
+// Get implements Store.
+func (s *MemoryStore) Get(key string, now time.Time) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.values[key]
+	if !ok || v.expired(now) {
+		return nil, nil
+	}
+	return append([]byte(nil), v.value...), nil
+}
+
+// add adds n to the counter k, restarting it when it expired. s.mu must be
+// held.
+func (s *MemoryStore) add(k string, n int64, expires, now time.Time) int64 {
+	c := s.counters[k]
+	if !c.expires.After(now) {
+		c.count = 0
+	}
+	c.count += n
+	c.expires = expires
+	s.counters[k] = c
+	return c.count
+}
+
+// sweep drops the expired counters and values every sweepEvery updates. s.mu must be
+// held.
+func (s *MemoryStore) sweep(now time.Time) {
+	s.increments++
+	if s.increments%sweepEvery != 0 {
+		return
+	}
+	for k, c := range s.counters {
+		if !c.expires.After(now) {
+			delete(s.counters, k)
+		}
+	}
+	for k, v := range s.values {
+		if v.expired(now) {
+			delete(s.values, k)
+		}
+	}
+}
+
+// Close implements Store.
+func (s *MemoryStore) Close() error {
+	return nil
+}
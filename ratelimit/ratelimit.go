@@ -0,0 +1,158 @@
+// Package ratelimit counts requests in fixed windows kept in a store that
+// can be shared by every replica of the API.
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store counts hits per key in fixed windows and keeps small values, such as
+// the state of a single elected worker. Implementations must be safe for
+// concurrent use; only the ones keeping the data outside the process make a
+// limit hold across replicas.
+type Store interface {
+	// Increment adds n hits to key in the window of the given length that
+	// contains now, and returns the hits in that window so far.
+	Increment(key string, n int64, window time.Duration, now time.Time) (int64, error)
+	// Add adds n, which may be negative, to the counter key, kept until
+	// expires, and returns its value. It counts periods that are not fixed
+	// windows, such as calendar months.
+	Add(key string, n int64, expires, now time.Time) (int64, error)
+	// Set stores value under key until expires, or until it is overwritten
+	// when expires is zero. Values and counters do not share keys.
+	Set(key string, value []byte, expires, now time.Time) error
+	// Get returns the value stored under key, or nil when there is none or
+	// it expired.
+	Get(key string, now time.Time) ([]byte, error)
+	Close() error
+}
+
+// windowKey names the window of length window containing now. Windows are
+// aligned to the Unix epoch so every replica agrees on them.
+func windowKey(key string, window time.Duration, now time.Time) string {
+	return fmt.Sprintf("%s:%d:%d", key, window.Milliseconds(), now.UnixNano()/int64(window))
+}
+
+// Policy allows Limit hits per Window.
+type Policy struct {
+	Limit  int64
+	Window time.Duration
+}
+
+// ParsePolicy parses "<limit>/<window>", where window is s, m, h or d (one
+// second, minute, hour or day) or a Go duration such as 15m.
+func ParsePolicy(s string) (Policy, error) {
+	limit, window, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return Policy{}, fmt.Errorf("ratelimit: policy %q is not <limit>/<window>", s)
+	}
+
+	var p Policy
+	var err error
+	if p.Limit, err = strconv.ParseInt(limit, 10, 64); err != nil || p.Limit <= 0 {
+		return Policy{}, fmt.Errorf("ratelimit: policy %q has an invalid limit", s)
+	}
+	switch window {
+	case "s":
+		p.Window = time.Second
+	case "m":
+		p.Window = time.Minute
+	case "h":
+		p.Window = time.Hour
+	case "d":
+		p.Window = 24 * time.Hour
+	default:
+		if p.Window, err = time.ParseDuration(window); err != nil || p.Window < time.Second {
+			return Policy{}, fmt.Errorf("ratelimit: policy %q has an invalid window", s)
+		}
+	}
+	return p, nil
+}
+
+// String formats p the way ParsePolicy reads it.
+func (p Policy) String() string {
+	switch p.Window {
+	case time.Second:
+		return fmt.Sprintf("%d/s", p.Limit)
+	case time.Minute:
+		return fmt.Sprintf("%d/m", p.Limit)
+	case time.Hour:
+		return fmt.Sprintf("%d/h", p.Limit)
+	case 24 * time.Hour:
+		return fmt.Sprintf("%d/d", p.Limit)
+	}
+	return fmt.Sprintf("%d/%s", p.Limit, p.Window)
+}
+
+// Decision is the outcome of Limiter.Allow. Policy is the policy that denied
+// the hits, or the one closest to its limit, and Reset the end of its
+// current window.
+type Decision struct {
+	Allowed   bool
+	Policy    Policy
+	Remaining int64
+	Reset     time.Time
+}
+
+// Limiter applies a set of policies to hits per identifier, e.g. 20 per
+// second and 10000 per day at the same time.
+type Limiter struct {
+	store    Store
+	policies []Policy
+	onError  func(error)
+	now      func() time.Time
+}
+
+// NewLimiter returns a limiter counting in store. When the store fails the
+// hits are allowed and onError, if set, is called: an unreachable store
+// must not take the API down.
+func NewLimiter(store Store, policies []Policy, onError func(error)) *Limiter {
+	return &Limiter{store: store, policies: policies, onError: onError, now: time.Now}
+}
+
+// Allow counts cost hits of identifier against every policy. When several
+// policies are exceeded, the decision is the one that resets last.
+func (l *Limiter) Allow(identifier string, cost int64) Decision {
+	now := l.now()
+	decision := Decision{Allowed: true, Remaining: -1}
+
+	for _, p := range l.policies {
+		count, err := l.store.Increment(identifier, cost, p.Window, now)
+		if err != nil {
+			if l.onError != nil {
+				l.onError(err)
+			}
+			continue
+		}
+
+		current := Decision{
+			Allowed:   count <= p.Limit,
+			Policy:    p,
+			Remaining: max(p.Limit-count, 0),
+			Reset:     windowEnd(p.Window, now),
+		}
+		switch {
+		case !current.Allowed && (decision.Allowed || current.Reset.After(decision.Reset)):
+			decision = current
+		case decision.Allowed && (decision.Remaining < 0 || current.Remaining < decision.Remaining):
+			decision = current
+		}
+	}
+	if decision.Remaining < 0 {
+		decision.Remaining = 0
+	}
+	return decision
+}
+
+// Close closes the store.
+func (l *Limiter) Close() error {
+	return l.store.Close()
+}
+
+func windowEnd(window time.Duration, now time.Time) time.Time {
+	end := (now.UnixNano()/int64(window) + 1) * int64(window)
+	return now.Add(time.Duration(end - now.UnixNano()))
+}
@@ -0,0 +1,385 @@
+package ratelimit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis is a stand-in for a Redis server that understands the commands
+// RedisStore sends.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	counters map[string]int64
+	ttls     map[string]string
+	values   map[string]fakeValue
+}
+
+// fakeValue is a string set with SET, expiring at expires when it is set.
+type fakeValue struct {
+	value   string
+	expires time.Time
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeRedis{ln: ln, password: password, counters: map[string]int64{}, ttls: map[string]string{}, values: map[string]fakeValue{}}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "SELECT":
+			reply = "+OK\r\n"
+		case cmd == "INCRBY":
+			n, _ := strconv.ParseInt(args[2], 10, 64)
+			f.mu.Lock()
+			f.counters[args[1]] += n
+			reply = fmt.Sprintf(":%d\r\n", f.counters[args[1]])
+			f.mu.Unlock()
+		case cmd == "SET":
+			v := fakeValue{value: args[2]}
+			if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+				ms, _ := strconv.ParseInt(args[4], 10, 64)
+				v.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+			f.mu.Lock()
+			f.values[args[1]] = v
+			if len(args) == 5 {
+				f.ttls[args[1]] = args[4]
+			}
+			f.mu.Unlock()
+			reply = "+OK\r\n"
+		case cmd == "GET":
+			f.mu.Lock()
+			v, ok := f.values[args[1]]
+			f.mu.Unlock()
+			reply = "$-1\r\n"
+			if ok && (v.expires.IsZero() || time.Now().Before(v.expires)) {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v.value), v.value)
+			}
+		case cmd == "PEXPIRE" || cmd == "PEXPIREAT":
+			f.mu.Lock()
+			f.ttls[args[1]] = args[2]
+			f.mu.Unlock()
+			reply = ":1\r\n"
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func testStore(t *testing.T, store Store) {
+	now := time.Date(2024, 5, 31, 12, 0, 30, 0, time.UTC)
+
+	for n := int64(1); n <= 3; n++ {
+		count, err := store.Increment("10.0.0.1", 1, time.Minute, now)
+		require.NoError(t, err)
+		assert.Equal(t, n, count)
+	}
+
+	count, err := store.Increment("10.0.0.2", 1, time.Minute, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count, "keys are counted apart")
+
+	count, err = store.Increment("10.0.0.1", 1, time.Minute, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count, "a new window starts from zero")
+
+	count, err = store.Increment("10.0.0.1", 1, time.Second, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count, "windows of different lengths are counted apart")
+
+	count, err = store.Increment("10.0.0.1", 5, time.Minute, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), count, "hits can cost more than one")
+
+	month := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	for n := int64(1); n <= 2; n++ {
+		count, err = store.Add("quota:2024-05", 1, month, now)
+		require.NoError(t, err)
+		assert.Equal(t, n, count)
+	}
+	count, err = store.Add("quota:2024-05", -1, month, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count, "counters can be decremented")
+	count, err = store.Add("quota:2024-05", 0, month, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), count, "adding zero reads the counter")
+
+	value, err := store.Get("cursor", now)
+	require.NoError(t, err)
+	assert.Nil(t, value)
+	require.NoError(t, store.Set("cursor", []byte("42"), time.Time{}, now))
+	require.NoError(t, store.Set("cursor", []byte("43"), time.Time{}, now))
+	value, err = store.Get("cursor", now.Add(24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("43"), value, "values without expiry are kept")
+
+	require.NoError(t, store.Set("owner", []byte("replica-1"), now.Add(time.Minute), now))
+	value, err = store.Get("owner", now.Add(59*time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("replica-1"), value)
+}
+
+// testValueExpiry checks that values expire, for the stores following the
+// clock they are given.
+func testValueExpiry(t *testing.T, store Store) {
+	now := time.Date(2024, 5, 31, 12, 0, 30, 0, time.UTC)
+	require.NoError(t, store.Set("owner", []byte("replica-1"), now.Add(time.Minute), now))
+	value, err := store.Get("owner", now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Nil(t, value, "expired values are gone")
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+	testValueExpiry(t, NewMemoryStore())
+}
+
+func TestRedisStore(t *testing.T) {
+	server := startFakeRedis(t, "segredo")
+	store := NewRedisStore(RedisConfig{Addr: server.ln.Addr().String(), Password: "segredo", DB: 2, Timeout: time.Second, PoolSize: 2, Prefix: "rl:"})
+	defer store.Close()
+
+	testStore(t, store)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for key, ttl := range server.ttls {
+		assert.True(t, strings.HasPrefix(key, "rl:"))
+		assert.Contains(t, []string{"120000", "2000", "1717200000000", "60000"}, ttl)
+	}
+
+	t.Run("wrong password", func(t *testing.T) {
+		store := NewRedisStore(RedisConfig{Addr: server.ln.Addr().String(), Password: "errada", Timeout: time.Second})
+		_, err := store.Increment("10.0.0.1", 1, time.Minute, time.Now())
+		var redisErr redisError
+		assert.True(t, errors.As(err, &redisErr))
+	})
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	testStore(t, store)
+	testValueExpiry(t, store)
+
+	t.Run("concurrent increments", func(t *testing.T) {
+		other, err := NewFileStore(dir)
+		require.NoError(t, err)
+		now := time.Now()
+
+		var wg sync.WaitGroup
+		for n := 0; n < 50; n++ {
+			wg.Add(1)
+			go func(s Store) {
+				defer wg.Done()
+				_, err := s.Increment("shared", 1, time.Hour, now)
+				assert.NoError(t, err)
+			}([]Store{store, other}[n%2])
+		}
+		wg.Wait()
+
+		count, err := store.Increment("shared", 1, time.Hour, now)
+		require.NoError(t, err)
+		assert.Equal(t, int64(51), count)
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		require.NoError(t, store.Sweep(time.Now().Add(3*time.Hour)))
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1, "only the value without expiry is left")
+		assert.True(t, strings.HasSuffix(entries[0].Name(), ".value"))
+	})
+}
+
+type failingStore struct{}
+
+func (failingStore) Increment(string, int64, time.Duration, time.Time) (int64, error) {
+	return 0, errors.New("unreachable")
+}
+
+func (failingStore) Add(string, int64, time.Time, time.Time) (int64, error) {
+	return 0, errors.New("unreachable")
+}
+
+func (failingStore) Set(string, []byte, time.Time, time.Time) error {
+	return errors.New("unreachable")
+}
+
+func (failingStore) Get(string, time.Time) ([]byte, error) {
+	return nil, errors.New("unreachable")
+}
+
+func (failingStore) Close() error { return nil }
+
+func TestParsePolicy(t *testing.T) {
+	for input, want := range map[string]Policy{
+		"20/s":    {Limit: 20, Window: time.Second},
+		"600/m":   {Limit: 600, Window: time.Minute},
+		"1000/h":  {Limit: 1000, Window: time.Hour},
+		"50000/d": {Limit: 50000, Window: 24 * time.Hour},
+		"100/15m": {Limit: 100, Window: 15 * time.Minute},
+	} {
+		p, err := ParsePolicy(input)
+		require.NoError(t, err, input)
+		assert.Equal(t, want, p, input)
+	}
+
+	for _, input := range []string{"", "20", "0/s", "x/s", "20/y", "20/10ms"} {
+		_, err := ParsePolicy(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(NewMemoryStore(), []Policy{{Limit: 2, Window: time.Second}, {Limit: 5, Window: time.Minute}}, nil)
+	now := time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	decision := limiter.Allow("10.0.0.1", 1)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, int64(1), decision.Remaining)
+	assert.Equal(t, time.Second, decision.Policy.Window, "the per second policy is the closest to its limit")
+
+	assert.True(t, limiter.Allow("10.0.0.1", 1).Allowed)
+	decision = limiter.Allow("10.0.0.1", 1)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, now.Add(time.Second), decision.Reset)
+
+	now = now.Add(time.Second)
+	decision = limiter.Allow("10.0.0.1", 3)
+	assert.False(t, decision.Allowed, "6 hits in the minute, denied ones included")
+	assert.Equal(t, time.Minute, decision.Policy.Window, "the policy that resets last")
+	assert.Equal(t, now.Add(59*time.Second), decision.Reset)
+
+	assert.True(t, limiter.Allow("10.0.0.2", 1).Allowed, "identifiers are limited apart")
+
+	t.Run("store failures allow the request", func(t *testing.T) {
+		var failures int
+		limiter := NewLimiter(failingStore{}, []Policy{{Limit: 1, Window: time.Minute}}, func(error) { failures++ })
+		assert.True(t, limiter.Allow("10.0.0.1", 1).Allowed)
+		assert.Equal(t, 1, failures)
+	})
+}
+
+func TestLease(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	a := NewLease(store, "sender", time.Minute)
+	b := NewLease(store, "sender", time.Minute)
+	a.now, b.now = clock, clock
+
+	held := func(l *Lease) bool {
+		ok, err := l.Held()
+		require.NoError(t, err)
+		return ok
+	}
+
+	now = now.Add(10 * time.Second)
+	assert.True(t, held(a), "first to claim the term")
+	assert.False(t, held(b))
+	assert.True(t, held(a), "held until the term ends")
+
+	// The holder claimed the next term while checking in this one, so the
+	// others lose even when they check first.
+	now = now.Add(time.Minute - 10*time.Second)
+	assert.False(t, held(b))
+	assert.True(t, held(a))
+	for range 5 {
+		now = now.Add(20 * time.Second)
+		assert.False(t, held(b), "the holder keeps the lease checking every third of a term")
+		assert.True(t, held(a))
+	}
+
+	// The holder stops checking: its last claimed term runs out first.
+	now = now.Add(time.Minute)
+	assert.False(t, held(b), "the term claimed ahead by the holder")
+	now = now.Add(time.Minute)
+	assert.True(t, held(b), "taken over once the holder stopped claiming")
+	assert.False(t, held(a))
+
+	t.Run("store failures do not grant the lease", func(t *testing.T) {
+		lease := NewLease(failingStore{}, "sender", time.Minute)
+		lease.now = func() time.Time { return now.Add(30 * time.Second) }
+		ok, err := lease.Held()
+		assert.Error(t, err)
+		assert.False(t, ok)
+	})
+}
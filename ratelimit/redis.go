@@ -0,0 +1,257 @@
+package ratelimit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RedisConfig configures a RedisStore. Anything speaking the Redis protocol
+// (Redis, Valkey, KeyDB, Dragonfly) works.
+type RedisConfig struct {
+	Addr     string
+	Password string
+	DB       int
+	Timeout  time.Duration
+	PoolSize int
+	Prefix   string
+}
+
+// RedisStore keeps the counters in a Redis server, one key per window that
+// expires after the window ends.
+type RedisStore struct {
+	config RedisConfig
+	pool   chan *redisConn
+}
+
+// NewRedisStore returns a store for config. Connections are opened on
+// demand, so the server does not need to be up yet.
+func NewRedisStore(config RedisConfig) *RedisStore {
+	if config.PoolSize <= 0 {
+		config.PoolSize = 1
+	}
+	return &RedisStore{config: config, pool: make(chan *redisConn, config.PoolSize)}
+}
+
+// Increment implements Store with a pipelined INCRBY and PEXPIRE.
+func (s *RedisStore) Increment(key string, n int64, window time.Duration, now time.Time) (int64, error) {
+	conn, err := s.get()
+	if err != nil {
+		return 0, err
+	}
+
+	k := s.config.Prefix + windowKey(key, window, now)
+	ttl := strconv.FormatInt((2 * window).Milliseconds(), 10)
+	count, err := conn.pipeline(
+		[]string{"INCRBY", k, strconv.FormatInt(n, 10)},
+		[]string{"PEXPIRE", k, ttl},
+	)
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+	s.put(conn)
+	return count[0], nil
+}
+
+// Add implements Store with a pipelined INCRBY and PEXPIREAT.
+func (s *RedisStore) Add(key string, n int64, expires, now time.Time) (int64, error) {
+	conn, err := s.get()
+	if err != nil {
+		return 0, err
+	}
+
+	k := s.config.Prefix + key
+	count, err := conn.pipeline(
+		[]string{"INCRBY", k, strconv.FormatInt(n, 10)},
+		[]string{"PEXPIREAT", k, strconv.FormatInt(expires.UnixMilli(), 10)},
+	)
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+	s.put(conn)
+	return count[0], nil
+}
+
+// Set implements Store with SET, expiring the key with PX.
+func (s *RedisStore) Set(key string, value []byte, expires, now time.Time) error {
+	args := []string{"SET", s.config.Prefix + key, string(value)}
+	if !expires.IsZero() {
+		args = append(args, "PX", strconv.FormatInt(max(expires.Sub(now).Milliseconds(), 1), 10))
+	}
+	_, err := s.do(args...)
+	return err
+}
+
+// Get implements Store with GET.
+func (s *RedisStore) Get(key string, now time.Time) ([]byte, error) {
+	return s.do("GET", s.config.Prefix+key)
+}
+
+// do sends a single command and returns its bulk reply, nil for the other
+// replies.
+func (s *RedisStore) do(args ...string) ([]byte, error) {
+	conn, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.send(args); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_, data, err := conn.readReply()
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		conn.Close()
+		return nil, err
+	}
+	s.put(conn)
+	return data, err
+}
+
+// Close closes the idle connections.
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case conn := <-s.pool:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (s *RedisStore) get() (*redisConn, error) {
+	select {
+	case conn := <-s.pool:
+		return conn, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", s.config.Addr, s.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc), timeout: s.config.Timeout}
+
+	var setup [][]string
+	if s.config.Password != "" {
+		setup = append(setup, []string{"AUTH", s.config.Password})
+	}
+	if s.config.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.config.DB)})
+	}
+	if len(setup) > 0 {
+		if _, err := conn.pipeline(setup...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (s *RedisStore) put(conn *redisConn) {
+	select {
+	case s.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// redisConn speaks just enough RESP for the store: it sends commands as
+// arrays of bulk strings and reads simple, error, integer and bulk replies.
+type redisConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// pipeline sends every command at once and returns the integer replies,
+// zero for the others.
+func (c *redisConn) pipeline(commands ...[]string) ([]int64, error) {
+	if err := c.send(commands...); err != nil {
+		return nil, err
+	}
+
+	replies := make([]int64, len(commands))
+	var firstErr error
+	for n := range commands {
+		v, _, err := c.readReply()
+		var redisErr redisError
+		if errors.As(err, &redisErr) {
+			// Keep reading so the connection stays in sync.
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		replies[n] = v
+	}
+	return replies, firstErr
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// send writes commands, setting the deadline of the exchange.
+func (c *redisConn) send(commands ...[]string) error {
+	if c.timeout > 0 {
+		c.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	var buf []byte
+	for _, args := range commands {
+		buf = fmt.Appendf(buf, "*%d\r\n", len(args))
+		for _, arg := range args {
+			buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	_, err := c.Write(buf)
+	return err
+}
+
+// readReply reads a reply: integers are returned as a number, bulk strings
+// as data, nil when absent.
+func (c *redisConn) readReply() (int64, []byte, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return 0, nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return 0, nil, nil
+	case '-':
+		return 0, nil, redisError(payload)
+	case ':':
+		n, err := strconv.ParseInt(payload, 10, 64)
+		return n, nil, err
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil || size < 0 {
+			return 0, nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return 0, nil, err
+		}
+		return 0, data[:size], nil
+	default:
+		return 0, nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
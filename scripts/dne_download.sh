@@ -15,8 +15,7 @@ fi
 COOKIE_FILE='cookies.txt'
 OUTPUT_FILE='eDNE_Basico.zip'
 
-rm -rf ./tmp_dne/
-rm -rf ./dne/
+rm -f "$OUTPUT_FILE"
 
 echo "Attempting download with curl..."
 curl -c "$COOKIE_FILE" -d "tx_codigo=$USERNAME&tx_senha=$PASSWORD" "$LOGIN_URL" && \
@@ -26,11 +25,5 @@ rm -f "$COOKIE_FILE"
 
 echo "Download completed: $OUTPUT_FILE"
 
-unzip -o "$OUTPUT_FILE" -d ./tmp_dne/
-
-unzip -o ./tmp_dne/eDNE_Basico.zip -d ./tmp_dne/
-unzip -o ./tmp_dne/eDNE_Basico*.zip -d ./tmp_dne/
-
-mv ./tmp_dne/Delimitado ./dne
-
-ls -lh ./tmp_dne/
+# The archive is imported as is: DB_RAW_PATH=./$OUTPUT_FILE MODE=seed ./wserver
+ls -lh "$OUTPUT_FILE"
@@ -0,0 +1,284 @@
+package zipcodes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"go.uber.org/zap"
+)
+
+// Types of change event.
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+const (
+	// changePrefix keys hold the change log: change:<cursor>.
+	changePrefix = "change:"
+	// changeSeqKey leases the cursors of new change events.
+	changeSeqKey = "meta:change_seq"
+)
+
+// ChangeEvent is an entry of the change log. Cursors grow with every event
+// but are not contiguous.
+type ChangeEvent struct {
+	Cursor  uint64       `json:"cursor"`
+	Type    string       `json:"type"`
+	CEP     string       `json:"cep"`
+	Old     *CEPCompleto `json:"old,omitempty"`
+	New     *CEPCompleto `json:"new,omitempty"`
+	Release string       `json:"release"`
+	At      time.Time    `json:"at"`
+}
+
+func changeKey(cursor uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", changePrefix, cursor))
+}
+
+// GetChanges returns up to limit events with a cursor greater than since,
+// oldest first, and whether more events follow.
+func GetChanges(db *badger.DB, since uint64, limit int) ([]ChangeEvent, bool, error) {
+	events := []ChangeEvent{}
+	more := false
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(changePrefix)
+		for it.Seek(changeKey(since + 1)); it.ValidForPrefix(prefix); it.Next() {
+			if len(events) == limit {
+				more = true
+				return nil
+			}
+			var event ChangeEvent
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &event)
+			}); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	return events, more, err
+}
+
+// tracksChanges reports whether imports compare records with the store.
+func (i *ZipCodeImporter) tracksChanges() bool {
+	return i.history || i.changeLog
+}
+
+// trackChange compares data, encoded as stored, with the current record of
+// cep and records a version and a change event when they differ. Imports
+// into an empty store skip the read: every record is new.
+func (i *ZipCodeImporter) trackChange(wb *badger.WriteBatch, cep string, data CEPCompleto, encoded []byte) error {
+	current, err := i.currentRecord(cep)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(current, encoded) {
+		return nil
+	}
+
+	var old *CEPCompleto
+	if current != nil {
+		old = &CEPCompleto{}
+		if err := json.Unmarshal(current, old); err != nil {
+			return err
+		}
+		if old.Cidade != "" && foldCity(old.Cidade) != foldCity(data.Cidade) {
+			if err := wb.Delete(cityIndexKey(old.Cidade, cep)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if i.history {
+		if old != nil {
+			if err := i.recordBaseline(wb, cep, old); err != nil {
+				return err
+			}
+		}
+		if err := i.recordVersion(wb, cep, &data); err != nil {
+			return err
+		}
+	}
+	if !i.changeLog {
+		return nil
+	}
+
+	event := ChangeEvent{Type: ChangeCreated, CEP: cep, New: &data}
+	if old != nil {
+		event.Type = ChangeUpdated
+		event.Old = old
+	}
+	return i.emitChange(wb, event)
+}
+
+// currentRecord returns the stored record of cep, or nil when it has none.
+func (i *ZipCodeImporter) currentRecord(cep string) ([]byte, error) {
+	if i.emptyStore {
+		return nil, nil
+	}
+	var current []byte
+	err := i.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("cep:" + cep))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		current, err = item.ValueCopy(nil)
+		return err
+	})
+	return current, err
+}
+
+func (i *ZipCodeImporter) emitChange(wb *badger.WriteBatch, event ChangeEvent) error {
+	cursor, err := i.changeSeq.Next()
+	if err != nil {
+		return err
+	}
+	// Sequences start at 0; cursor 0 is kept to mean "from the beginning".
+	event.Cursor = cursor + 1
+	event.Release = i.dataset.Source
+	event.At = time.Now()
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := wb.Set(changeKey(event.Cursor), data); err != nil {
+		return err
+	}
+
+	i.changeMu.Lock()
+	i.changes.add(&event)
+	i.changeMu.Unlock()
+	return nil
+}
+
+// retireUnseen deletes the CEPs of the store that are not in the release
+// just imported, recording their removal in the history and change log.
+func (i *ZipCodeImporter) retireUnseen() (int, error) {
+	stale := make(map[string][]byte)
+	err := i.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte("cep:")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			cep := strings.TrimPrefix(string(it.Item().Key()), "cep:")
+			if i.seenCEPs[cep].written {
+				continue
+			}
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			stale[cep] = val
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	wb := i.db.NewWriteBatch()
+	defer wb.Cancel()
+	for cep, val := range stale {
+		if err := wb.Delete([]byte("cep:" + cep)); err != nil {
+			return 0, err
+		}
+		old := &CEPCompleto{}
+		if err := json.Unmarshal(val, old); err != nil {
+			return 0, err
+		}
+		if old.Cidade != "" {
+			if err := wb.Delete(cityIndexKey(old.Cidade, cep)); err != nil {
+				return 0, err
+			}
+		}
+		if i.history {
+			if err := i.recordBaseline(wb, cep, old); err != nil {
+				return 0, err
+			}
+			if err := i.recordVersion(wb, cep, nil); err != nil {
+				return 0, err
+			}
+		}
+		if i.changeLog {
+			if err := i.emitChange(wb, ChangeEvent{Type: ChangeDeleted, CEP: cep, Old: old}); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return 0, err
+	}
+
+	if len(stale) > 0 {
+		i.logger.Info("Retired CEPs missing from the release", zap.Int("count", len(stale)))
+	}
+	return len(stale), nil
+}
+
+// pruneChanges drops the change events older than the retention. Cursors
+// grow with time, so it stops at the first event kept.
+func (i *ZipCodeImporter) pruneChanges() error {
+	if i.changeRetention <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-i.changeRetention)
+
+	var stale [][]byte
+	err := i.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(changePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var event ChangeEvent
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &event)
+			}); err != nil {
+				return err
+			}
+			if !event.At.Before(cutoff) {
+				return nil
+			}
+			stale = append(stale, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := deleteKeys(i.db, stale); err != nil {
+		return err
+	}
+
+	if len(stale) > 0 {
+		i.logger.Info("Pruned change events", zap.Int("count", len(stale)), zap.Time("before", cutoff))
+	}
+	return nil
+}
+
+// deleteKeys deletes keys from db in a single batch.
+func deleteKeys(db *badger.DB, keys [][]byte) error {
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
@@ -0,0 +1,103 @@
+package zipcodes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeLog(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+	importer.changeLog = true
+
+	for _, streets := range []string{
+		"001@SP@001@@@Paulista@@01310-100@Avenida@S@\n002@SP@001@@@Augusta@@01310-200@Rua@S@\n",
+		"001@SP@001@@@Paulista@lado par@01310-100@Avenida@S@\n003@SP@001@@@Consolacao@@01301-000@Rua@S@\n",
+	} {
+		dir := writeDNEDir(t, map[string]string{
+			"LOG_LOCALIDADE.TXT":    "001@SP@Sao Paulo@@1@M@@SP@3550308\n",
+			"LOG_BAIRRO.TXT":        "",
+			"LOG_LOGRADOURO_SP.TXT": streets,
+		})
+		_, err := importer.PopulateZipcodes(dir)
+		require.NoError(t, err)
+	}
+
+	events, more, err := GetChanges(importer.db, 0, 100)
+	require.NoError(t, err)
+	assert.False(t, more)
+	require.Len(t, events, 5)
+
+	byType := map[string][]ChangeEvent{}
+	for n, e := range events {
+		if n > 0 {
+			assert.Greater(t, e.Cursor, events[n-1].Cursor)
+		}
+		byType[e.Type] = append(byType[e.Type], e)
+	}
+	require.Len(t, byType[ChangeCreated], 3)
+	require.Len(t, byType[ChangeUpdated], 1)
+	require.Len(t, byType[ChangeDeleted], 1)
+
+	updated := byType[ChangeUpdated][0]
+	assert.Equal(t, "01310100", updated.CEP)
+	assert.Empty(t, updated.Old.Complemento)
+	assert.Equal(t, "lado par", updated.New.Complemento)
+
+	deleted := byType[ChangeDeleted][0]
+	assert.Equal(t, "01310200", deleted.CEP)
+	assert.Equal(t, "Rua Augusta", deleted.Old.Logradouro)
+	assert.Nil(t, deleted.New)
+
+	t.Run("pagination", func(t *testing.T) {
+		page, more, err := GetChanges(importer.db, 0, 2)
+		require.NoError(t, err)
+		assert.True(t, more)
+		require.Len(t, page, 2)
+
+		rest, more, err := GetChanges(importer.db, page[1].Cursor, 100)
+		require.NoError(t, err)
+		assert.False(t, more)
+		assert.Len(t, rest, 3)
+	})
+}
+
+func TestChangeLogRetention(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+	importer.changeLog = true
+
+	for _, streets := range []string{
+		"001@SP@001@@@Paulista@@01310-100@Avenida@S@\n",
+		"001@SP@001@@@Paulista@lado par@01310-100@Avenida@S@\n",
+	} {
+		dir := writeDNEDir(t, map[string]string{
+			"LOG_LOCALIDADE.TXT":    "001@SP@Sao Paulo@@1@M@@SP@3550308\n",
+			"LOG_BAIRRO.TXT":        "",
+			"LOG_LOGRADOURO_SP.TXT": streets,
+		})
+		_, err := importer.PopulateZipcodes(dir)
+		require.NoError(t, err)
+
+		// Age the events of the first import.
+		events, _, err := GetChanges(importer.db, 0, 100)
+		require.NoError(t, err)
+		for _, e := range events {
+			if e.Type == ChangeCreated {
+				e.At = e.At.AddDate(0, 0, -10)
+				require.NoError(t, putJSON(importer.db, string(changeKey(e.Cursor)), e))
+			}
+		}
+	}
+
+	importer.changeRetention = 7 * 24 * time.Hour
+	require.NoError(t, importer.pruneChanges())
+
+	events, _, err := GetChanges(importer.db, 0, 100)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, ChangeUpdated, events[0].Type)
+}
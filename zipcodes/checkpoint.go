@@ -0,0 +1,154 @@
+package zipcodes
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Dataset status values stored under datasetKey.
+const (
+	DatasetImporting = "importing"
+	DatasetComplete  = "complete"
+)
+
+const (
+	datasetKey       = "meta:dataset"
+	checkpointPrefix = "meta:checkpoint:"
+	// checkpointCEPsPrefix holds, per file and flush, the CEPs written by
+	// the batch, so a resumed import knows them without reading the file.
+	checkpointCEPsPrefix = "meta:checkpoint-ceps:"
+)
+
+// DatasetInfo describes the data currently in the store. While a seed is
+// running (or after it was interrupted) Status is DatasetImporting.
+type DatasetInfo struct {
+	Status      string    `json:"status"`
+	Source      string    `json:"source"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+}
+
+// Complete reports whether the last import finished.
+func (d *DatasetInfo) Complete() bool {
+	return d.Status == DatasetComplete
+}
+
+// Checkpoint is the progress of a single DNE file. Offset is the byte
+// position in the raw (ISO-8859-1) file after the last record that was
+// flushed to the store and Line the line it ended on; Report is the file
+// report at that point.
+type Checkpoint struct {
+	File      string      `json:"file"`
+	Offset    int64       `json:"offset"`
+	Line      int         `json:"line"`
+	Records   int         `json:"records"`
+	Done      bool        `json:"done"`
+	Report    *FileReport `json:"report,omitempty"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// GetDatasetInfo returns the dataset metadata, or nil when the store was
+// never seeded (or was seeded before metadata existed).
+func GetDatasetInfo(db *badger.DB) (*DatasetInfo, error) {
+	var info *DatasetInfo
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(datasetKey))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			info = &DatasetInfo{}
+			return json.Unmarshal(val, info)
+		})
+	})
+	return info, err
+}
+
+func setDatasetInfo(db *badger.DB, info *DatasetInfo) error {
+	return putJSON(db, datasetKey, info)
+}
+
+// loadCheckpoints returns the checkpoints of an interrupted import by file.
+func loadCheckpoints(db *badger.DB) (map[string]Checkpoint, error) {
+	checkpoints := make(map[string]Checkpoint)
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(checkpointPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var cp Checkpoint
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &cp)
+			}); err != nil {
+				return err
+			}
+			checkpoints[cp.File] = cp
+		}
+		return nil
+	})
+	return checkpoints, err
+}
+
+func saveCheckpoint(db *badger.DB, cp Checkpoint) error {
+	cp.UpdatedAt = time.Now()
+	return putJSON(db, checkpointPrefix+cp.File, cp)
+}
+
+func clearCheckpoints(db *badger.DB) error {
+	return db.DropPrefix([]byte(checkpointPrefix), []byte(checkpointCEPsPrefix))
+}
+
+// checkpointCEPsKey is the key of the CEPs written by the flush of file
+// that brought it to records processed records.
+func checkpointCEPsKey(file string, records int) []byte {
+	return []byte(fmt.Sprintf("%s%s:%010d", checkpointCEPsPrefix, file, records))
+}
+
+// loadCheckpointCEPs returns the CEPs written from file by the flushes up to
+// records processed records. Later flushes, whose checkpoint was not saved,
+// are left out as their records are imported again.
+func loadCheckpointCEPs(db *badger.DB, file string, records int) ([]string, error) {
+	var ceps []string
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(checkpointCEPsPrefix + file + ":")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			flushed, err := strconv.Atoi(strings.TrimPrefix(string(it.Item().Key()), string(prefix)))
+			if err != nil || flushed > records {
+				continue
+			}
+			if err := it.Item().Value(func(val []byte) error {
+				for len(val) >= 8 {
+					ceps = append(ceps, string(val[:8]))
+					val = val[8:]
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return ceps, err
+}
+
+func putJSON(db *badger.DB, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), data)
+	})
+}
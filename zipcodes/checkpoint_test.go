@@ -0,0 +1,157 @@
+package zipcodes
+
+import (
+	"encoding/json"
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPopulateZipcodesResume(t *testing.T) {
+	// The street names are ISO-8859-1, so raw and decoded offsets differ.
+	firstLine := "001@SP@001@001@001@Paulista@@01310-100@Avenida@S@Av Paulista\n"
+	secondLine := "002@SP@001@001@001@S\xe3o Bento@@01310-200@Rua@S@R S\xe3o Bento\n"
+	files := map[string]string{
+		"LOG_LOCALIDADE.TXT":    "001@SP@Sao Paulo@@1@M@@SP@3550308\n",
+		"LOG_BAIRRO.TXT":        "001@SP@001@Centro@Ctr\n",
+		"LOG_LOGRADOURO_SP.TXT": firstLine + secondLine + "003@SP@001@001@001@Direita@@bad@Rua@S@R Direita\n",
+	}
+	dir := writeDNEDir(t, files)
+
+	getStreet := func(t *testing.T, importer *ZipCodeImporter, cep string) string {
+		var retrieved CEPCompleto
+		err := importer.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte("cep:" + cep))
+			if err != nil {
+				return err
+			}
+			return item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &retrieved)
+			})
+		})
+		require.NoError(t, err)
+		return retrieved.Logradouro
+	}
+
+	// interrupt simulates an import that stored the first two streets and
+	// saved a checkpoint right after them.
+	interrupt := func(t *testing.T, importer *ZipCodeImporter, source string) {
+		wb := importer.db.NewWriteBatch()
+		for _, cep := range []string{"01310100", "01310200"} {
+			_, err := importer.storeCEP(wb, cep, CEPCompleto{CEP: cep, UF: "SP", TipoOrigem: "logradouro", Logradouro: "Stored before interruption"}, fileRank("LOG_LOGRADOURO_SP.TXT"))
+			require.NoError(t, err)
+		}
+		require.NoError(t, wb.Set(checkpointCEPsKey("LOG_LOGRADOURO_SP.TXT", 2), []byte("0131010001310200")))
+		require.NoError(t, wb.Flush())
+		importer.seenCEPs = make(map[string]cepClaim)
+		importer.counts = newStatsCounter()
+
+		require.NoError(t, setDatasetInfo(importer.db, &DatasetInfo{Status: DatasetImporting, Source: source}))
+		report := &FileReport{File: "LOG_LOGRADOURO_SP.TXT", Read: 2, Written: 2}
+		cp := Checkpoint{File: "LOG_LOGRADOURO_SP.TXT", Offset: int64(len(firstLine) + len(secondLine)), Line: 2, Records: 2, Report: report}
+		require.NoError(t, saveCheckpoint(importer.db, cp))
+	}
+
+	resumes := func(t *testing.T, source string) {
+		importer, cleanup := setupImporter(t)
+		defer cleanup()
+		importer.resume = true
+		interrupt(t, importer, source)
+
+		report, err := importer.PopulateZipcodes(source)
+		require.NoError(t, err)
+
+		assert.Equal(t, "Stored before interruption", getStreet(t, importer, "01310100"))
+		assert.Equal(t, "Stored before interruption", getStreet(t, importer, "01310200"))
+
+		// The report is restored from the checkpoint and the file is read
+		// from the next line on.
+		stats := report.file("LOG_LOGRADOURO_SP.TXT")
+		assert.Equal(t, 3, stats.Read)
+		assert.Equal(t, 2, stats.Written)
+		assert.Equal(t, 1, stats.InvalidCEP)
+		require.Len(t, stats.Samples[ReasonInvalidCEP], 1)
+		assert.Equal(t, 3, stats.Samples[ReasonInvalidCEP][0].Line)
+
+		// CEPs written before the interruption are counted as well.
+		counted, err := GetStats(importer.db)
+		require.NoError(t, err)
+		require.NotNil(t, counted)
+		assert.Equal(t, 2, counted.PorTipoOrigem["logradouro"])
+
+		info, err := GetDatasetInfo(importer.db)
+		require.NoError(t, err)
+		require.NotNil(t, info)
+		assert.True(t, info.Complete())
+		assert.False(t, info.CompletedAt.IsZero())
+
+		checkpoints, err := loadCheckpoints(importer.db)
+		require.NoError(t, err)
+		assert.Empty(t, checkpoints)
+		ceps, err := loadCheckpointCEPs(importer.db, "LOG_LOGRADOURO_SP.TXT", 2)
+		require.NoError(t, err)
+		assert.Empty(t, ceps)
+	}
+
+	t.Run("seeks to the checkpoint in a directory", func(t *testing.T) {
+		resumes(t, dir)
+	})
+
+	t.Run("skips to the checkpoint in a zip", func(t *testing.T) {
+		resumes(t, writeEDNEArchive(t, t.TempDir(), files))
+	})
+
+	t.Run("keeps CEPs written before the interruption when retiring", func(t *testing.T) {
+		importer, cleanup := setupImporter(t)
+		defer cleanup()
+		importer.resume = true
+		interrupt(t, importer, dir)
+		importer.changeLog = true
+
+		_, err := importer.PopulateZipcodes(dir)
+		require.NoError(t, err)
+
+		assert.Equal(t, "Stored before interruption", getStreet(t, importer, "01310100"))
+		assert.Equal(t, "Stored before interruption", getStreet(t, importer, "01310200"))
+	})
+
+	t.Run("imports again after a checkpoint without a report", func(t *testing.T) {
+		importer, cleanup := setupImporter(t)
+		defer cleanup()
+		importer.resume = true
+		interrupt(t, importer, dir)
+		require.NoError(t, saveCheckpoint(importer.db, Checkpoint{File: "LOG_LOGRADOURO_SP.TXT", Offset: int64(len(firstLine)), Records: 1}))
+
+		report, err := importer.PopulateZipcodes(dir)
+		require.NoError(t, err)
+
+		assert.Equal(t, "Avenida Paulista", getStreet(t, importer, "01310100"))
+		assert.Equal(t, "Rua São Bento", getStreet(t, importer, "01310200"))
+		assert.Equal(t, 2, report.file("LOG_LOGRADOURO_SP.TXT").Written)
+	})
+
+	t.Run("starts over when the source changed", func(t *testing.T) {
+		importer, cleanup := setupImporter(t)
+		defer cleanup()
+		importer.resume = true
+		interrupt(t, importer, "/some/other/eDNE_Basico.zip")
+
+		_, err := importer.PopulateZipcodes(dir)
+		require.NoError(t, err)
+
+		assert.Equal(t, "Avenida Paulista", getStreet(t, importer, "01310100"))
+	})
+
+	t.Run("starts over when resume is disabled", func(t *testing.T) {
+		importer, cleanup := setupImporter(t)
+		defer cleanup()
+		interrupt(t, importer, dir)
+
+		_, err := importer.PopulateZipcodes(dir)
+		require.NoError(t, err)
+
+		assert.Equal(t, "Avenida Paulista", getStreet(t, importer, "01310100"))
+	})
+}
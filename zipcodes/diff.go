@@ -0,0 +1,361 @@
+package zipcodes
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/brasilcep/api/logger"
+	badger "github.com/dgraph-io/badger/v4"
+	"go.uber.org/zap"
+)
+
+// Kinds of change reported by Diff.
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// Diff output formats.
+const (
+	DiffFormatJSON = "json"
+	DiffFormatCSV  = "csv"
+)
+
+// FieldChange is a single field of a modified CEP.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// CEPChange is a CEP that differs between two datasets. Fields is only set
+// for modified CEPs.
+type CEPChange struct {
+	CEP        string        `json:"cep"`
+	Change     string        `json:"change"`
+	UF         string        `json:"uf"`
+	TipoOrigem string        `json:"tipo_origem"`
+	Old        *CEPCompleto  `json:"old,omitempty"`
+	New        *CEPCompleto  `json:"new,omitempty"`
+	Fields     []FieldChange `json:"fields,omitempty"`
+}
+
+// DiffCounts counts the changes of a group.
+type DiffCounts struct {
+	Added    int `json:"added"`
+	Removed  int `json:"removed"`
+	Modified int `json:"modified"`
+}
+
+func (c *DiffCounts) add(change string) {
+	switch change {
+	case ChangeAdded:
+		c.Added++
+	case ChangeRemoved:
+		c.Removed++
+	case ChangeModified:
+		c.Modified++
+	}
+}
+
+// DiffGroup holds the changes of one UF and TipoOrigem.
+type DiffGroup struct {
+	UF         string `json:"uf"`
+	TipoOrigem string `json:"tipo_origem"`
+	DiffCounts
+	Changes []CEPChange `json:"changes"`
+}
+
+// DiffReport is the outcome of Diff. The releases themselves stay on disk,
+// but every change is kept in memory, which is fine between DNE releases
+// but not between unrelated datasets.
+type DiffReport struct {
+	Old        string       `json:"old"`
+	New        string       `json:"new"`
+	Unchanged  int          `json:"unchanged"`
+	Totals     DiffCounts   `json:"totals"`
+	Groups     []*DiffGroup `json:"groups"`
+	DurationMS int64        `json:"duration_ms"`
+
+	groups map[[2]string]*DiffGroup
+}
+
+// diffFields are the CEPCompleto fields compared by Diff, named after their
+// JSON keys.
+var diffFields = []column[CEPCompleto]{
+	{"logradouro", func(c *CEPCompleto) string { return c.Logradouro }},
+	{"complemento", func(c *CEPCompleto) string { return c.Complemento }},
+	{"bairro", func(c *CEPCompleto) string { return c.Bairro }},
+	{"cidade", func(c *CEPCompleto) string { return c.Cidade }},
+	{"uf", func(c *CEPCompleto) string { return c.UF }},
+	{"codigo_ibge", func(c *CEPCompleto) string { return c.CodigoIBGE }},
+	{"tipo_logradouro", func(c *CEPCompleto) string { return c.TipoLogradouro }},
+	{"tipo_origem", func(c *CEPCompleto) string { return c.TipoOrigem }},
+	{"nome_origem", func(c *CEPCompleto) string { return c.NomeOrigem }},
+}
+
+// Diff compares two DNE releases. Each path is imported into a scratch
+// store in a temporary directory under diff.scratch.path, removed once the
+// comparison is done; an empty oldPath compares newPath against the
+// importer's own store instead.
+func (i *ZipCodeImporter) Diff(oldPath, newPath string) (*DiffReport, error) {
+	if newPath == "" {
+		return nil, errors.New("DNE path to compare is empty")
+	}
+
+	start := time.Now()
+	report := &DiffReport{Old: oldPath, New: newPath, groups: make(map[[2]string]*DiffGroup)}
+
+	oldDB := i.db
+	if oldPath == "" {
+		if oldDB == nil {
+			return nil, errors.New("BadgerDB not initialized (database.GetDB() returned nil)")
+		}
+		report.Old = "store"
+	} else {
+		scratch, remove, err := i.scratchImport(oldPath)
+		if err != nil {
+			return nil, fmt.Errorf("importing %s: %w", oldPath, err)
+		}
+		defer remove()
+		oldDB = scratch
+	}
+
+	newDB, remove, err := i.scratchImport(newPath)
+	if err != nil {
+		return nil, fmt.Errorf("importing %s: %w", newPath, err)
+	}
+	defer remove()
+
+	i.logger.Info("Comparing datasets", zap.String("old", report.Old), zap.String("new", newPath))
+	if err := compareStores(oldDB, newDB, report.add); err != nil {
+		return nil, err
+	}
+
+	report.finish()
+	report.DurationMS = time.Since(start).Milliseconds()
+	return report, nil
+}
+
+// scratchImport imports dnePath into a new store in a temporary directory.
+// The returned func closes the store and removes the directory.
+func (i *ZipCodeImporter) scratchImport(dnePath string) (*badger.DB, func(), error) {
+	dir, err := os.MkdirTemp(i.scratchPath, "brasilcep-diff-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	scratch, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	remove := func() {
+		scratch.Close()
+		os.RemoveAll(dir)
+	}
+
+	importer := &ZipCodeImporter{
+		db:         scratch,
+		logger:     i.logger,
+		workers:    i.workers,
+		thresholds: Thresholds{MaxRejectedRatio: -1, MaxOrphanedRatio: -1},
+	}
+	if _, err := importer.PopulateZipcodes(dnePath); err != nil {
+		remove()
+		return nil, nil, err
+	}
+	return scratch, remove, nil
+}
+
+// compareStores walks the CEPs of both stores in key order and calls fn for
+// every CEP that was added, removed or modified; nil fn arguments mean
+// unchanged.
+func compareStores(oldDB, newDB *badger.DB, fn func(change *CEPChange)) error {
+	oldTxn := oldDB.NewTransaction(false)
+	defer oldTxn.Discard()
+	newTxn := newDB.NewTransaction(false)
+	defer newTxn.Discard()
+
+	prefix := []byte("cep:")
+	oldIt := oldTxn.NewIterator(badger.DefaultIteratorOptions)
+	defer oldIt.Close()
+	newIt := newTxn.NewIterator(badger.DefaultIteratorOptions)
+	defer newIt.Close()
+
+	oldIt.Seek(prefix)
+	newIt.Seek(prefix)
+	for {
+		oldValid, newValid := oldIt.ValidForPrefix(prefix), newIt.ValidForPrefix(prefix)
+		if !oldValid && !newValid {
+			return nil
+		}
+
+		cmp := 0
+		switch {
+		case !oldValid:
+			cmp = 1
+		case !newValid:
+			cmp = -1
+		default:
+			cmp = bytes.Compare(oldIt.Item().Key(), newIt.Item().Key())
+		}
+
+		switch {
+		case cmp < 0:
+			old, err := decodeCEP(oldIt.Item())
+			if err != nil {
+				return err
+			}
+			fn(&CEPChange{CEP: old.CEP, Change: ChangeRemoved, Old: old})
+			oldIt.Next()
+		case cmp > 0:
+			cur, err := decodeCEP(newIt.Item())
+			if err != nil {
+				return err
+			}
+			fn(&CEPChange{CEP: cur.CEP, Change: ChangeAdded, New: cur})
+			newIt.Next()
+		default:
+			old, err := decodeCEP(oldIt.Item())
+			if err != nil {
+				return err
+			}
+			cur, err := decodeCEP(newIt.Item())
+			if err != nil {
+				return err
+			}
+			if fields := compareCEPs(old, cur); len(fields) > 0 {
+				fn(&CEPChange{CEP: cur.CEP, Change: ChangeModified, Old: old, New: cur, Fields: fields})
+			} else {
+				fn(nil)
+			}
+			oldIt.Next()
+			newIt.Next()
+		}
+	}
+}
+
+func decodeCEP(item *badger.Item) (*CEPCompleto, error) {
+	var c CEPCompleto
+	err := item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &c)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", item.Key(), err)
+	}
+	return &c, nil
+}
+
+func compareCEPs(old, cur *CEPCompleto) []FieldChange {
+	var fields []FieldChange
+	for _, f := range diffFields {
+		if o, n := f.get(old), f.get(cur); o != n {
+			fields = append(fields, FieldChange{Field: f.name, Old: o, New: n})
+		}
+	}
+	return fields
+}
+
+func (r *DiffReport) add(change *CEPChange) {
+	if change == nil {
+		r.Unchanged++
+		return
+	}
+
+	// Group by the current record, or the old one for removed CEPs.
+	rec := change.New
+	if rec == nil {
+		rec = change.Old
+	}
+	change.UF = rec.UF
+	change.TipoOrigem = rec.TipoOrigem
+
+	key := [2]string{rec.UF, rec.TipoOrigem}
+	group, ok := r.groups[key]
+	if !ok {
+		group = &DiffGroup{UF: rec.UF, TipoOrigem: rec.TipoOrigem}
+		r.groups[key] = group
+		r.Groups = append(r.Groups, group)
+	}
+	group.add(change.Change)
+	group.Changes = append(group.Changes, *change)
+	r.Totals.add(change.Change)
+}
+
+func (r *DiffReport) finish() {
+	sort.Slice(r.Groups, func(a, b int) bool {
+		if r.Groups[a].UF != r.Groups[b].UF {
+			return r.Groups[a].UF < r.Groups[b].UF
+		}
+		return r.Groups[a].TipoOrigem < r.Groups[b].TipoOrigem
+	})
+}
+
+// Write encodes the report as JSON or CSV. The CSV has one row per changed
+// field, and a single row without field for added and removed CEPs.
+func (r *DiffReport) Write(w io.Writer, format string) error {
+	switch format {
+	case DiffFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case DiffFormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"uf", "tipo_origem", "cep", "change", "field", "old", "new"})
+		for _, g := range r.Groups {
+			for _, c := range g.Changes {
+				if c.Change != ChangeModified {
+					cw.Write([]string{g.UF, g.TipoOrigem, c.CEP, c.Change, "", "", ""})
+					continue
+				}
+				for _, f := range c.Fields {
+					cw.Write([]string{g.UF, g.TipoOrigem, c.CEP, c.Change, f.Field, f.Old, f.New})
+				}
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unknown diff format %q", format)
+	}
+}
+
+// WriteFile writes the report to path, or to stdout when path is "-".
+func (r *DiffReport) WriteFile(path, format string) error {
+	if path == "-" {
+		return r.Write(os.Stdout, format)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := r.Write(f, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Log writes the totals and one line per UF and TipoOrigem.
+func (r *DiffReport) Log(logger *logger.Logger) {
+	for _, g := range r.Groups {
+		logger.Info("Diff", zap.String("uf", g.UF), zap.String("tipo_origem", g.TipoOrigem), zap.Int("added", g.Added), zap.Int("removed", g.Removed), zap.Int("modified", g.Modified))
+	}
+	logger.Info("Diff completed",
+		zap.String("old", r.Old),
+		zap.String("new", r.New),
+		zap.Int("added", r.Totals.Added),
+		zap.Int("removed", r.Totals.Removed),
+		zap.Int("modified", r.Totals.Modified),
+		zap.Int("unchanged", r.Unchanged),
+		zap.Int64("duration_ms", r.DurationMS),
+	)
+}
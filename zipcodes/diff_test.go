@@ -0,0 +1,87 @@
+package zipcodes
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func findDiffGroup(report *DiffReport, uf, tipoOrigem string) *DiffGroup {
+	for _, g := range report.Groups {
+		if g.UF == uf && g.TipoOrigem == tipoOrigem {
+			return g
+		}
+	}
+	return nil
+}
+
+func TestDiff(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+
+	localitiesFile := "001@SP@Sao Paulo@@1@M@@SP@3550308\n002@RJ@Rio de Janeiro@@1@M@@RJ@3304557\n"
+	oldDir := writeDNEDir(t, map[string]string{
+		"LOG_LOCALIDADE.TXT":    localitiesFile,
+		"LOG_BAIRRO.TXT":        "001@SP@001@Centro@Ctr\n",
+		"LOG_LOGRADOURO_SP.TXT": "001@SP@001@001@001@Paulista@@01310-100@Avenida@S@\n002@SP@001@001@001@Augusta@@01310-200@Rua@S@\n",
+		"LOG_LOGRADOURO_RJ.TXT": "003@RJ@002@@@Atlantica@@22010-000@Avenida@S@\n",
+	})
+	newDir := writeDNEDir(t, map[string]string{
+		"LOG_LOCALIDADE.TXT":    localitiesFile,
+		"LOG_BAIRRO.TXT":        "001@SP@001@Centro@Ctr\n",
+		"LOG_LOGRADOURO_SP.TXT": "001@SP@001@001@001@Paulista@lado par@01310-100@Avenida@S@\n002@SP@001@001@001@Augusta@@01310-200@Rua@S@\n004@SP@001@001@001@Consolacao@@01301-000@Rua@S@\n",
+		"LOG_CPC.TXT":           "001@RJ@002@CPC Copacabana@Rua B 2@22011-001\n",
+	})
+
+	t.Run("two releases", func(t *testing.T) {
+		report, err := importer.Diff(oldDir, newDir)
+		require.NoError(t, err)
+
+		assert.Equal(t, DiffCounts{Added: 2, Removed: 1, Modified: 1}, report.Totals)
+		assert.Equal(t, 1, report.Unchanged)
+		require.Len(t, report.Groups, 3)
+
+		rj := findDiffGroup(report, "RJ", "logradouro")
+		require.NotNil(t, rj)
+		assert.Equal(t, 1, rj.Removed)
+		assert.Equal(t, "22010000", rj.Changes[0].CEP)
+
+		cpc := findDiffGroup(report, "RJ", "cpc")
+		require.NotNil(t, cpc)
+		assert.Equal(t, 1, cpc.Added)
+
+		sp := findDiffGroup(report, "SP", "logradouro")
+		require.NotNil(t, sp)
+		assert.Equal(t, DiffCounts{Added: 1, Modified: 1}, sp.DiffCounts)
+		for _, c := range sp.Changes {
+			if c.Change == ChangeModified {
+				assert.Equal(t, "01310100", c.CEP)
+				assert.Equal(t, []FieldChange{{Field: "complemento", Old: "", New: "lado par"}}, c.Fields)
+			}
+		}
+
+		var buf bytes.Buffer
+		require.NoError(t, report.Write(&buf, DiffFormatCSV))
+		rows, err := csv.NewReader(&buf).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, rows, 5)
+		assert.Equal(t, []string{"RJ", "cpc", "22011001", "added", "", "", ""}, rows[1])
+
+		assert.Error(t, report.Write(&buf, "xml"))
+	})
+
+	t.Run("against the store", func(t *testing.T) {
+		_, err := importer.PopulateZipcodes(oldDir)
+		require.NoError(t, err)
+
+		report, err := importer.Diff("", oldDir)
+		require.NoError(t, err)
+		assert.Equal(t, "store", report.Old)
+		assert.Equal(t, DiffCounts{}, report.Totals)
+		assert.Equal(t, 3, report.Unchanged)
+		assert.Empty(t, report.Groups)
+	})
+}
@@ -0,0 +1,223 @@
+package zipcodes
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Export formats.
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+	ExportSQL    = "sql"
+)
+
+// Datasets that can be exported.
+const (
+	DatasetCEPs       = "ceps"
+	DatasetLocalities = "localidades"
+	DatasetDistricts  = "bairros"
+)
+
+// ExportOptions selects what Export writes. Prefix, TipoOrigem and After
+// only apply to CEPs; an empty filter matches everything.
+type ExportOptions struct {
+	Dataset    string
+	Format     string
+	UFs        []string
+	Prefix     string
+	TipoOrigem string
+	// After resumes an export: only CEPs sorting after it are written.
+	After string
+}
+
+type column[T any] struct {
+	name string
+	get  func(*T) string
+}
+
+var cepColumns = append([]column[CEPCompleto]{
+	{"cep", func(c *CEPCompleto) string { return c.CEP }},
+}, diffFields...)
+
+var localityColumns = []column[Localidade]{
+	{"codigo", func(l *Localidade) string { return l.Codigo }},
+	{"uf", func(l *Localidade) string { return l.UF }},
+	{"nome", func(l *Localidade) string { return l.Nome }},
+	{"cep", func(l *Localidade) string { return l.CEP }},
+	{"situacao", func(l *Localidade) string { return l.Situacao }},
+	{"tipo_localidade", func(l *Localidade) string { return l.TipoLocalidade }},
+	{"codigo_sub", func(l *Localidade) string { return l.CodigoSub }},
+	{"nome_abreviado", func(l *Localidade) string { return l.NomeAbreviado }},
+	{"codigo_ibge", func(l *Localidade) string { return l.CodigoIBGE }},
+}
+
+var districtColumns = []column[Bairro]{
+	{"codigo", func(b *Bairro) string { return b.Codigo }},
+	{"uf", func(b *Bairro) string { return b.UF }},
+	{"codigo_localidade", func(b *Bairro) string { return b.CodigoLocalidade }},
+	{"nome", func(b *Bairro) string { return b.Nome }},
+	{"nome_abreviado", func(b *Bairro) string { return b.NomeAbreviado }},
+}
+
+// Export streams a dataset of db to w, one record at a time, and returns how
+// many records were written. It stops with the error of ctx once ctx is
+// done.
+func Export(ctx context.Context, db *badger.DB, w io.Writer, opts ExportOptions) (int, error) {
+	ufs := make([]string, 0, len(opts.UFs))
+	for _, uf := range opts.UFs {
+		ufs = append(ufs, strings.ToUpper(strings.TrimSpace(uf)))
+	}
+	matchUF := func(uf string) bool {
+		return len(ufs) == 0 || slices.Contains(ufs, uf)
+	}
+
+	switch opts.Dataset {
+	case DatasetCEPs, "":
+		seek := "cep:" + opts.Prefix
+		if after := "cep:" + opts.After + "\x00"; opts.After != "" && after > seek {
+			seek = after
+		}
+		return exportTable(ctx, db, w, opts.Format, "ceps", "cep:"+opts.Prefix, seek, cepColumns, func(c *CEPCompleto) bool {
+			return matchUF(c.UF) && (opts.TipoOrigem == "" || c.TipoOrigem == opts.TipoOrigem)
+		})
+	case DatasetLocalities:
+		return exportTable(ctx, db, w, opts.Format, "localidades", localityPrefix, localityPrefix, localityColumns, func(l *Localidade) bool {
+			return matchUF(l.UF)
+		})
+	case DatasetDistricts:
+		return exportTable(ctx, db, w, opts.Format, "bairros", districtPrefix, districtPrefix, districtColumns, func(b *Bairro) bool {
+			return matchUF(b.UF)
+		})
+	default:
+		return 0, fmt.Errorf("unknown dataset %q", opts.Dataset)
+	}
+}
+
+// exportTable writes the records under prefix, starting at the key seek.
+func exportTable[T any](ctx context.Context, db *badger.DB, w io.Writer, format, table, prefix, seek string, columns []column[T], match func(*T) bool) (int, error) {
+	out, err := newRowWriter(w, format, table, columns)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek([]byte(seek)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			err := it.Item().Value(func(val []byte) error {
+				var record T
+				if err := json.Unmarshal(val, &record); err != nil {
+					return fmt.Errorf("decoding %s: %w", it.Item().Key(), err)
+				}
+				if !match(&record) {
+					return nil
+				}
+				count++
+				return out.write(&record, val)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, out.close()
+}
+
+// rowWriter encodes records in one of the export formats.
+type rowWriter[T any] struct {
+	format  string
+	table   string
+	columns []column[T]
+	buf     *bufio.Writer
+	csv     *csv.Writer
+}
+
+func newRowWriter[T any](w io.Writer, format, table string, columns []column[T]) (*rowWriter[T], error) {
+	out := &rowWriter[T]{format: format, table: table, columns: columns, buf: bufio.NewWriter(w)}
+
+	names := make([]string, len(columns))
+	for n, c := range columns {
+		names[n] = c.name
+	}
+
+	switch format {
+	case ExportCSV:
+		out.csv = csv.NewWriter(out.buf)
+		return out, out.csv.Write(names)
+	case ExportNDJSON:
+		return out, nil
+	case ExportSQL:
+		defs := make([]string, len(names))
+		for n, name := range names {
+			defs[n] = "  " + name + " TEXT"
+		}
+		_, err := fmt.Fprintf(out.buf, "CREATE TABLE IF NOT EXISTS %s (\n%s,\n  PRIMARY KEY (%s)\n);\nBEGIN;\n", table, strings.Join(defs, ",\n"), names[0])
+		return out, err
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// write encodes record; raw is its JSON as stored, reused for NDJSON.
+func (o *rowWriter[T]) write(record *T, raw []byte) error {
+	switch o.format {
+	case ExportCSV:
+		values := make([]string, len(o.columns))
+		for n, c := range o.columns {
+			values[n] = c.get(record)
+		}
+		return o.csv.Write(values)
+	case ExportNDJSON:
+		if _, err := o.buf.Write(raw); err != nil {
+			return err
+		}
+		return o.buf.WriteByte('\n')
+	default:
+		names := make([]string, len(o.columns))
+		values := make([]string, len(o.columns))
+		for n, c := range o.columns {
+			names[n] = c.name
+			values[n] = sqlString(c.get(record))
+		}
+		_, err := fmt.Fprintf(o.buf, "INSERT INTO %s (%s) VALUES (%s);\n", o.table, strings.Join(names, ", "), strings.Join(values, ", "))
+		return err
+	}
+}
+
+func (o *rowWriter[T]) close() error {
+	switch o.format {
+	case ExportCSV:
+		o.csv.Flush()
+		if err := o.csv.Error(); err != nil {
+			return err
+		}
+	case ExportSQL:
+		if _, err := o.buf.WriteString("COMMIT;\n"); err != nil {
+			return err
+		}
+	}
+	return o.buf.Flush()
+}
+
+// sqlString quotes s as a standard SQL string literal.
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
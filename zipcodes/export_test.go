@@ -0,0 +1,116 @@
+package zipcodes
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExport(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+
+	dir := writeDNEDir(t, map[string]string{
+		"LOG_LOCALIDADE.TXT":    "001@SP@Sao Paulo@@1@M@@SP@3550308\n002@RJ@Rio de Janeiro@@1@M@@RJ@3304557\n",
+		"LOG_BAIRRO.TXT":        "001@SP@001@Centro@Ctr\n002@RJ@002@Copacabana@Copa\n",
+		"LOG_LOGRADOURO_SP.TXT": "001@SP@001@001@001@Paulista@@01310-100@Avenida@S@\n002@SP@001@001@001@D'Ouro@@01310-200@Rua@S@\n",
+		"LOG_LOGRADOURO_RJ.TXT": "003@RJ@002@002@002@Atlantica@@22010-000@Avenida@S@\n",
+		"LOG_CPC.TXT":           "001@SP@001@CPC Centro@Rua A 1@01000-001\n",
+	})
+	_, err := importer.PopulateZipcodes(dir)
+	require.NoError(t, err)
+
+	t.Run("csv filtered by UF and source type", func(t *testing.T) {
+		var buf bytes.Buffer
+		count, err := Export(context.Background(), importer.db, &buf, ExportOptions{Format: ExportCSV, UFs: []string{"sp"}, TipoOrigem: "logradouro"})
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+
+		rows, err := csv.NewReader(&buf).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, rows, 3)
+		assert.Equal(t, "cep", rows[0][0])
+		assert.Equal(t, "01310100", rows[1][0])
+		assert.Equal(t, "Avenida Paulista", rows[1][1])
+	})
+
+	t.Run("ndjson by prefix", func(t *testing.T) {
+		var buf bytes.Buffer
+		count, err := Export(context.Background(), importer.db, &buf, ExportOptions{Dataset: DatasetCEPs, Format: ExportNDJSON, Prefix: "220"})
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+
+		var c CEPCompleto
+		require.NoError(t, json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &c))
+		assert.Equal(t, "Rio de Janeiro", c.Cidade)
+	})
+
+	t.Run("resume after cursor", func(t *testing.T) {
+		var buf bytes.Buffer
+		count, err := Export(context.Background(), importer.db, &buf, ExportOptions{Format: ExportCSV, Prefix: "013", After: "01310100"})
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+		assert.Contains(t, buf.String(), "01310200")
+		assert.NotContains(t, buf.String(), "01310100")
+
+		buf.Reset()
+		count, err = Export(context.Background(), importer.db, &buf, ExportOptions{Format: ExportCSV, After: "0"})
+		require.NoError(t, err)
+		assert.Equal(t, 4, count)
+	})
+
+	t.Run("sql escapes quotes", func(t *testing.T) {
+		var buf bytes.Buffer
+		count, err := Export(context.Background(), importer.db, &buf, ExportOptions{Format: ExportSQL, Prefix: "01310200"})
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+
+		out := buf.String()
+		assert.True(t, strings.HasPrefix(out, "CREATE TABLE IF NOT EXISTS ceps ("))
+		assert.Contains(t, out, "VALUES ('01310200', 'Rua D''Ouro'")
+		assert.True(t, strings.HasSuffix(out, "COMMIT;\n"))
+	})
+
+	t.Run("localities and districts", func(t *testing.T) {
+		var buf bytes.Buffer
+		count, err := Export(context.Background(), importer.db, &buf, ExportOptions{Dataset: DatasetLocalities, Format: ExportCSV})
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+		assert.Contains(t, buf.String(), "001,SP,Sao Paulo,,1,M,,SP,3550308")
+
+		buf.Reset()
+		count, err = Export(context.Background(), importer.db, &buf, ExportOptions{Dataset: DatasetDistricts, Format: ExportNDJSON, UFs: []string{"RJ"}})
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+		assert.JSONEq(t, `{"codigo":"002","uf":"RJ","codigo_localidade":"002","nome":"Copacabana","nome_abreviado":"Copa"}`, buf.String())
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		_, err := Export(context.Background(), importer.db, &bytes.Buffer{}, ExportOptions{Format: "xml"})
+		assert.Error(t, err)
+		_, err = Export(context.Background(), importer.db, &bytes.Buffer{}, ExportOptions{Dataset: "ruas", Format: ExportCSV})
+		assert.Error(t, err)
+	})
+}
+
+func TestExportCancelled(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+
+	wb := importer.db.NewWriteBatch()
+	require.NoError(t, importer.writeCEPIfNew(wb, "01310100", CEPCompleto{CEP: "01310100", UF: "SP"}))
+	require.NoError(t, wb.Flush())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var buf bytes.Buffer
+	count, err := Export(ctx, importer.db, &buf, ExportOptions{Format: ExportNDJSON})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Zero(t, count)
+}
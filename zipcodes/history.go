@@ -0,0 +1,167 @@
+package zipcodes
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"go.uber.org/zap"
+)
+
+// historyPrefix keys hold one CEPVersion per CEP and import that changed it:
+// hist:<cep>:<valid from, unix nanoseconds>.
+const historyPrefix = "hist:"
+
+// ReleaseDateLayout is the format of seed.release_date and of as-of queries.
+const ReleaseDateLayout = "2006-01-02"
+
+// CEPVersion is the data of a CEP from ValidFrom until the next version.
+// Removed versions mark the release that retired the CEP.
+type CEPVersion struct {
+	ValidFrom time.Time    `json:"valido_de"`
+	ValidTo   *time.Time   `json:"valido_ate,omitempty"`
+	Release   string       `json:"release"`
+	Removed   bool         `json:"removido,omitempty"`
+	Data      *CEPCompleto `json:"endereco,omitempty"`
+}
+
+func historyKey(cep string, validFrom time.Time) []byte {
+	return []byte(fmt.Sprintf("%s%s:%020d", historyPrefix, cep, validFrom.UnixNano()))
+}
+
+// GetHistory returns every version of cep, oldest first, with ValidTo set
+// from the following version.
+func GetHistory(db *badger.DB, cep string) ([]CEPVersion, error) {
+	var versions []CEPVersion
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(historyPrefix + cep + ":")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var v CEPVersion
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &v)
+			}); err != nil {
+				return err
+			}
+			versions = append(versions, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for n := 0; n < len(versions)-1; n++ {
+		validTo := versions[n+1].ValidFrom
+		versions[n].ValidTo = &validTo
+	}
+	return versions, nil
+}
+
+// GetCEPAt returns the version of cep valid at the given time, or nil when
+// the CEP did not exist (or was retired) then. ok is false when cep has no
+// history at all, e.g. because it was imported before versions were kept.
+func GetCEPAt(db *badger.DB, cep string, at time.Time) (version *CEPVersion, ok bool, err error) {
+	versions, err := GetHistory(db, cep)
+	if err != nil || len(versions) == 0 {
+		return nil, false, err
+	}
+
+	for n := len(versions) - 1; n >= 0; n-- {
+		if !versions[n].ValidFrom.After(at) {
+			if versions[n].Removed {
+				return nil, true, nil
+			}
+			return &versions[n], true, nil
+		}
+	}
+	return nil, true, nil
+}
+
+// recordVersion adds a version of cep to the history, valid from the
+// release being imported. A nil data marks the CEP as removed.
+func (i *ZipCodeImporter) recordVersion(wb *badger.WriteBatch, cep string, data *CEPCompleto) error {
+	version, err := json.Marshal(CEPVersion{ValidFrom: i.validFrom, Release: i.dataset.Source, Removed: data == nil, Data: data})
+	if err != nil {
+		return err
+	}
+	return wb.Set(historyKey(cep, i.validFrom), version)
+}
+
+// recordBaseline adds the stored record of cep to the history before the
+// import changes it, when cep has no versions yet. Otherwise enabling the
+// history on a populated store would lose the data the first import
+// replaces.
+func (i *ZipCodeImporter) recordBaseline(wb *badger.WriteBatch, cep string, current *CEPCompleto) error {
+	found := false
+	err := i.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(historyPrefix + cep + ":")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		found = it.Valid()
+		return nil
+	})
+	if err != nil || found {
+		return err
+	}
+
+	baseline := i.baseline
+	baseline.Data = current
+	version, err := json.Marshal(baseline)
+	if err != nil {
+		return err
+	}
+	return wb.Set(historyKey(cep, baseline.ValidFrom), version)
+}
+
+// pruneHistory drops the versions replaced by another one before the
+// retention, keeping the version that was valid at the cutoff. Versions are
+// ordered by the key, so only keys are read.
+func (i *ZipCodeImporter) pruneHistory() error {
+	if i.historyRetention <= 0 {
+		return nil
+	}
+	cutoff := fmt.Sprintf("%020d", time.Now().Add(-i.historyRetention).UnixNano())
+
+	var stale [][]byte
+	err := i.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(historyPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		var prevCEP string
+		var prevKey []byte
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			cep, validFrom, ok := strings.Cut(strings.TrimPrefix(string(key), historyPrefix), ":")
+			if !ok {
+				continue
+			}
+			if cep == prevCEP && validFrom <= cutoff {
+				stale = append(stale, prevKey)
+			}
+			prevCEP, prevKey = cep, key
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := deleteKeys(i.db, stale); err != nil {
+		return err
+	}
+
+	if len(stale) > 0 {
+		i.logger.Info("Pruned CEP versions", zap.Int("count", len(stale)))
+	}
+	return nil
+}
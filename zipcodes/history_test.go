@@ -0,0 +1,183 @@
+package zipcodes
+
+import (
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+	importer.history = true
+
+	localitiesFile := "001@SP@Sao Paulo@@1@M@@SP@3550308\n"
+	releases := []struct {
+		date    string
+		streets string
+	}{
+		{"2024-01-01", "001@SP@001@@@Paulista@@01310-100@Avenida@S@\n002@SP@001@@@Augusta@@01310-200@Rua@S@\n"},
+		{"2024-06-01", "001@SP@001@@@Paulista@@01310-100@Avenida@S@\n002@SP@001@@@Augusta@@01310-200@Rua@S@\n"},
+		{"2025-01-01", "001@SP@001@@@Paulista@lado par@01310-100@Avenida@S@\n003@SP@001@@@Consolacao@@01301-000@Rua@S@\n"},
+	}
+	for _, r := range releases {
+		dir := writeDNEDir(t, map[string]string{
+			"LOG_LOCALIDADE.TXT":    localitiesFile,
+			"LOG_BAIRRO.TXT":        "",
+			"LOG_LOGRADOURO_SP.TXT": r.streets,
+		})
+		importer.releaseDate = r.date
+		_, err := importer.PopulateZipcodes(dir)
+		require.NoError(t, err)
+	}
+
+	date := func(s string) time.Time {
+		d, err := time.Parse(ReleaseDateLayout, s)
+		require.NoError(t, err)
+		return d
+	}
+
+	t.Run("modified CEP", func(t *testing.T) {
+		versions, err := GetHistory(importer.db, "01310100")
+		require.NoError(t, err)
+		require.Len(t, versions, 2, "unchanged releases add no version")
+		assert.Equal(t, date("2024-01-01"), versions[0].ValidFrom.UTC())
+		require.NotNil(t, versions[0].ValidTo)
+		assert.Equal(t, date("2025-01-01"), versions[0].ValidTo.UTC())
+		assert.Nil(t, versions[1].ValidTo)
+		assert.Equal(t, "lado par", versions[1].Data.Complemento)
+
+		v, ok, err := GetCEPAt(importer.db, "01310100", date("2024-12-31"))
+		require.NoError(t, err)
+		assert.True(t, ok)
+		require.NotNil(t, v)
+		assert.Empty(t, v.Data.Complemento)
+
+		v, _, err = GetCEPAt(importer.db, "01310100", date("2023-12-31"))
+		require.NoError(t, err)
+		assert.Nil(t, v)
+	})
+
+	t.Run("retired CEP", func(t *testing.T) {
+		versions, err := GetHistory(importer.db, "01310200")
+		require.NoError(t, err)
+		require.Len(t, versions, 2)
+		assert.True(t, versions[1].Removed)
+
+		v, _, err := GetCEPAt(importer.db, "01310200", date("2024-07-01"))
+		require.NoError(t, err)
+		require.NotNil(t, v)
+		assert.Equal(t, "Rua Augusta", v.Data.Logradouro)
+
+		v, ok, err := GetCEPAt(importer.db, "01310200", date("2025-02-01"))
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Nil(t, v)
+
+		err = importer.db.View(func(txn *badger.Txn) error {
+			_, err := txn.Get([]byte("cep:01310200"))
+			return err
+		})
+		assert.ErrorIs(t, err, badger.ErrKeyNotFound)
+	})
+
+	t.Run("CEP without history", func(t *testing.T) {
+		_, ok, err := GetCEPAt(importer.db, "99999999", date("2025-02-01"))
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("invalid release date", func(t *testing.T) {
+		importer.releaseDate = "01/01/2025"
+		_, err := importer.PopulateZipcodes(t.TempDir())
+		assert.Error(t, err)
+	})
+}
+
+func TestHistoryOnPopulatedStore(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+
+	importRelease := func(streets string) {
+		dir := writeDNEDir(t, map[string]string{
+			"LOG_LOCALIDADE.TXT":    "001@SP@Sao Paulo@@1@M@@SP@3550308\n",
+			"LOG_BAIRRO.TXT":        "",
+			"LOG_LOGRADOURO_SP.TXT": streets,
+		})
+		_, err := importer.PopulateZipcodes(dir)
+		require.NoError(t, err)
+	}
+
+	// Imported before the history was enabled.
+	importRelease("001@SP@001@@@Paulista@@01310-100@Avenida@S@\n002@SP@001@@@Augusta@@01310-200@Rua@S@\n003@SP@001@@@Consolacao@@01301-000@Rua@S@\n")
+	first, err := GetDatasetInfo(importer.db)
+	require.NoError(t, err)
+
+	importer.history = true
+	importRelease("001@SP@001@@@Paulista@lado par@01310-100@Avenida@S@\n003@SP@001@@@Consolacao@@01301-000@Rua@S@\n")
+	second, err := GetDatasetInfo(importer.db)
+	require.NoError(t, err)
+
+	t.Run("modified CEP", func(t *testing.T) {
+		versions, err := GetHistory(importer.db, "01310100")
+		require.NoError(t, err)
+		require.Len(t, versions, 2, "the stored record is kept as the baseline")
+		assert.True(t, first.StartedAt.Equal(versions[0].ValidFrom))
+		assert.Equal(t, first.Source, versions[0].Release)
+		assert.Empty(t, versions[0].Data.Complemento)
+		assert.Equal(t, "lado par", versions[1].Data.Complemento)
+
+		v, ok, err := GetCEPAt(importer.db, "01310100", second.StartedAt.Add(-time.Nanosecond))
+		require.NoError(t, err)
+		assert.True(t, ok)
+		require.NotNil(t, v)
+		assert.Empty(t, v.Data.Complemento)
+	})
+
+	t.Run("retired CEP", func(t *testing.T) {
+		versions, err := GetHistory(importer.db, "01310200")
+		require.NoError(t, err)
+		require.Len(t, versions, 2)
+		assert.Equal(t, "Rua Augusta", versions[0].Data.Logradouro)
+		assert.True(t, versions[1].Removed)
+	})
+
+	t.Run("unchanged CEP", func(t *testing.T) {
+		versions, err := GetHistory(importer.db, "01301000")
+		require.NoError(t, err)
+		assert.Empty(t, versions)
+	})
+}
+
+func TestHistoryRetention(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+	importer.history = true
+	importer.historyRetention = 365 * 24 * time.Hour
+
+	// The last release is dated today, so only the first version was
+	// replaced before the retention.
+	for _, r := range []struct{ date, complemento string }{
+		{"2020-01-01", ""},
+		{"2021-01-01", "lado par"},
+		{"", "lado impar"},
+	} {
+		dir := writeDNEDir(t, map[string]string{
+			"LOG_LOCALIDADE.TXT":    "001@SP@Sao Paulo@@1@M@@SP@3550308\n",
+			"LOG_BAIRRO.TXT":        "",
+			"LOG_LOGRADOURO_SP.TXT": "001@SP@001@@@Paulista@" + r.complemento + "@01310-100@Avenida@S@\n",
+		})
+		importer.releaseDate = r.date
+		_, err := importer.PopulateZipcodes(dir)
+		require.NoError(t, err)
+	}
+
+	versions, err := GetHistory(importer.db, "01310100")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, "lado par", versions[0].Data.Complemento)
+	assert.Equal(t, "lado impar", versions[1].Data.Complemento)
+}
@@ -0,0 +1,203 @@
+package zipcodes
+
+import (
+	"encoding/json"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// cityIndexPrefix keys index the CEPs of every city:
+// idx:cidade:<cidade>:<cep>, holding the UF. The city is folded to lower
+// case.
+const cityIndexPrefix = "idx:cidade:"
+
+// cepRange is an inclusive range of the first five digits of a CEP.
+type cepRange struct {
+	from, to string
+}
+
+// ufRanges are the CEP ranges the Correios assign to every UF, in CEP order.
+var ufRanges = map[string][]cepRange{
+	"SP": {{"01000", "19999"}},
+	"RJ": {{"20000", "28999"}},
+	"ES": {{"29000", "29999"}},
+	"MG": {{"30000", "39999"}},
+	"BA": {{"40000", "48999"}},
+	"SE": {{"49000", "49999"}},
+	"PE": {{"50000", "56999"}},
+	"AL": {{"57000", "57999"}},
+	"PB": {{"58000", "58999"}},
+	"RN": {{"59000", "59999"}},
+	"CE": {{"60000", "63999"}},
+	"PI": {{"64000", "64999"}},
+	"MA": {{"65000", "65999"}},
+	"PA": {{"66000", "68899"}},
+	"AP": {{"68900", "68999"}},
+	"AM": {{"69000", "69299"}, {"69400", "69899"}},
+	"RR": {{"69300", "69399"}},
+	"AC": {{"69900", "69999"}},
+	"DF": {{"70000", "72799"}, {"73000", "73699"}},
+	"GO": {{"72800", "72999"}, {"73700", "76799"}},
+	"RO": {{"76800", "76999"}},
+	"TO": {{"77000", "77999"}},
+	"MT": {{"78000", "78899"}},
+	"MS": {{"79000", "79999"}},
+	"PR": {{"80000", "87999"}},
+	"SC": {{"88000", "89999"}},
+	"RS": {{"90000", "99999"}},
+}
+
+func foldCity(cidade string) string {
+	return strings.ToLower(strings.TrimSpace(cidade))
+}
+
+func cityIndexKey(cidade, cep string) []byte {
+	return []byte(cityIndexPrefix + foldCity(cidade) + ":" + cep)
+}
+
+// ListOptions filters ListCEPs. Cidade matches without regard to case.
+type ListOptions struct {
+	UF     string
+	Prefix string
+	Cidade string
+	// After is the last CEP of the previous page.
+	After string
+	Limit int
+}
+
+// ListCEPs returns a page of CEPs in CEP order and, when more may follow,
+// the CEP to pass as After for the next page.
+//
+// A city is read through the city index and a UF through its CEP ranges,
+// so neither filter scans the whole store. Stores imported before the
+// index existed fall back to scanning for cities.
+func ListCEPs(db *badger.DB, opts ListOptions) ([]CEPCompleto, string, error) {
+	page := &listPage{opts: opts, ceps: []CEPCompleto{}}
+	err := db.View(func(txn *badger.Txn) error {
+		switch {
+		case opts.Cidade != "" && hasCityIndex(txn):
+			return page.byCity(txn)
+		case opts.UF != "":
+			for _, r := range ufRanges[strings.ToUpper(opts.UF)] {
+				if err := page.scan(txn, r); err != nil || page.done {
+					return err
+				}
+			}
+			return nil
+		default:
+			return page.scan(txn, cepRange{})
+		}
+	})
+	return page.ceps, page.next, err
+}
+
+// listPage collects a page of ListCEPs.
+type listPage struct {
+	opts ListOptions
+	ceps []CEPCompleto
+	next string
+	done bool
+}
+
+// seek returns the first key of prefix to read, after the previous page.
+func (p *listPage) seek(prefix string) string {
+	if after := prefix + p.opts.After + "\x00"; p.opts.After != "" && after > prefix+p.opts.Prefix {
+		return after
+	}
+	return prefix + p.opts.Prefix
+}
+
+// add adds cep to the page when it matches the filters. Once the page is
+// full, the next match only tells that another page follows.
+func (p *listPage) add(cep CEPCompleto) {
+	if p.opts.UF != "" && !strings.EqualFold(cep.UF, p.opts.UF) {
+		return
+	}
+	if p.opts.Cidade != "" && !strings.EqualFold(cep.Cidade, p.opts.Cidade) {
+		return
+	}
+	if len(p.ceps) == p.opts.Limit {
+		p.next = p.ceps[len(p.ceps)-1].CEP
+		p.done = true
+		return
+	}
+	p.ceps = append(p.ceps, cep)
+}
+
+// scan reads the CEPs of r that match the prefix; an empty range reads
+// every CEP.
+func (p *listPage) scan(txn *badger.Txn, r cepRange) error {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	prefix := []byte("cep:" + p.opts.Prefix)
+	seek := p.seek("cep:")
+	if from := "cep:" + r.from; from > seek {
+		seek = from
+	}
+	for it.Seek([]byte(seek)); it.ValidForPrefix(prefix) && !p.done; it.Next() {
+		if r.to != "" && string(it.Item().Key()) > "cep:"+r.to+"999" {
+			return nil
+		}
+		var cep CEPCompleto
+		if err := it.Item().Value(func(val []byte) error {
+			return json.Unmarshal(val, &cep)
+		}); err != nil {
+			return err
+		}
+		p.add(cep)
+	}
+	return nil
+}
+
+// byCity reads the CEPs of the city index. Entries left behind by CEPs
+// that moved or were removed are skipped.
+func (p *listPage) byCity(txn *badger.Txn) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	index := cityIndexPrefix + foldCity(p.opts.Cidade) + ":"
+	prefix := []byte(index + p.opts.Prefix)
+	for it.Seek([]byte(p.seek(index))); it.ValidForPrefix(prefix) && !p.done; it.Next() {
+		if p.opts.UF != "" {
+			uf, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if !strings.EqualFold(string(uf), p.opts.UF) {
+				continue
+			}
+		}
+
+		item, err := txn.Get([]byte("cep:" + strings.TrimPrefix(string(it.Item().Key()), index)))
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var cep CEPCompleto
+		if err := item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &cep)
+		}); err != nil {
+			return err
+		}
+		p.add(cep)
+	}
+	return nil
+}
+
+// hasCityIndex reports whether the store holds the city index.
+func hasCityIndex(txn *badger.Txn) bool {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = []byte(cityIndexPrefix)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	it.Rewind()
+	return it.Valid()
+}
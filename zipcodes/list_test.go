@@ -0,0 +1,208 @@
+package zipcodes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListCEPs(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+
+	dir := writeDNEDir(t, map[string]string{
+		// DNE files are ISO-8859-1 encoded.
+		"LOG_LOCALIDADE.TXT":    "001@SP@S\xe3o Paulo@@1@M@@SP@3550308\n002@SP@Campinas@@1@M@@SP@3509502\n003@RJ@Rio de Janeiro@@1@M@@RJ@3304557\n",
+		"LOG_BAIRRO.TXT":        "",
+		"LOG_LOGRADOURO_SP.TXT": "001@SP@001@@@Paulista@@01310-100@Avenida@S@\n002@SP@001@@@Augusta@@01310-200@Rua@S@\n003@SP@002@@@Brasil@@13010-000@Avenida@S@\n",
+		"LOG_LOGRADOURO_RJ.TXT": "004@RJ@003@@@Atlantica@@22010-000@Avenida@S@\n",
+	})
+	_, err := importer.PopulateZipcodes(dir)
+	require.NoError(t, err)
+
+	t.Run("pages", func(t *testing.T) {
+		var all []string
+		after := ""
+		for pages := 0; pages < 10; pages++ {
+			ceps, next, err := ListCEPs(importer.db, ListOptions{After: after, Limit: 3})
+			require.NoError(t, err)
+			for _, c := range ceps {
+				all = append(all, c.CEP)
+			}
+			if next == "" {
+				break
+			}
+			after = next
+		}
+		assert.Equal(t, []string{"01310100", "01310200", "13010000", "22010000"}, all)
+	})
+
+	t.Run("last page has no cursor", func(t *testing.T) {
+		ceps, next, err := ListCEPs(importer.db, ListOptions{Prefix: "0131", Limit: 2})
+		require.NoError(t, err)
+		assert.Len(t, ceps, 2)
+		assert.Empty(t, next)
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		ceps, _, err := ListCEPs(importer.db, ListOptions{UF: "rj", Limit: 10})
+		require.NoError(t, err)
+		require.Len(t, ceps, 1)
+		assert.Equal(t, "22010000", ceps[0].CEP)
+
+		ceps, _, err = ListCEPs(importer.db, ListOptions{Cidade: "são paulo", Limit: 10})
+		require.NoError(t, err)
+		assert.Len(t, ceps, 2)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		stats, err := GetStats(importer.db)
+		require.NoError(t, err)
+		require.NotNil(t, stats)
+		assert.Equal(t, 4, stats.Total)
+		assert.Equal(t, 3, stats.PorUF["SP"])
+		assert.Equal(t, 4, stats.PorTipoOrigem["logradouro"])
+		assert.Equal(t, 3, stats.Municipios)
+		cityTotal := func(uf, cidade string) int {
+			total, err := CityTotal(importer.db, uf, cidade)
+			require.NoError(t, err)
+			return total
+		}
+		assert.Equal(t, 2, cityTotal("SP", "SÃO PAULO"))
+		assert.Equal(t, 1, cityTotal("", "campinas"))
+		assert.Equal(t, 0, cityTotal("RJ", "Campinas"))
+	})
+}
+
+func TestListCEPsIndexes(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+	importer.changeLog = true
+
+	write := func(streets string) {
+		dir := writeDNEDir(t, map[string]string{
+			"LOG_LOCALIDADE.TXT":    "001@SP@Campinas@@1@M@@SP@3509502\n002@SP@Santos@@1@M@@SP@3548500\n003@AM@Manaus@@1@M@@AM@1302603\n",
+			"LOG_BAIRRO.TXT":        "",
+			"LOG_LOGRADOURO_SP.TXT": streets,
+			"LOG_LOGRADOURO_AM.TXT": "010@AM@003@@@Eduardo Ribeiro@@69010-001@Avenida@S@\n011@AM@003@@@Djalma Batista@@69400-000@Avenida@S@\n",
+		})
+		_, err := importer.PopulateZipcodes(dir)
+		require.NoError(t, err)
+	}
+	list := func(opts ListOptions) []string {
+		var all []string
+		for pages := 0; pages < 10; pages++ {
+			ceps, next, err := ListCEPs(importer.db, opts)
+			require.NoError(t, err)
+			for _, c := range ceps {
+				all = append(all, c.CEP)
+			}
+			if next == "" {
+				break
+			}
+			opts.After = next
+		}
+		return all
+	}
+
+	write("001@SP@001@@@Brasil@@13010-000@Avenida@S@\n002@SP@001@@@Glicerio@@13010-100@Rua@S@\n003@SP@002@@@Ana Costa@@11010-000@Avenida@S@\n")
+
+	t.Run("uf ranges", func(t *testing.T) {
+		assert.Equal(t, []string{"69010001", "69400000"}, list(ListOptions{UF: "AM", Limit: 1}))
+		assert.Equal(t, []string{"11010000"}, list(ListOptions{UF: "SP", Prefix: "11", Limit: 1}))
+		assert.Empty(t, list(ListOptions{UF: "XX", Limit: 1}))
+	})
+
+	t.Run("city index", func(t *testing.T) {
+		assert.Equal(t, []string{"13010000", "13010100"}, list(ListOptions{Cidade: "CAMPINAS", Limit: 1}))
+		assert.Equal(t, []string{"13010100"}, list(ListOptions{Cidade: "campinas", Prefix: "130101", Limit: 1}))
+		assert.Empty(t, list(ListOptions{Cidade: "campinas", UF: "AM", Limit: 1}))
+	})
+
+	t.Run("moved and removed CEPs leave the index", func(t *testing.T) {
+		// 13010-100 moves to Santos and 13010-000 is gone from the release.
+		write("002@SP@002@@@Glicerio@@13010-100@Rua@S@\n003@SP@002@@@Ana Costa@@11010-000@Avenida@S@\n")
+
+		assert.Empty(t, list(ListOptions{Cidade: "campinas", Limit: 1}))
+		assert.Equal(t, []string{"11010000", "13010100"}, list(ListOptions{Cidade: "santos", Limit: 1}))
+
+		total, err := CityTotal(importer.db, "", "santos")
+		require.NoError(t, err)
+		assert.Equal(t, 2, total)
+	})
+
+	t.Run("stores without the index scan", func(t *testing.T) {
+		require.NoError(t, importer.db.DropPrefix([]byte(cityIndexPrefix)))
+		assert.Equal(t, []string{"11010000", "13010100"}, list(ListOptions{Cidade: "santos", Limit: 1}))
+	})
+}
+
+func TestStatsCountedOnImport(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+
+	write := func(streets string) *Stats {
+		dir := writeDNEDir(t, map[string]string{
+			"LOG_LOCALIDADE.TXT":    "001@SP@Campinas@@1@M@@SP@3509502\n002@SP@Santos@@1@M@@SP@3548500\n003@AM@Manaus@@1@M@@AM@1302603\n",
+			"LOG_BAIRRO.TXT":        "",
+			"LOG_LOGRADOURO_SP.TXT": streets,
+			"LOG_LOGRADOURO_AM.TXT": "010@AM@003@@@Eduardo Ribeiro@@69010-001@Avenida@S@\n",
+		})
+		_, err := importer.PopulateZipcodes(dir)
+		require.NoError(t, err)
+		stats, err := GetStats(importer.db)
+		require.NoError(t, err)
+		require.NotNil(t, stats)
+		return stats
+	}
+
+	stats := write("001@SP@001@@@Brasil@@13010-000@Avenida@S@\n002@SP@001@@@Glicerio@@13010-100@Rua@S@\n003@SP@002@@@Ana Costa@@11010-000@Avenida@S@\n")
+	assert.Equal(t, 4, stats.Total)
+	assert.Equal(t, 3, stats.Municipios)
+
+	t.Run("municipalities", func(t *testing.T) {
+		page, next, err := ListMunicipalityStats(importer.db, "", "", 2)
+		require.NoError(t, err)
+		assert.Equal(t, []MunicipalityStats{
+			{CodigoIBGE: "1302603", UF: "AM", Cidade: "Manaus", Total: 1},
+			{CodigoIBGE: "3509502", UF: "SP", Cidade: "Campinas", Total: 2},
+		}, page)
+		require.Equal(t, "3509502", next)
+
+		page, next, err = ListMunicipalityStats(importer.db, "", next, 2)
+		require.NoError(t, err)
+		assert.Equal(t, []MunicipalityStats{{CodigoIBGE: "3548500", UF: "SP", Cidade: "Santos", Total: 1}}, page)
+		assert.Empty(t, next)
+
+		page, _, err = ListMunicipalityStats(importer.db, "am", "", 10)
+		require.NoError(t, err)
+		require.Len(t, page, 1)
+		assert.Equal(t, "Manaus", page[0].Cidade)
+
+		page, _, err = ListMunicipalityStats(importer.db, "XX", "", 10)
+		require.NoError(t, err)
+		assert.Empty(t, page)
+	})
+
+	t.Run("CEPs kept from the previous release are counted", func(t *testing.T) {
+		// Without change tracking 13010-000 stays in the store.
+		stats := write("002@SP@001@@@Glicerio@@13010-100@Rua@S@\n003@SP@002@@@Ana Costa@@11010-000@Avenida@S@\n")
+		assert.Equal(t, 4, stats.Total)
+		assert.Equal(t, 3, stats.PorUF["SP"])
+
+		total, err := CityTotal(importer.db, "SP", "campinas")
+		require.NoError(t, err)
+		assert.Equal(t, 2, total)
+	})
+
+	t.Run("retired CEPs are not counted", func(t *testing.T) {
+		importer.changeLog = true
+		stats := write("002@SP@001@@@Glicerio@@13010-100@Rua@S@\n003@SP@002@@@Ana Costa@@11010-000@Avenida@S@\n")
+		assert.Equal(t, 3, stats.Total)
+
+		total, err := CityTotal(importer.db, "SP", "campinas")
+		require.NoError(t, err)
+		assert.Equal(t, 1, total)
+	})
+}
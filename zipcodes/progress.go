@@ -0,0 +1,157 @@
+package zipcodes
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of ProgressEvent.
+const (
+	EventImportStarted  = "import_started"
+	EventFileProgress   = "file_progress"
+	EventFileFinished   = "file_finished"
+	EventImportFinished = "import_finished"
+	EventChanges        = "changes"
+)
+
+// ProgressEvent is a structured notification of what an import is doing.
+// Only the fields relevant to Type are set.
+type ProgressEvent struct {
+	ID       uint64         `json:"id"`
+	Type     string         `json:"type"`
+	At       time.Time      `json:"at"`
+	Source   string         `json:"source,omitempty"`
+	File     string         `json:"file,omitempty"`
+	Records  int            `json:"records,omitempty"`
+	Report   *FileReport    `json:"report,omitempty"`
+	Totals   *FileReport    `json:"totals,omitempty"`
+	Failed   bool           `json:"failed,omitempty"`
+	Failures []string       `json:"failures,omitempty"`
+	Changes  *ChangeSummary `json:"changes,omitempty"`
+}
+
+// ChangeSummary counts the change events of an import. The events
+// themselves are in the change log between FirstCursor and LastCursor.
+type ChangeSummary struct {
+	Created     int    `json:"created"`
+	Updated     int    `json:"updated"`
+	Deleted     int    `json:"deleted"`
+	FirstCursor uint64 `json:"first_cursor,omitempty"`
+	LastCursor  uint64 `json:"last_cursor,omitempty"`
+}
+
+func (s *ChangeSummary) add(event *ChangeEvent) {
+	switch event.Type {
+	case ChangeCreated:
+		s.Created++
+	case ChangeUpdated:
+		s.Updated++
+	case ChangeDeleted:
+		s.Deleted++
+	}
+	if s.FirstCursor == 0 || event.Cursor < s.FirstCursor {
+		s.FirstCursor = event.Cursor
+	}
+	if event.Cursor > s.LastCursor {
+		s.LastCursor = event.Cursor
+	}
+}
+
+// EventBus fans progress events out to subscribers and keeps the latest
+// ones so late subscribers can catch up. A nil *EventBus drops everything.
+type EventBus struct {
+	mu      sync.Mutex
+	nextID  uint64
+	size    int
+	history []ProgressEvent
+	subs    map[chan ProgressEvent]struct{}
+	closed  bool
+}
+
+// NewEventBus keeps the last size events for replay.
+func NewEventBus(size int) *EventBus {
+	return &EventBus{
+		size: max(size, 1),
+		subs: make(map[chan ProgressEvent]struct{}),
+	}
+}
+
+// Publish assigns the next ID to event and sends it to every subscriber.
+// Subscribers too slow to keep up are disconnected; they can resubscribe
+// from the last ID they got.
+func (b *EventBus) Publish(event ProgressEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	b.nextID++
+	event.ID = b.nextID
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+
+	b.history = append(b.history, event)
+	if len(b.history) > b.size {
+		b.history = b.history[len(b.history)-b.size:]
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- event:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the kept events with an ID greater
+// than lastID and then every new event. The channel is closed by the
+// returned cancel func, by Close, or when the subscriber falls behind.
+func (b *EventBus) Subscribe(lastID uint64) (<-chan ProgressEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan ProgressEvent, 2*b.size)
+	for _, event := range b.history {
+		if event.ID > lastID {
+			ch <- event
+		}
+	}
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	b.subs[ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close ends every subscription once the pending events are read.
+func (b *EventBus) Close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
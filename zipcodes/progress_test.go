@@ -0,0 +1,106 @@
+package zipcodes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func drain(ch <-chan ProgressEvent) []ProgressEvent {
+	var events []ProgressEvent
+	for event := range ch {
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestEventBus(t *testing.T) {
+	t.Run("replay and close", func(t *testing.T) {
+		bus := NewEventBus(2)
+		bus.Publish(ProgressEvent{Type: EventImportStarted})
+		bus.Publish(ProgressEvent{Type: EventFileProgress})
+		bus.Publish(ProgressEvent{Type: EventFileFinished})
+
+		all, _ := bus.Subscribe(0)
+		resumed, _ := bus.Subscribe(2)
+		bus.Publish(ProgressEvent{Type: EventImportFinished})
+		bus.Close()
+
+		events := drain(all)
+		require.Len(t, events, 3, "only the last 2 events are kept")
+		assert.Equal(t, []uint64{2, 3, 4}, []uint64{events[0].ID, events[1].ID, events[2].ID})
+		assert.False(t, events[2].At.IsZero())
+
+		events = drain(resumed)
+		require.Len(t, events, 2)
+		assert.Equal(t, uint64(3), events[0].ID)
+
+		late, _ := bus.Subscribe(0)
+		assert.Len(t, drain(late), 2)
+	})
+
+	t.Run("slow subscriber is dropped", func(t *testing.T) {
+		bus := NewEventBus(1)
+		slow, _ := bus.Subscribe(0)
+		for n := 0; n < 3; n++ {
+			bus.Publish(ProgressEvent{Type: EventFileProgress})
+		}
+		assert.Len(t, drain(slow), 2)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		bus := NewEventBus(1)
+		ch, cancel := bus.Subscribe(0)
+		cancel()
+		cancel()
+		assert.Empty(t, drain(ch))
+	})
+
+	t.Run("nil bus", func(t *testing.T) {
+		var bus *EventBus
+		bus.Publish(ProgressEvent{Type: EventImportStarted})
+		bus.Close()
+	})
+}
+
+func TestPopulateZipcodesEvents(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+	importer.changeLog = true
+
+	bus := NewEventBus(100)
+	importer.PublishTo(bus)
+	events, _ := bus.Subscribe(0)
+
+	dir := writeDNEDir(t, map[string]string{
+		"LOG_LOCALIDADE.TXT":    "001@SP@Sao Paulo@@1@M@@SP@3550308\n",
+		"LOG_BAIRRO.TXT":        "",
+		"LOG_LOGRADOURO_SP.TXT": "001@SP@001@@@Paulista@@01310-100@Avenida@S@\n",
+	})
+	_, err := importer.PopulateZipcodes(dir)
+	require.NoError(t, err)
+	bus.Close()
+
+	received := drain(events)
+	require.NotEmpty(t, received)
+	assert.Equal(t, EventImportStarted, received[0].Type)
+
+	var street *ProgressEvent
+	for n := range received {
+		if received[n].Type == EventFileFinished && received[n].File == "LOG_LOGRADOURO_SP.TXT" {
+			street = &received[n]
+		}
+	}
+	require.NotNil(t, street)
+	assert.Equal(t, 1, street.Report.Written)
+
+	finished := received[len(received)-2]
+	assert.Equal(t, EventImportFinished, finished.Type)
+	assert.Equal(t, 1, finished.Totals.Written)
+
+	changes := received[len(received)-1]
+	assert.Equal(t, EventChanges, changes.Type)
+	assert.Equal(t, 1, changes.Changes.Created)
+	assert.Equal(t, changes.Changes.FirstCursor, changes.Changes.LastCursor)
+}
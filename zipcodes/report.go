@@ -0,0 +1,233 @@
+package zipcodes
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brasilcep/api/logger"
+	"go.uber.org/zap"
+)
+
+// Rejection reasons used in the import report.
+const (
+	ReasonMalformed  = "malformed"   // CSV parse error or missing fields
+	ReasonInvalidCEP = "invalid_cep" // CEP field is not 8 digits
+	ReasonOrphaned   = "orphaned"    // unknown LOC_NU or BAI_NU (record is still written)
+	ReasonWriteError = "write_error" // storing the record failed
+)
+
+// maxSamples is how many examples are kept per rejection reason and file.
+const maxSamples = 5
+
+// Sample is an example of a record flagged by the importer.
+type Sample struct {
+	Line   int    `json:"line"`
+	Detail string `json:"detail"`
+	Record string `json:"record,omitempty"`
+}
+
+// FileReport holds the counters of a single DNE source file. A file is only
+// processed by one goroutine at a time, so it is not synchronized.
+type FileReport struct {
+	File       string              `json:"file"`
+	Read       int                 `json:"read"`
+	Written    int                 `json:"written"`
+	Duplicate  int                 `json:"duplicate"`
+	Malformed  int                 `json:"malformed"`
+	InvalidCEP int                 `json:"invalid_cep"`
+	Orphaned   int                 `json:"orphaned"`
+	WriteError int                 `json:"write_error"`
+	DurationMS int64               `json:"duration_ms"`
+	Errors     []string            `json:"errors,omitempty"`
+	Samples    map[string][]Sample `json:"samples,omitempty"`
+
+	// orphanedLine is the line of the last orphaned record, so a record
+	// with several unknown references is counted once.
+	orphanedLine int
+}
+
+// Rejected is the number of records that did not make it to the database.
+func (r *FileReport) Rejected() int {
+	return r.Malformed + r.InvalidCEP + r.WriteError
+}
+
+func (r *FileReport) read() {
+	r.Read++
+}
+
+func (r *FileReport) reject(reason string, line int, detail string, record []string) {
+	switch reason {
+	case ReasonMalformed:
+		r.Malformed++
+	case ReasonInvalidCEP:
+		r.InvalidCEP++
+	case ReasonOrphaned:
+		if r.Orphaned == 0 || line != r.orphanedLine {
+			r.Orphaned++
+			r.orphanedLine = line
+		}
+	case ReasonWriteError:
+		r.WriteError++
+	}
+
+	if r.Samples == nil {
+		r.Samples = make(map[string][]Sample)
+	}
+	if len(r.Samples[reason]) < maxSamples {
+		r.Samples[reason] = append(r.Samples[reason], Sample{
+			Line:   line,
+			Detail: detail,
+			Record: strings.Join(record, "@"),
+		})
+	}
+}
+
+func (r *FileReport) fail(err error) {
+	r.Errors = append(r.Errors, err.Error())
+}
+
+// ImportReport is the machine readable outcome of PopulateZipcodes.
+type ImportReport struct {
+	Source     string        `json:"source"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt time.Time     `json:"finished_at"`
+	DurationMS int64         `json:"duration_ms"`
+	Totals     FileReport    `json:"totals"`
+	Files      []*FileReport `json:"files"`
+	Failed     bool          `json:"failed"`
+	Failures   []string      `json:"failures,omitempty"`
+
+	mu    sync.Mutex
+	files map[string]*FileReport
+}
+
+// Thresholds decide when an import is considered failed. Ratios are relative
+// to the number of records read; a negative value disables the check.
+type Thresholds struct {
+	MaxRejectedRatio float64
+	MaxOrphanedRatio float64
+}
+
+func newImportReport(source string) *ImportReport {
+	return &ImportReport{
+		Source:    source,
+		StartedAt: time.Now(),
+		files:     make(map[string]*FileReport),
+	}
+}
+
+// file returns the report of the given source file, creating it on first use.
+func (r *ImportReport) file(name string) *FileReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.files[name]; ok {
+		return f
+	}
+	f := &FileReport{File: name}
+	r.files[name] = f
+	r.Files = append(r.Files, f)
+	return f
+}
+
+// hasErrors reports whether any file could not be fully read or written.
+func (r *ImportReport) hasErrors() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.Files {
+		if len(f.Errors) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// finish computes the totals and checks them against the thresholds.
+func (r *ImportReport) finish(t Thresholds) {
+	r.FinishedAt = time.Now()
+	r.DurationMS = r.FinishedAt.Sub(r.StartedAt).Milliseconds()
+
+	sort.Slice(r.Files, func(a, b int) bool { return r.Files[a].File < r.Files[b].File })
+
+	totals := FileReport{File: "total"}
+	for _, f := range r.Files {
+		totals.Read += f.Read
+		totals.Written += f.Written
+		totals.Duplicate += f.Duplicate
+		totals.Malformed += f.Malformed
+		totals.InvalidCEP += f.InvalidCEP
+		totals.Orphaned += f.Orphaned
+		totals.WriteError += f.WriteError
+		for _, err := range f.Errors {
+			r.Failures = append(r.Failures, fmt.Sprintf("%s: %s", f.File, err))
+		}
+	}
+	r.Totals = totals
+
+	if totals.Read > 0 {
+		if ratio := float64(totals.Rejected()) / float64(totals.Read); t.MaxRejectedRatio >= 0 && ratio > t.MaxRejectedRatio {
+			r.Failures = append(r.Failures, fmt.Sprintf("rejected ratio %.4f above threshold %.4f", ratio, t.MaxRejectedRatio))
+		}
+		if ratio := float64(totals.Orphaned) / float64(totals.Read); t.MaxOrphanedRatio >= 0 && ratio > t.MaxOrphanedRatio {
+			r.Failures = append(r.Failures, fmt.Sprintf("orphaned ratio %.4f above threshold %.4f", ratio, t.MaxOrphanedRatio))
+		}
+	}
+
+	r.Failed = len(r.Failures) > 0
+}
+
+// WriteFile stores the report as indented JSON.
+func (r *ImportReport) WriteFile(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Log writes a one line summary per file plus the totals.
+func (r *ImportReport) Log(logger *logger.Logger) {
+	for _, f := range r.Files {
+		logger.Info("Import report",
+			zap.String("file", f.File),
+			zap.Int("read", f.Read),
+			zap.Int("written", f.Written),
+			zap.Int("duplicate", f.Duplicate),
+			zap.Int("malformed", f.Malformed),
+			zap.Int("invalid_cep", f.InvalidCEP),
+			zap.Int("orphaned", f.Orphaned),
+			zap.Int("write_error", f.WriteError),
+			zap.Int64("duration_ms", f.DurationMS),
+		)
+	}
+
+	fields := []zap.Field{
+		zap.Int("read", r.Totals.Read),
+		zap.Int("written", r.Totals.Written),
+		zap.Int("duplicate", r.Totals.Duplicate),
+		zap.Int("rejected", r.Totals.Rejected()),
+		zap.Int("orphaned", r.Totals.Orphaned),
+		zap.Int64("duration_ms", r.DurationMS),
+	}
+	if r.Failed {
+		logger.Error("Import failed", append(fields, zap.Strings("failures", r.Failures))...)
+		return
+	}
+	logger.Info("Import succeeded", fields...)
+}
+
+// parseErrorLine extracts the line number from a csv.ParseError.
+func parseErrorLine(err error) int {
+	var perr *csv.ParseError
+	if errors.As(err, &perr) {
+		return perr.Line
+	}
+	return 0
+}
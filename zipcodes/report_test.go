@@ -0,0 +1,85 @@
+package zipcodes
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportReport(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+
+	tmpDir, err := os.MkdirTemp("", "report-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	importer.localities["001"] = &Localidade{Codigo: "001", UF: "SP", Nome: "São Paulo"}
+	importer.districts["001"] = &Bairro{Codigo: "001", Nome: "Centro"}
+
+	streetsFile := filepath.Join(tmpDir, "LOG_LOGRADOURO_SP.TXT")
+	content := "001@SP@001@001@001@Paulista@@01310-100@Avenida@S@\n" +
+		"002@SP@001@001@001@Duplicada@@01310-100@Rua@S@\n" +
+		"003@SP\n" +
+		"004@SP@001@001@001@Sem CEP@@0131@Rua@S@\n" +
+		"005@SP@999@777@777@Orfa@@01310-200@Rua@S@\n"
+	require.NoError(t, os.WriteFile(streetsFile, []byte(content), 0644))
+
+	count, err := importer.importStreets(context.Background(), streetsFile)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	stats := importer.report.file("LOG_LOGRADOURO_SP.TXT")
+	assert.Equal(t, 5, stats.Read)
+	assert.Equal(t, 2, stats.Written)
+	assert.Equal(t, 1, stats.Duplicate)
+	assert.Equal(t, 1, stats.Malformed)
+	assert.Equal(t, 1, stats.InvalidCEP)
+	// One record with both an unknown LOC_NU and BAI_NU.
+	assert.Equal(t, 1, stats.Orphaned)
+	assert.Equal(t, 2, stats.Rejected())
+
+	require.Len(t, stats.Samples[ReasonMalformed], 1)
+	assert.Equal(t, 3, stats.Samples[ReasonMalformed][0].Line)
+	require.Len(t, stats.Samples[ReasonOrphaned], 2)
+	assert.Equal(t, `unknown BAI_NU "777"`, stats.Samples[ReasonOrphaned][0].Detail)
+	assert.Equal(t, `unknown LOC_NU "999"`, stats.Samples[ReasonOrphaned][1].Detail)
+
+	t.Run("thresholds", func(t *testing.T) {
+		importer.report.finish(Thresholds{MaxRejectedRatio: 0.5, MaxOrphanedRatio: -1})
+		assert.False(t, importer.report.Failed)
+
+		importer.report.Failures = nil
+		importer.report.finish(Thresholds{MaxRejectedRatio: 0.1, MaxOrphanedRatio: 0.1})
+		assert.True(t, importer.report.Failed)
+		assert.Len(t, importer.report.Failures, 2)
+	})
+
+	t.Run("write report file", func(t *testing.T) {
+		path := filepath.Join(tmpDir, "report.json")
+		require.NoError(t, importer.report.WriteFile(path))
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+
+		var decoded map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, float64(5), decoded["totals"].(map[string]interface{})["read"])
+	})
+}
+
+func TestImportReportMissingFile(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+
+	_, err := importer.importCPC(context.Background(), "/non/existent/LOG_CPC.TXT")
+	assert.Error(t, err)
+
+	importer.report.finish(Thresholds{MaxRejectedRatio: -1, MaxOrphanedRatio: -1})
+	assert.True(t, importer.report.Failed)
+}
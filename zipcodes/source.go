@@ -0,0 +1,143 @@
+package zipcodes
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxNestedArchives limits how deep zip files inside zip files are followed.
+// The eDNE distribution nests two levels; anything deeper is suspicious.
+const maxNestedArchives = 4
+
+// dneSource gives access to the DNE .TXT files, either from a plain
+// directory or straight from the eDNE zip archive distributed by Correios.
+type dneSource interface {
+	Open(name string) (io.ReadCloser, error)
+	Close() error
+}
+
+// openSource returns a directory source when path is a directory and a zip
+// source when path points to a .zip file (eDNE_Basico.zip and friends).
+func openSource(path string) (dneSource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &dirSource{path: path}, nil
+	}
+	if strings.EqualFold(filepath.Ext(path), ".zip") {
+		return openZipSource(path)
+	}
+	return nil, fmt.Errorf("unsupported DNE source %q: expected a directory or a .zip file", path)
+}
+
+type dirSource struct {
+	path string
+}
+
+func (s *dirSource) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.path, name))
+}
+
+func (s *dirSource) Close() error {
+	return nil
+}
+
+// zipSource indexes every .TXT entry of an archive, following nested zip
+// files, so entries can be streamed without extracting anything to disk.
+type zipSource struct {
+	archive *zip.ReadCloser
+	entries map[string]*zip.File
+}
+
+func openZipSource(path string) (*zipSource, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &zipSource{
+		archive: archive,
+		entries: make(map[string]*zip.File),
+	}
+	if err := s.index(&archive.Reader, 0); err != nil {
+		archive.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *zipSource) index(r *zip.Reader, depth int) error {
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		switch strings.ToUpper(path.Ext(f.Name)) {
+		case ".ZIP":
+			if depth >= maxNestedArchives {
+				return fmt.Errorf("archive %s is nested too deep", f.Name)
+			}
+			nested, err := openNestedZip(f)
+			if err != nil {
+				return fmt.Errorf("opening nested archive %s: %w", f.Name, err)
+			}
+			if err := s.index(nested, depth+1); err != nil {
+				return err
+			}
+		case ".TXT":
+			name := strings.ToUpper(path.Base(f.Name))
+			// eDNE ships the same files in "Delimitado" and "Fixo" layouts;
+			// only the delimited one can be parsed by the importer.
+			if existing, ok := s.entries[name]; ok && isDelimited(existing.Name) && !isDelimited(f.Name) {
+				continue
+			}
+			s.entries[name] = f
+		}
+	}
+	return nil
+}
+
+// openNestedZip loads a zip entry that is itself an archive. zip needs random
+// access, so the compressed inner archive is kept in memory.
+func openNestedZip(f *zip.File) (*zip.Reader, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(bytes.NewReader(data), int64(len(data)))
+}
+
+func isDelimited(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.EqualFold(part, "Delimitado") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *zipSource) Open(name string) (io.ReadCloser, error) {
+	f, ok := s.entries[strings.ToUpper(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.Open()
+}
+
+func (s *zipSource) Close() error {
+	return s.archive.Close()
+}
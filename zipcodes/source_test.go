@@ -0,0 +1,138 @@
+package zipcodes
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func buildZip(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		require.NoError(t, err)
+		_, err = f.Write(content)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// writeEDNEArchive mimics the eDNE layout: an outer zip holding a zip that
+// holds the versioned zip with the Delimitado and Fixo folders.
+func writeEDNEArchive(t *testing.T, dir string, delimited map[string]string) string {
+	files := map[string][]byte{}
+	for name, content := range delimited {
+		files["Delimitado/"+name] = []byte(content)
+		files["Fixo/"+name] = []byte("fixed width layout, not parseable")
+	}
+	versioned := buildZip(t, files)
+	basic := buildZip(t, map[string][]byte{"eDNE_Basico_25061.zip": versioned})
+	outer := buildZip(t, map[string][]byte{"eDNE_Basico.zip": basic})
+
+	path := filepath.Join(dir, "eDNE_Basico.zip")
+	require.NoError(t, os.WriteFile(path, outer, 0644))
+	return path
+}
+
+func TestOpenSource(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "source-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	t.Run("directory source", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "LOG_CPC.TXT"), []byte("cpc"), 0644))
+
+		src, err := openSource(tmpDir)
+		require.NoError(t, err)
+		defer src.Close()
+
+		rc, err := src.Open("LOG_CPC.TXT")
+		require.NoError(t, err)
+		defer rc.Close()
+		content, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		assert.Equal(t, "cpc", string(content))
+	})
+
+	t.Run("nested zip source prefers delimited files", func(t *testing.T) {
+		path := writeEDNEArchive(t, tmpDir, map[string]string{"LOG_BAIRRO.TXT": "001@SP@001@Centro@Ctr\n"})
+
+		src, err := openSource(path)
+		require.NoError(t, err)
+		defer src.Close()
+
+		rc, err := src.Open("log_bairro.txt")
+		require.NoError(t, err)
+		defer rc.Close()
+		content, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		assert.Equal(t, "001@SP@001@Centro@Ctr\n", string(content))
+	})
+
+	t.Run("missing entry in zip", func(t *testing.T) {
+		path := writeEDNEArchive(t, tmpDir, map[string]string{"LOG_BAIRRO.TXT": ""})
+
+		src, err := openSource(path)
+		require.NoError(t, err)
+		defer src.Close()
+
+		_, err = src.Open("LOG_CPC.TXT")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("unsupported file", func(t *testing.T) {
+		path := filepath.Join(tmpDir, "dne.tar")
+		require.NoError(t, os.WriteFile(path, nil, 0644))
+
+		_, err := openSource(path)
+		assert.Error(t, err)
+	})
+}
+
+func TestPopulateZipcodesFromZip(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+
+	tmpDir, err := os.MkdirTemp("", "populate-zip-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	path := writeEDNEArchive(t, tmpDir, map[string]string{
+		"LOG_LOCALIDADE.TXT":     "001@SP@Sao Paulo@@1@M@@SP@3550308\n",
+		"LOG_BAIRRO.TXT":         "001@SP@001@Centro@Ctr\n",
+		"LOG_LOGRADOURO_SP.TXT":  "001@SP@001@001@001@Paulista@@01310-100@Avenida@S@Av Paulista\n",
+		"LOG_CPC.TXT":            "001@SP@001@CPC Centro@Rua A 1@01000-001\n",
+		"LOG_GRANDE_USUARIO.TXT": "",
+		"LOG_UNID_OPER.TXT":      "",
+	})
+
+	report, err := importer.PopulateZipcodes(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.file("LOG_CPC.TXT").Written)
+
+	for _, cep := range []string{"01310100", "01000001"} {
+		err = importer.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte("cep:" + cep))
+			if err != nil {
+				return err
+			}
+			return item.Value(func(val []byte) error {
+				var retrieved CEPCompleto
+				require.NoError(t, json.Unmarshal(val, &retrieved))
+				assert.Equal(t, "Sao Paulo", retrieved.Cidade)
+				return nil
+			})
+		})
+		assert.NoError(t, err, cep)
+	}
+}
@@ -0,0 +1,224 @@
+package zipcodes
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+const (
+	// statsKey holds the Stats of the store, refreshed at the end of every
+	// import.
+	statsKey = "meta:stats"
+	// cityTotalPrefix keys hold the CEP count of every city:
+	// stats:cidade:<cidade>:<UF>, with the city folded to lower case.
+	cityTotalPrefix = "stats:cidade:"
+	// municipalityPrefix keys hold the MunicipalityStats of every
+	// municipality: stats:municipio:<código IBGE>.
+	municipalityPrefix = "stats:municipio:"
+)
+
+// ufIBGECodes are the IBGE codes of the UFs, which start the codes of
+// their municipalities.
+var ufIBGECodes = map[string]string{
+	"RO": "11", "AC": "12", "AM": "13", "RR": "14", "PA": "15", "AP": "16", "TO": "17",
+	"MA": "21", "PI": "22", "CE": "23", "RN": "24", "PB": "25", "PE": "26", "AL": "27", "SE": "28", "BA": "29",
+	"MG": "31", "ES": "32", "RJ": "33", "SP": "35",
+	"PR": "41", "SC": "42", "RS": "43",
+	"MS": "50", "MT": "51", "GO": "52", "DF": "53",
+}
+
+// Stats are aggregate counts of the CEPs in the store, computed once per
+// import so they can be served without scanning.
+type Stats struct {
+	Total         int            `json:"total_ceps"`
+	PorUF         map[string]int `json:"por_uf"`
+	PorTipoOrigem map[string]int `json:"por_tipo_origem"`
+	// Municipios is how many municipalities have CEPs; their counts are
+	// read with ListMunicipalityStats.
+	Municipios int       `json:"municipios"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// MunicipalityStats counts the CEPs of a municipality.
+type MunicipalityStats struct {
+	CodigoIBGE string `json:"codigo_ibge"`
+	UF         string `json:"uf"`
+	Cidade     string `json:"cidade"`
+	Total      int    `json:"total_ceps"`
+}
+
+func cityTotalKey(uf, cidade string) string {
+	return cityTotalPrefix + foldCity(cidade) + ":" + strings.ToUpper(uf)
+}
+
+// CityTotal returns how many CEPs a city has, matching its name without
+// regard to case. An empty uf sums the cities of that name in every UF.
+func CityTotal(db *badger.DB, uf, cidade string) (int, error) {
+	total := 0
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(cityTotalKey(uf, cidade))
+		if uf == "" {
+			opts.Prefix = []byte(cityTotalPrefix + foldCity(cidade) + ":")
+		}
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var n int
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &n)
+			}); err != nil {
+				return err
+			}
+			total += n
+		}
+		return nil
+	})
+	return total, err
+}
+
+// GetStats returns the stored Stats, or nil when no import stored them yet.
+func GetStats(db *badger.DB) (*Stats, error) {
+	var stats *Stats
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(statsKey))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			stats = &Stats{}
+			return json.Unmarshal(val, stats)
+		})
+	})
+	return stats, err
+}
+
+// ListMunicipalityStats returns a page of municipalities in IBGE code
+// order, optionally of a single UF, and, when more may follow, the code to
+// pass as after for the next page.
+func ListMunicipalityStats(db *badger.DB, uf, after string, limit int) ([]MunicipalityStats, string, error) {
+	page := []MunicipalityStats{}
+	next := ""
+
+	prefix := municipalityPrefix
+	if uf != "" {
+		code, ok := ufIBGECodes[strings.ToUpper(uf)]
+		if !ok {
+			return page, "", nil
+		}
+		prefix += code
+	}
+	seek := prefix
+	if key := municipalityPrefix + after + "\x00"; after != "" && key > seek {
+		seek = key
+	}
+
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek([]byte(seek)); it.ValidForPrefix([]byte(prefix)); it.Next() {
+			if len(page) == limit {
+				next = page[len(page)-1].CodigoIBGE
+				return nil
+			}
+			var m MunicipalityStats
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &m)
+			}); err != nil {
+				return err
+			}
+			page = append(page, m)
+		}
+		return nil
+	})
+	return page, next, err
+}
+
+// statsCounter accumulates the Stats of the CEPs an import writes, so they
+// are ready when it finishes without reading the store again.
+type statsCounter struct {
+	mu             sync.Mutex
+	stats          Stats
+	cities         map[string]int
+	municipalities map[string]*MunicipalityStats
+}
+
+func newStatsCounter() *statsCounter {
+	return &statsCounter{
+		stats: Stats{
+			PorUF:         make(map[string]int),
+			PorTipoOrigem: make(map[string]int),
+		},
+		cities:         make(map[string]int),
+		municipalities: make(map[string]*MunicipalityStats),
+	}
+}
+
+// add counts cep. It is safe for concurrent use.
+func (s *statsCounter) add(cep *CEPCompleto) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Total++
+	s.stats.PorUF[cep.UF]++
+	s.stats.PorTipoOrigem[cep.TipoOrigem]++
+	if cep.Cidade != "" {
+		s.cities[cityTotalKey(cep.UF, cep.Cidade)]++
+	}
+	if cep.CodigoIBGE != "" {
+		m, ok := s.municipalities[cep.CodigoIBGE]
+		if !ok {
+			m = &MunicipalityStats{CodigoIBGE: cep.CodigoIBGE, UF: cep.UF, Cidade: cep.Cidade}
+			s.municipalities[cep.CodigoIBGE] = m
+		}
+		m.Total++
+	}
+}
+
+// store replaces the Stats, city totals and municipality counts of db with
+// the counted ones.
+func (s *statsCounter) store(db *badger.DB) (*Stats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, prefix := range []string{cityTotalPrefix, municipalityPrefix} {
+		if err := db.DropPrefix([]byte(prefix)); err != nil {
+			return nil, err
+		}
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for key, n := range s.cities {
+		if err := wb.Set([]byte(key), []byte(strconv.Itoa(n))); err != nil {
+			return nil, err
+		}
+	}
+	for code, m := range s.municipalities {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		if err := wb.Set([]byte(municipalityPrefix+code), data); err != nil {
+			return nil, err
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return nil, err
+	}
+
+	stats := s.stats
+	stats.Municipios = len(s.municipalities)
+	stats.UpdatedAt = time.Now()
+	return &stats, putJSON(db, statsKey, &stats)
+}
@@ -0,0 +1,37 @@
+package zipcodes
+
+import (
+	"context"
+
+	"github.com/brasilcep/api/tracing"
+	badger "github.com/dgraph-io/badger/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+var tracer = otel.Tracer("github.com/brasilcep/api/zipcodes")
+
+// startPhase starts the span of an import phase as a child of ctx and
+// returns its context, and a func ending it.
+func (i *ZipCodeImporter) startPhase(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, func(err error)) {
+	ctx, span := tracer.Start(ctx, "import."+name, trace.WithAttributes(attrs...))
+	return ctx, func(err error) { tracing.End(span, err) }
+}
+
+// loggerFor returns the importer logger with the trace and span IDs of ctx.
+func (i *ZipCodeImporter) loggerFor(ctx context.Context) *zap.Logger {
+	return i.logger.With(tracing.Fields(ctx)...)
+}
+
+// flush writes wb in a span holding the number of records read so far.
+func flush(ctx context.Context, wb *badger.WriteBatch, file string, records int) error {
+	_, span := tracer.Start(ctx, "badger.flush", trace.WithAttributes(
+		attribute.String("dne.file", file),
+		attribute.Int("dne.records", records),
+	))
+	err := wb.Flush()
+	tracing.End(span, err)
+	return err
+}
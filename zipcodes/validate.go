@@ -0,0 +1,344 @@
+package zipcodes
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/brasilcep/api/logger"
+	"go.uber.org/zap"
+)
+
+// Validation issue kinds, in addition to the import rejection reasons.
+const (
+	IssueMissingReference = "missing_reference" // LOC_NU, BAI_NU or LOG_NU not found
+	IssueFieldLength      = "field_length"      // field longer than the DNE layout allows
+	IssueUFMismatch       = "uf_mismatch"       // UF differs from the referenced locality or file
+	IssueDuplicateCode    = "duplicate_code"    // primary key repeated in the same file
+	IssueMissingFile      = "missing_file"      // file could not be opened
+)
+
+type dneField struct {
+	name string
+	max  int
+}
+
+// dneLayouts holds the maximum field lengths of the delimited eDNE files,
+// following the Correios layout documentation. CEPs (max 0) are checked by
+// checkCEP instead.
+var dneLayouts = map[string][]dneField{
+	"LOG_LOCALIDADE.TXT": {
+		{"LOC_NU", 8}, {"UFE_SG", 2}, {"LOC_NO", 72}, {"CEP", 0}, {"LOC_IN_SIT", 1},
+		{"LOC_IN_TIPO_LOC", 1}, {"LOC_NU_SUB", 8}, {"LOC_NO_ABREV", 36}, {"MUN_NU", 7},
+	},
+	"LOG_BAIRRO.TXT": {
+		{"BAI_NU", 8}, {"UFE_SG", 2}, {"LOC_NU", 8}, {"BAI_NO", 72}, {"BAI_NO_ABREV", 36},
+	},
+	"LOG_LOGRADOURO": {
+		{"LOG_NU", 8}, {"UFE_SG", 2}, {"LOC_NU", 8}, {"BAI_NU_INI", 8}, {"BAI_NU_FIM", 8},
+		{"LOG_NO", 100}, {"LOG_COMPLEMENTO", 100}, {"CEP", 0}, {"TLO_TX", 36},
+		{"LOG_STA_TLO", 1}, {"LOG_NO_ABREV", 36},
+	},
+	"LOG_GRANDE_USUARIO.TXT": {
+		{"GRU_NU", 8}, {"UFE_SG", 2}, {"LOC_NU", 8}, {"BAI_NU", 8}, {"LOG_NU", 8},
+		{"GRU_NO", 72}, {"GRU_ENDERECO", 100}, {"CEP", 0}, {"GRU_NO_ABREV", 36},
+	},
+	"LOG_UNID_OPER.TXT": {
+		{"UOP_NU", 8}, {"UFE_SG", 2}, {"LOC_NU", 8}, {"BAI_NU", 8}, {"LOG_NU", 8},
+		{"UOP_NO", 100}, {"UOP_ENDERECO", 100}, {"CEP", 0}, {"UOP_IN_CP", 1}, {"UOP_NO_ABREV", 36},
+	},
+	"LOG_CPC.TXT": {
+		{"CPC_NU", 8}, {"UFE_SG", 2}, {"LOC_NU", 8}, {"CPC_NO", 72}, {"CPC_ENDERECO", 100}, {"CEP", 0},
+	},
+}
+
+// FileValidation holds the issues found in a single DNE file.
+type FileValidation struct {
+	File    string              `json:"file"`
+	Records int                 `json:"records"`
+	Issues  map[string]int      `json:"issues,omitempty"`
+	Samples map[string][]Sample `json:"samples,omitempty"`
+}
+
+func (f *FileValidation) read() {
+	f.Records++
+}
+
+func (f *FileValidation) reject(kind string, line int, detail string, record []string) {
+	if f.Issues == nil {
+		f.Issues = make(map[string]int)
+		f.Samples = make(map[string][]Sample)
+	}
+	f.Issues[kind]++
+	if len(f.Samples[kind]) < maxSamples {
+		f.Samples[kind] = append(f.Samples[kind], Sample{
+			Line:   line,
+			Detail: detail,
+			Record: strings.Join(record, "@"),
+		})
+	}
+}
+
+func (f *FileValidation) fail(err error) {
+	f.reject(IssueMissingFile, 0, err.Error(), nil)
+}
+
+// ValidationReport is the outcome of Validate. The dataset is only valid when
+// no issue of any kind was found.
+type ValidationReport struct {
+	Source string            `json:"source"`
+	Valid  bool              `json:"valid"`
+	Totals map[string]int    `json:"totals"`
+	Files  []*FileValidation `json:"files"`
+}
+
+func (v *ValidationReport) file(name string) *FileValidation {
+	f := &FileValidation{File: name}
+	v.Files = append(v.Files, f)
+	return f
+}
+
+func (v *ValidationReport) finish() {
+	v.Totals = make(map[string]int)
+	for _, f := range v.Files {
+		for kind, count := range f.Issues {
+			v.Totals[kind] += count
+		}
+	}
+	v.Valid = len(v.Totals) == 0
+}
+
+// WriteFile stores the report as indented JSON.
+func (v *ValidationReport) WriteFile(path string) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Log writes one line per file with issues plus the overall result.
+func (v *ValidationReport) Log(logger *logger.Logger) {
+	for _, f := range v.Files {
+		if len(f.Issues) == 0 {
+			continue
+		}
+		logger.Warn("Validation issues", zap.String("file", f.File), zap.Int("records", f.Records), zap.Any("issues", f.Issues))
+	}
+	if !v.Valid {
+		logger.Error("DNE validation failed", zap.Any("totals", v.Totals))
+		return
+	}
+	logger.Info("DNE validation succeeded")
+}
+
+// dneValidator keeps the codes seen so far (with their UF); files are checked
+// in dependency order so references always point to files already read.
+type dneValidator struct {
+	i          *ZipCodeImporter
+	report     *ValidationReport
+	localities map[string]string
+	districts  map[string]string
+	streets    map[string]struct{}
+}
+
+// Validate checks referential integrity, field lengths and UF consistency of
+// every DNE file at dnePath without writing anything to the database.
+func (i *ZipCodeImporter) Validate(dnePath string) (*ValidationReport, error) {
+	closeSource, err := i.useSource(dnePath)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSource()
+
+	report := i.validate(dnePath)
+	report.Log(i.logger)
+	i.writeValidationReport(report)
+	return report, nil
+}
+
+func (i *ZipCodeImporter) validate(dnePath string) *ValidationReport {
+	i.logger.Info("Validating DNE files...", zap.String("source", dnePath))
+
+	v := &dneValidator{
+		i:          i,
+		report:     &ValidationReport{Source: dnePath},
+		localities: make(map[string]string),
+		districts:  make(map[string]string),
+		streets:    make(map[string]struct{}),
+	}
+
+	v.validateLocalities("LOG_LOCALIDADE.TXT")
+	v.validateDistricts("LOG_BAIRRO.TXT")
+	ufs := append([]string(nil), streetUFs...)
+	sort.Strings(ufs)
+	for _, uf := range ufs {
+		v.validateStreets("LOG_LOGRADOURO_"+uf+".TXT", uf)
+	}
+	v.validateAddressed("LOG_GRANDE_USUARIO.TXT")
+	v.validateAddressed("LOG_UNID_OPER.TXT")
+	v.validateCPC("LOG_CPC.TXT")
+
+	v.report.finish()
+	return v.report
+}
+
+func (v *dneValidator) validateLocalities(file string) {
+	f := v.report.file(file)
+	subordinates := make(map[string][]string)
+
+	v.i.readRecords(file, 9, f, func(record []string, line int) {
+		v.checkLayout(f, file, record, line)
+		code := strings.TrimSpace(record[0])
+		uf := strings.TrimSpace(record[1])
+		v.checkUF(f, uf, record, line)
+		v.checkCEP(f, strings.TrimSpace(record[3]), true, record, line)
+
+		if _, ok := v.localities[code]; ok {
+			f.reject(IssueDuplicateCode, line, fmt.Sprintf("LOC_NU %q repeated", code), record)
+		}
+		v.localities[code] = uf
+
+		if sub := strings.TrimSpace(record[6]); sub != "" {
+			subordinates[sub] = record
+		}
+	})
+
+	// LOC_NU_SUB may point to a locality further down the file.
+	for sub, record := range subordinates {
+		if _, ok := v.localities[sub]; !ok {
+			f.reject(IssueMissingReference, 0, fmt.Sprintf("unknown LOC_NU_SUB %q", sub), record)
+		}
+	}
+}
+
+func (v *dneValidator) validateDistricts(file string) {
+	f := v.report.file(file)
+
+	v.i.readRecords(file, 4, f, func(record []string, line int) {
+		v.checkLayout(f, file, record, line)
+		code := strings.TrimSpace(record[0])
+		uf := strings.TrimSpace(record[1])
+		v.checkUF(f, uf, record, line)
+		v.checkLocality(f, strings.TrimSpace(record[2]), uf, record, line)
+
+		if _, ok := v.districts[code]; ok {
+			f.reject(IssueDuplicateCode, line, fmt.Sprintf("BAI_NU %q repeated", code), record)
+		}
+		v.districts[code] = uf
+	})
+}
+
+func (v *dneValidator) validateStreets(file, fileUF string) {
+	f := v.report.file(file)
+
+	v.i.readRecords(file, 8, f, func(record []string, line int) {
+		v.checkLayout(f, file, record, line)
+		uf := strings.TrimSpace(record[1])
+		if uf != fileUF {
+			f.reject(IssueUFMismatch, line, fmt.Sprintf("UF %q in a %s street file", uf, fileUF), record)
+		}
+		v.checkLocality(f, strings.TrimSpace(record[2]), uf, record, line)
+		v.checkDistrict(f, strings.TrimSpace(record[3]), uf, record, line)
+		v.checkDistrict(f, strings.TrimSpace(record[4]), uf, record, line)
+		v.checkCEP(f, strings.TrimSpace(record[7]), false, record, line)
+
+		v.streets[strings.TrimSpace(record[0])] = struct{}{}
+	})
+}
+
+// validateAddressed checks large users and operational units, which share
+// the same reference columns.
+func (v *dneValidator) validateAddressed(file string) {
+	f := v.report.file(file)
+
+	v.i.readRecords(file, 8, f, func(record []string, line int) {
+		v.checkLayout(f, file, record, line)
+		uf := strings.TrimSpace(record[1])
+		v.checkUF(f, uf, record, line)
+		v.checkLocality(f, strings.TrimSpace(record[2]), uf, record, line)
+		v.checkDistrict(f, strings.TrimSpace(record[3]), uf, record, line)
+		if street := strings.TrimSpace(record[4]); street != "" {
+			if _, ok := v.streets[street]; !ok {
+				f.reject(IssueMissingReference, line, fmt.Sprintf("unknown LOG_NU %q", street), record)
+			}
+		}
+		v.checkCEP(f, strings.TrimSpace(record[7]), false, record, line)
+	})
+}
+
+func (v *dneValidator) validateCPC(file string) {
+	f := v.report.file(file)
+
+	v.i.readRecords(file, 6, f, func(record []string, line int) {
+		v.checkLayout(f, file, record, line)
+		uf := strings.TrimSpace(record[1])
+		v.checkUF(f, uf, record, line)
+		v.checkLocality(f, strings.TrimSpace(record[2]), uf, record, line)
+		v.checkCEP(f, strings.TrimSpace(record[5]), false, record, line)
+	})
+}
+
+func (v *dneValidator) checkLayout(f *FileValidation, file string, record []string, line int) {
+	layout, ok := dneLayouts[file]
+	if !ok && strings.HasPrefix(file, "LOG_LOGRADOURO_") {
+		layout = dneLayouts["LOG_LOGRADOURO"]
+	}
+	for idx, field := range layout {
+		if idx >= len(record) {
+			break
+		}
+		if field.max == 0 {
+			continue
+		}
+		if n := utf8.RuneCountInString(strings.TrimSpace(record[idx])); n > field.max {
+			f.reject(IssueFieldLength, line, fmt.Sprintf("%s has %d characters, max %d", field.name, n, field.max), record)
+		}
+	}
+}
+
+func (v *dneValidator) checkUF(f *FileValidation, uf string, record []string, line int) {
+	for _, known := range streetUFs {
+		if uf == known {
+			return
+		}
+	}
+	f.reject(IssueUFMismatch, line, fmt.Sprintf("unknown UF %q", uf), record)
+}
+
+func (v *dneValidator) checkCEP(f *FileValidation, raw string, optional bool, record []string, line int) {
+	if raw == "" && optional {
+		return
+	}
+	if v.i.normalizeCEP(raw) == "" {
+		f.reject(ReasonInvalidCEP, line, fmt.Sprintf("invalid CEP %q", raw), record)
+	}
+}
+
+func (v *dneValidator) checkLocality(f *FileValidation, code, uf string, record []string, line int) {
+	locUF, ok := v.localities[code]
+	if !ok {
+		f.reject(IssueMissingReference, line, fmt.Sprintf("unknown LOC_NU %q", code), record)
+		return
+	}
+	if locUF != uf {
+		f.reject(IssueUFMismatch, line, fmt.Sprintf("UF %q but LOC_NU %q is in %q", uf, code, locUF), record)
+	}
+}
+
+func (v *dneValidator) checkDistrict(f *FileValidation, code, uf string, record []string, line int) {
+	if code == "" {
+		return
+	}
+	districtUF, ok := v.districts[code]
+	if !ok {
+		f.reject(IssueMissingReference, line, fmt.Sprintf("unknown BAI_NU %q", code), record)
+		return
+	}
+	if districtUF != uf {
+		f.reject(IssueUFMismatch, line, fmt.Sprintf("UF %q but BAI_NU %q is in %q", uf, code, districtUF), record)
+	}
+}
@@ -0,0 +1,130 @@
+package zipcodes
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeDNEDir(t *testing.T, files map[string]string) string {
+	dir, err := os.MkdirTemp("", "validate-test-*")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for _, uf := range streetUFs {
+		name := "LOG_LOGRADOURO_" + uf + ".TXT"
+		if _, ok := files[name]; !ok {
+			files[name] = ""
+		}
+	}
+	for _, name := range []string{"LOG_GRANDE_USUARIO.TXT", "LOG_UNID_OPER.TXT", "LOG_CPC.TXT"} {
+		if _, ok := files[name]; !ok {
+			files[name] = ""
+		}
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	return dir
+}
+
+func findFileValidation(report *ValidationReport, file string) *FileValidation {
+	for _, f := range report.Files {
+		if f.File == file {
+			return f
+		}
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+
+	t.Run("valid dataset", func(t *testing.T) {
+		dir := writeDNEDir(t, map[string]string{
+			"LOG_LOCALIDADE.TXT":    "001@SP@São Paulo@@1@M@@SP@3550308\n",
+			"LOG_BAIRRO.TXT":        "001@SP@001@Centro@Ctr\n",
+			"LOG_LOGRADOURO_SP.TXT": "001@SP@001@001@001@Paulista@@01310-100@Avenida@S@Av Paulista\n",
+			"LOG_CPC.TXT":           "001@SP@001@CPC Centro@Rua A 1@01000-001\n",
+		})
+
+		report, err := importer.Validate(dir)
+		require.NoError(t, err)
+		assert.True(t, report.Valid, report.Totals)
+	})
+
+	t.Run("reports every kind of issue", func(t *testing.T) {
+		dir := writeDNEDir(t, map[string]string{
+			"LOG_LOCALIDADE.TXT": "001@SP@São Paulo@@1@M@@SP@3550308\n" +
+				"001@SP@Duplicada@@1@M@@SP@3550308\n" +
+				"002@XX@Nenhum Lugar@@1@M@@NL@1234567\n",
+			"LOG_BAIRRO.TXT": "001@SP@001@Centro@Ctr\n" +
+				"002@RJ@001@Errado@Err\n",
+			"LOG_LOGRADOURO_SP.TXT": "001@SP@001@001@999@" + strings.Repeat("A", 101) + "@@01310-100@Avenida@S@\n" +
+				"002@SP@777@001@001@Orfa@@0131@Rua@S@\n" +
+				"003@RJ@001@001@001@Outra UF@@01310-200@Rua@S@\n",
+			"LOG_GRANDE_USUARIO.TXT": "001@SP@001@001@555@Empresa@Rua X@01234-567@Emp\n",
+		})
+
+		report, err := importer.Validate(dir)
+		require.NoError(t, err)
+		assert.False(t, report.Valid)
+
+		loc := findFileValidation(report, "LOG_LOCALIDADE.TXT")
+		require.NotNil(t, loc)
+		assert.Equal(t, 1, loc.Issues[IssueDuplicateCode])
+		assert.Equal(t, 1, loc.Issues[IssueUFMismatch])
+
+		bai := findFileValidation(report, "LOG_BAIRRO.TXT")
+		require.NotNil(t, bai)
+		assert.Equal(t, 1, bai.Issues[IssueUFMismatch])
+
+		streets := findFileValidation(report, "LOG_LOGRADOURO_SP.TXT")
+		require.NotNil(t, streets)
+		assert.Equal(t, 1, streets.Issues[IssueFieldLength])
+		assert.Equal(t, 2, streets.Issues[IssueMissingReference])
+		assert.Equal(t, 1, streets.Issues[ReasonInvalidCEP])
+		assert.Equal(t, 4, streets.Issues[IssueUFMismatch])
+
+		gru := findFileValidation(report, "LOG_GRANDE_USUARIO.TXT")
+		require.NotNil(t, gru)
+		assert.Equal(t, 1, gru.Issues[IssueMissingReference])
+		assert.Equal(t, `unknown LOG_NU "555"`, gru.Samples[IssueMissingReference][0].Detail)
+	})
+
+	t.Run("missing files", func(t *testing.T) {
+		dir := writeDNEDir(t, map[string]string{"LOG_BAIRRO.TXT": ""})
+
+		report, err := importer.Validate(dir)
+		require.NoError(t, err)
+		assert.False(t, report.Valid)
+		assert.Equal(t, 1, report.Totals[IssueMissingFile])
+	})
+}
+
+func TestPopulateZipcodesStrict(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+
+	importer.strict = true
+	dir := writeDNEDir(t, map[string]string{
+		"LOG_LOCALIDADE.TXT":    "001@SP@São Paulo@@1@M@@SP@3550308\n",
+		"LOG_BAIRRO.TXT":        "001@SP@001@Centro@Ctr\n",
+		"LOG_LOGRADOURO_SP.TXT": "001@SP@999@001@001@Paulista@@01310-100@Avenida@S@\n",
+	})
+
+	_, err := importer.PopulateZipcodes(dir)
+	assert.ErrorIs(t, err, ErrInvalidDNE)
+
+	err = importer.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte("cep:01310100"))
+		return err
+	})
+	assert.ErrorIs(t, err, badger.ErrKeyNotFound)
+}
@@ -1,44 +1,53 @@
 package zipcodes
 
 import (
+	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/brasilcep/api/database"
 	"github.com/brasilcep/api/logger"
+	"github.com/brasilcep/api/tracing"
 	badger "github.com/dgraph-io/badger/v4"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/charmap"
-	"golang.org/x/text/transform"
 )
 
 // Localidade (LOG_LOCALIDADE.TXT)
 type Localidade struct {
-	Codigo         string // LOC_NU
-	UF             string // UFE_SG
-	Nome           string // LOC_NO
-	CEP            string // CEP
-	Situacao       string // LOC_IN_SIT
-	TipoLocalidade string // LOC_IN_TIPO_LOC
-	CodigoSub      string // LOC_NU_SUB
-	NomeAbreviado  string // LOC_NO_ABREV
-	CodigoIBGE     string // MUN_NU
+	Codigo         string `json:"codigo"`                    // LOC_NU
+	UF             string `json:"uf"`                        // UFE_SG
+	Nome           string `json:"nome"`                      // LOC_NO
+	CEP            string `json:"cep,omitempty"`             // CEP
+	Situacao       string `json:"situacao,omitempty"`        // LOC_IN_SIT
+	TipoLocalidade string `json:"tipo_localidade,omitempty"` // LOC_IN_TIPO_LOC
+	CodigoSub      string `json:"codigo_sub,omitempty"`      // LOC_NU_SUB
+	NomeAbreviado  string `json:"nome_abreviado,omitempty"`  // LOC_NO_ABREV
+	CodigoIBGE     string `json:"codigo_ibge,omitempty"`     // MUN_NU
 }
 
 // Bairro (LOG_BAIRRO.TXT)
 type Bairro struct {
-	Codigo           string // BAI_NU
-	UF               string // UFE_SG
-	CodigoLocalidade string // LOC_NU
-	Nome             string // BAI_NO
-	NomeAbreviado    string // BAI_NO_ABREV
+	Codigo           string `json:"codigo"`                   // BAI_NU
+	UF               string `json:"uf"`                       // UFE_SG
+	CodigoLocalidade string `json:"codigo_localidade"`        // LOC_NU
+	Nome             string `json:"nome"`                     // BAI_NO
+	NomeAbreviado    string `json:"nome_abreviado,omitempty"` // BAI_NO_ABREV
 }
 
 // Logradouro (LOG_LOGRADOURO_XX.TXT)
@@ -92,122 +101,673 @@ type CEPCompleto struct {
 	NomeOrigem     string `json:"nome_origem,omitempty"`
 }
 
-var (
-	localities = make(map[string]*Localidade)
-	districts  = make(map[string]*Bairro)
-	db         *badger.DB
-	seenCEPs   = make(map[string]bool)
+// Key prefixes of the localities and districts of the last import.
+const (
+	localityPrefix = "loc:"
+	districtPrefix = "bai:"
 )
 
+// streetUFs lists the LOG_LOGRADOURO_XX.TXT files, largest states first so
+// the worker pool does not end up waiting on SP alone. The order only
+// schedules the work; it does not decide which file a CEP is taken from.
+var streetUFs = []string{"SP", "MG", "RJ", "RS", "PR", "BA", "SC", "GO", "PE", "CE", "PA", "ES", "MT", "MS", "MA", "PB", "RN", "AL", "PI", "DF", "SE", "TO", "RO", "AM", "AP", "AC", "RR"}
+
+// fileRanks decides which file a CEP found in more than one is taken from:
+// the lowest rank wins. It follows the import order, with the street files,
+// imported concurrently, ranked alphabetically by UF.
+var fileRanks = func() map[string]int {
+	ufs := slices.Sorted(slices.Values(streetUFs))
+	files := []string{"LOG_LOCALIDADE.TXT"}
+	for _, uf := range ufs {
+		files = append(files, "LOG_LOGRADOURO_"+uf+".TXT")
+	}
+	files = append(files, "LOG_GRANDE_USUARIO.TXT", "LOG_UNID_OPER.TXT", "LOG_CPC.TXT")
+
+	ranks := make(map[string]int, len(files))
+	for n, file := range files {
+		ranks[file] = n
+	}
+	return ranks
+}()
+
+// fileRank returns the rank of a DNE file; unknown files rank last.
+func fileRank(file string) int {
+	if rank, ok := fileRanks[filepath.Base(file)]; ok {
+		return rank
+	}
+	return len(fileRanks)
+}
+
+// cepClaim is the file that owns a CEP in the running import, and whether
+// its record was written.
+type cepClaim struct {
+	rank    int
+	written bool
+}
+
 type ZipCodeImporter struct {
-	db     *badger.DB
-	logger *logger.Logger
+	db         *badger.DB
+	logger     *logger.Logger
+	source     dneSource
+	workers    int
+	reportPath string
+	thresholds Thresholds
+	report     *ImportReport
+	reportOnce sync.Once
+
+	strict               bool
+	validationReportPath string
+
+	resume      bool
+	dataset     *DatasetInfo
+	checkpoints map[string]Checkpoint
+
+	history          bool
+	historyRetention time.Duration
+	releaseDate      string
+	validFrom        time.Time
+	// baseline is the version recorded for the stored record of a CEP
+	// without history when the import changes it, e.g. the first import
+	// with history enabled: the data of the previous import, Data unset.
+	baseline CEPVersion
+
+	changeLog       bool
+	changeRetention time.Duration
+	changeSeq       *badger.Sequence
+	changeMu        sync.Mutex
+	changes         ChangeSummary
+
+	// emptyStore is set when the import started without CEPs in the store,
+	// so there is nothing to compare the records with.
+	emptyStore bool
+
+	events *EventBus
+
+	scratchPath string
+
+	// Lookups and de-duplication state of the running import.
+	localities map[string]*Localidade
+	districts  map[string]*Bairro
+	seenMu     sync.Mutex
+	seenCEPs   map[string]cepClaim
+	counts     *statsCounter
 }
 
+// ErrInvalidDNE is returned by PopulateZipcodes in strict mode when the DNE
+// files do not pass validation.
+var ErrInvalidDNE = errors.New("DNE validation failed")
+
 var nonDigit = regexp.MustCompile(`\D`)
 
-func NewZipCodeImporter(logger *logger.Logger) *ZipCodeImporter {
+func NewZipCodeImporter(config *viper.Viper, logger *logger.Logger) *ZipCodeImporter {
 	return &ZipCodeImporter{
-		db:     database.GetDB(),
-		logger: logger,
+		db:         database.GetDB(),
+		logger:     logger,
+		workers:    config.GetInt("seed.workers"),
+		reportPath: config.GetString("seed.report.path"),
+		thresholds: Thresholds{
+			MaxRejectedRatio: config.GetFloat64("seed.report.max_rejected_ratio"),
+			MaxOrphanedRatio: config.GetFloat64("seed.report.max_orphaned_ratio"),
+		},
+		strict:               config.GetBool("seed.strict"),
+		validationReportPath: config.GetString("seed.validation.report.path"),
+		resume:               config.GetBool("seed.resume"),
+		history:              config.GetBool("seed.history.enable"),
+		historyRetention:     time.Duration(config.GetInt("seed.history.retention_days")) * 24 * time.Hour,
+		releaseDate:          config.GetString("seed.release_date"),
+		changeLog:            config.GetBool("seed.changes.enable"),
+		changeRetention:      time.Duration(config.GetInt("seed.changes.retention_days")) * 24 * time.Hour,
+		scratchPath:          config.GetString("diff.scratch.path"),
 	}
 }
 
-func (i *ZipCodeImporter) PopulateZipcodes(dnePath string) {
+// PublishTo sends the progress of the following imports to bus.
+func (i *ZipCodeImporter) PublishTo(bus *EventBus) {
+	i.events = bus
+}
+
+// PopulateZipcodes imports the DNE found at dnePath (a directory or the eDNE
+// zip archive) and returns a report of what happened to every source file.
+// The returned error is only set when the import could not run at all; check
+// ImportReport.Failed for data quality failures.
+func (i *ZipCodeImporter) PopulateZipcodes(dnePath string) (*ImportReport, error) {
 	if dnePath == "" {
-		i.logger.Error("DNE path is empty")
+		return nil, errors.New("DNE path is empty")
 	}
 
-	i.logger.Info("Starting DNE import...")
-	start := time.Now()
+	var releaseDate time.Time
+	if i.releaseDate != "" {
+		var err error
+		if releaseDate, err = time.Parse(ReleaseDateLayout, i.releaseDate); err != nil {
+			return nil, fmt.Errorf("invalid release date %q: %w", i.releaseDate, err)
+		}
+	}
 
-	var err error
-	db = database.GetDB()
-	if db == nil {
-		i.logger.Error("BadgerDB not initialized (database.GetDB() returned nil)")
+	if i.db == nil {
+		return nil, errors.New("BadgerDB not initialized (database.GetDB() returned nil)")
 	}
 
-	i.logger.Info("Loading localities...")
-	if err := i.loadLocalities(filepath.Join(dnePath, "LOG_LOCALIDADE.TXT")); err != nil {
-		i.logger.Warn("Warning loading localities", zap.Error(err))
+	closeSource, err := i.useSource(dnePath)
+	if err != nil {
+		return nil, err
 	}
-	i.logger.Info("Localities loaded", zap.Int("count", len(localities)))
+	defer closeSource()
 
-	i.logger.Info("Loading districts...")
-	if err := i.loadDistricts(filepath.Join(dnePath, "LOG_BAIRRO.TXT")); err != nil {
-		i.logger.Warn("Warning loading districts", zap.Error(err))
+	i.resetState()
+
+	if i.strict {
+		validation := i.validate(dnePath)
+		validation.Log(i.logger)
+		i.writeValidationReport(validation)
+		if !validation.Valid {
+			return nil, ErrInvalidDNE
+		}
 	}
-	i.logger.Info("Districts loaded", zap.Int("count", len(districts)))
 
-	i.logger.Info("Importing locality CEPs (general CEP)...")
-	if err := i.importLocalityCEPs(); err != nil {
-		i.logger.Warn("Warning while importing localities", zap.Error(err))
+	ctx, span := tracer.Start(context.Background(), "import", trace.WithAttributes(attribute.String("dne.source", dnePath)))
+	defer span.End()
+	log := i.loggerFor(ctx)
+
+	log.Info("Starting DNE import...")
+	i.report = newImportReport(dnePath)
+
+	if err := i.startDataset(dnePath); err != nil {
+		return nil, fmt.Errorf("starting dataset: %w", err)
+	}
+	if i.emptyStore, err = storeIsEmpty(i.db); err != nil {
+		return nil, fmt.Errorf("reading store: %w", err)
+	}
+	i.validFrom = releaseDate
+	if i.validFrom.IsZero() {
+		i.validFrom = i.dataset.StartedAt
 	}
+	if i.baseline.ValidFrom.IsZero() || !i.baseline.ValidFrom.Before(i.validFrom) {
+		// The start of the stored data is unknown, or not before this
+		// release: the baseline only tells what was there before it.
+		i.baseline = CEPVersion{ValidFrom: time.Unix(0, 0).UTC(), Release: i.baseline.Release}
+	}
+
+	i.events.Publish(ProgressEvent{Type: EventImportStarted, Source: dnePath})
 
-	i.logger.Info("Importing streets by state...")
-	totalStreets := 0
-	for _, uf := range []string{"AC", "AL", "AP", "AM", "BA", "CE", "DF", "ES", "GO", "MA", "MT", "MS", "MG", "PA", "PB", "PR", "PE", "PI", "RJ", "RN", "RS", "RO", "RR", "SC", "SP", "SE", "TO"} {
-		filePath := filepath.Join(dnePath, "LOG_LOGRADOURO_"+uf+".TXT")
-		ufCount, err := i.importStreets(filePath)
+	if i.changeLog {
+		i.changes = ChangeSummary{}
+		i.changeSeq, err = i.db.GetSequence([]byte(changeSeqKey), 1000)
 		if err != nil {
-			i.logger.Warn("Warning while importing streets for UF "+uf, zap.Error(err))
-			continue
+			return nil, fmt.Errorf("opening change sequence: %w", err)
 		}
-		totalStreets += ufCount
+		defer i.changeSeq.Release()
+	}
+
+	log.Info("Loading localities...")
+	_, endPhase := i.startPhase(ctx, "load_localities")
+	err = i.loadLocalities("LOG_LOCALIDADE.TXT")
+	endPhase(err)
+	if err != nil {
+		log.Warn("Warning loading localities", zap.Error(err))
+	}
+	log.Info("Localities loaded", zap.Int("count", len(i.localities)))
+
+	log.Info("Loading districts...")
+	_, endPhase = i.startPhase(ctx, "load_districts")
+	err = i.loadDistricts("LOG_BAIRRO.TXT")
+	endPhase(err)
+	if err != nil {
+		log.Warn("Warning loading districts", zap.Error(err))
+	}
+	log.Info("Districts loaded", zap.Int("count", len(i.districts)))
+
+	_, endPhase = i.startPhase(ctx, "store_lookups")
+	err = i.storeLookups()
+	endPhase(err)
+	if err != nil {
+		log.Warn("Warning while storing localities and districts", zap.Error(err))
+	}
+
+	log.Info("Importing locality CEPs (general CEP)...")
+	phaseCtx, endPhase := i.startPhase(ctx, "locality_ceps")
+	err = i.importLocalityCEPs(phaseCtx)
+	endPhase(err)
+	if err != nil {
+		log.Warn("Warning while importing localities", zap.Error(err))
 	}
-	i.logger.Info("Streets imported", zap.Int("count", totalStreets))
 
-	i.logger.Info("Importing large users...")
-	countLU, err := i.importLargeUsers(filepath.Join(dnePath, "LOG_GRANDE_USUARIO.TXT"))
+	log.Info("Importing streets by state...", zap.Int("workers", i.streetWorkers()))
+	streetsStart := time.Now()
+	phaseCtx, endPhase = i.startPhase(ctx, "streets", attribute.Int("workers", i.streetWorkers()))
+	totalStreets := i.importAllStreets(phaseCtx)
+	endPhase(nil)
+	log.Info("Streets imported", zap.Int("count", totalStreets), zap.Duration("duration", time.Since(streetsStart)))
+
+	log.Info("Importing large users...")
+	phaseCtx, endPhase = i.startPhase(ctx, "large_users")
+	countLU, err := i.importLargeUsers(phaseCtx, "LOG_GRANDE_USUARIO.TXT")
+	endPhase(err)
 	if err != nil {
-		i.logger.Warn("Warning while importing large users", zap.Error(err))
+		log.Warn("Warning while importing large users", zap.Error(err))
 	}
-	i.logger.Info("Large users imported", zap.Int("count", countLU))
+	log.Info("Large users imported", zap.Int("count", countLU))
 
-	i.logger.Info("Importing Operational Units (UOP)...")
-	countUOP, err := i.importOperationalUnits(filepath.Join(dnePath, "LOG_UNID_OPER.TXT"))
+	log.Info("Importing Operational Units (UOP)...")
+	phaseCtx, endPhase = i.startPhase(ctx, "operational_units")
+	countUOP, err := i.importOperationalUnits(phaseCtx, "LOG_UNID_OPER.TXT")
+	endPhase(err)
 	if err != nil {
-		i.logger.Warn("Warning while importing operational units", zap.Error(err))
+		log.Warn("Warning while importing operational units", zap.Error(err))
 	}
-	i.logger.Info("UOPs imported", zap.Int("count", countUOP))
+	log.Info("UOPs imported", zap.Int("count", countUOP))
 
-	i.logger.Info("Importing CPC...")
-	countCPC, err := i.importCPC(filepath.Join(dnePath, "LOG_CPC.TXT"))
+	log.Info("Importing CPC...")
+	phaseCtx, endPhase = i.startPhase(ctx, "cpc")
+	countCPC, err := i.importCPC(phaseCtx, "LOG_CPC.TXT")
+	endPhase(err)
 	if err != nil {
-		i.logger.Warn("Warning while importing CPC", zap.Error(err))
+		log.Warn("Warning while importing CPC", zap.Error(err))
 	}
-	i.logger.Info("CPC imported", zap.Int("count", countCPC))
+	log.Info("CPC imported", zap.Int("count", countCPC))
 
-	elapsed := time.Since(start)
-	i.logger.Info("Import completed", zap.Duration("duration", elapsed))
-	i.logger.Info("Total CEPs imported (approx)", zap.Int("count", len(seenCEPs)))
+	_, endPhase = i.startPhase(ctx, "finish")
+	err = i.finishDataset()
+	endPhase(err)
+	if err != nil {
+		return nil, fmt.Errorf("finishing dataset: %w", err)
+	}
+
+	i.report.finish(i.thresholds)
+	i.publishFinished()
+	log.Info("Import completed", zap.Duration("duration", time.Since(i.report.StartedAt)))
+	log.Info("Total CEPs imported (approx)", zap.Int("count", len(i.seenCEPs)))
+	i.report.Log(i.logger)
+
+	if i.reportPath != "" {
+		if err := i.report.WriteFile(i.reportPath); err != nil {
+			log.Warn("Failed to write import report", zap.String("path", i.reportPath), zap.Error(err))
+		} else {
+			log.Info("Import report written", zap.String("path", i.reportPath))
+		}
+	}
+
+	return i.report, nil
 }
 
-func (i *ZipCodeImporter) loadLocalities(file string) error {
-	f, err := os.Open(file)
+// publishFinished sends the outcome of the import, and a summary of the
+// change events it recorded, to the event bus.
+func (i *ZipCodeImporter) publishFinished() {
+	totals := i.report.Totals
+	i.events.Publish(ProgressEvent{
+		Type:     EventImportFinished,
+		Source:   i.report.Source,
+		Totals:   &totals,
+		Failed:   i.report.Failed,
+		Failures: i.report.Failures,
+	})
+	if i.changeLog {
+		changes := i.changes
+		i.events.Publish(ProgressEvent{Type: EventChanges, Source: i.report.Source, Changes: &changes})
+	}
+}
+
+// publishFile sends the report of a file once it was imported, or failed.
+func (i *ZipCodeImporter) publishFile(stats *FileReport) {
+	if i.events == nil {
+		return
+	}
+	report := *stats
+	i.events.Publish(ProgressEvent{Type: EventFileFinished, File: report.File, Records: report.Read, Report: &report})
+}
+
+// resetState forgets the lookups and CEPs of a previous import by this
+// importer.
+func (i *ZipCodeImporter) resetState() {
+	i.localities = make(map[string]*Localidade)
+	i.districts = make(map[string]*Bairro)
+	i.seenMu.Lock()
+	i.seenCEPs = make(map[string]cepClaim)
+	i.seenMu.Unlock()
+	i.counts = newStatsCounter()
+}
+
+// startDataset marks the store as being imported. When the previous import
+// of the same source was interrupted and resuming is enabled, its
+// checkpoints are loaded instead.
+func (i *ZipCodeImporter) startDataset(dnePath string) error {
+	info, err := GetDatasetInfo(i.db)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	decoder := transform.NewReader(f, charmap.ISO8859_1.NewDecoder())
-	reader := csv.NewReader(decoder)
+	i.baseline = CEPVersion{}
+	if info != nil && info.Complete() {
+		i.baseline = CEPVersion{ValidFrom: info.StartedAt, Release: info.Source}
+	}
+	if info != nil && !info.Complete() {
+		if i.resume && info.Source == dnePath {
+			i.checkpoints, err = loadCheckpoints(i.db)
+			if err != nil {
+				return err
+			}
+			i.dataset = info
+			i.logger.Info("Resuming interrupted import", zap.Time("started_at", info.StartedAt), zap.Int("checkpoints", len(i.checkpoints)))
+			return nil
+		}
+		i.logger.Warn("Previous import did not finish, starting over", zap.String("source", info.Source), zap.Time("started_at", info.StartedAt))
+	}
+
+	if err := clearCheckpoints(i.db); err != nil {
+		return err
+	}
+	i.checkpoints = nil
+	i.dataset = &DatasetInfo{Status: DatasetImporting, Source: dnePath, StartedAt: time.Now()}
+	return setDatasetInfo(i.db, i.dataset)
+}
+
+// finishDataset stores the stats, marks the dataset complete and drops the
+// checkpoints. When changes are tracked, CEPs missing from a cleanly read
+// release are retired first; otherwise they stay and are counted too.
+// History and change events past their retention are dropped.
+func (i *ZipCodeImporter) finishDataset() error {
+	if i.tracksChanges() && !i.report.hasErrors() {
+		if _, err := i.retireUnseen(); err != nil {
+			return err
+		}
+	} else if err := i.countUnseen(); err != nil {
+		return fmt.Errorf("counting CEPs missing from the release: %w", err)
+	}
+
+	if err := i.pruneHistory(); err != nil {
+		return fmt.Errorf("pruning history: %w", err)
+	}
+	if err := i.pruneChanges(); err != nil {
+		return fmt.Errorf("pruning change log: %w", err)
+	}
+
+	stats, err := i.counts.store(i.db)
+	if err != nil {
+		return fmt.Errorf("storing stats: %w", err)
+	}
+	i.logger.Info("Stats stored", zap.Int("total_ceps", stats.Total))
+
+	i.dataset.Status = DatasetComplete
+	i.dataset.CompletedAt = time.Now()
+	if err := setDatasetInfo(i.db, i.dataset); err != nil {
+		return err
+	}
+	return clearCheckpoints(i.db)
+}
+
+// storeIsEmpty reports whether the store holds no CEP.
+func storeIsEmpty(db *badger.DB) (bool, error) {
+	empty := true
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte("cep:")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	return empty, err
+}
+
+// countUnseen adds the CEPs of the store that the import did not write to
+// the stats. Only their keys are read, except for the CEPs that are counted.
+func (i *ZipCodeImporter) countUnseen() error {
+	return i.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte("cep:")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			if i.seenCEPs[strings.TrimPrefix(string(it.Item().Key()), "cep:")].written {
+				continue
+			}
+			var cep CEPCompleto
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &cep)
+			}); err != nil {
+				return err
+			}
+			i.counts.add(&cep)
+		}
+		return nil
+	})
+}
+
+// useSource makes dnePath the source of the DNE files; the returned func
+// closes it.
+func (i *ZipCodeImporter) useSource(dnePath string) (func(), error) {
+	source, err := openSource(dnePath)
+	if err != nil {
+		return nil, fmt.Errorf("opening DNE source: %w", err)
+	}
+	i.source = source
+	return func() {
+		i.source.Close()
+		i.source = nil
+	}, nil
+}
+
+// writeValidationReport stores the validation report when a path is set.
+func (i *ZipCodeImporter) writeValidationReport(report *ValidationReport) {
+	if i.validationReportPath == "" {
+		return
+	}
+	if err := report.WriteFile(i.validationReportPath); err != nil {
+		i.logger.Warn("Failed to write validation report", zap.String("path", i.validationReportPath), zap.Error(err))
+		return
+	}
+	i.logger.Info("Validation report written", zap.String("path", i.validationReportPath))
+}
+
+func (i *ZipCodeImporter) streetWorkers() int {
+	if i.workers < 1 {
+		return 1
+	}
+	return i.workers
+}
+
+// importAllStreets imports every LOG_LOGRADOURO_XX.TXT file using a bounded
+// pool of workers, one file per worker at a time. The CEPs of every file are
+// claimed first, so a CEP in more than one file is taken from the same file
+// whatever order the workers run in.
+func (i *ZipCodeImporter) importAllStreets(ctx context.Context) int {
+	i.claimStreets(ctx)
+	log := i.loggerFor(ctx)
+
+	jobs := make(chan string)
+	var (
+		wg    sync.WaitGroup
+		total atomic.Int64
+	)
+
+	for w := 0; w < i.streetWorkers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uf := range jobs {
+				start := time.Now()
+				ufCount, err := i.importStreets(ctx, "LOG_LOGRADOURO_"+uf+".TXT")
+				if err != nil {
+					log.Warn("Warning while importing streets for UF "+uf, zap.Error(err))
+					continue
+				}
+				total.Add(int64(ufCount))
+				log.Info("Streets imported for UF", zap.String("uf", uf), zap.Int("count", ufCount), zap.Duration("duration", time.Since(start)))
+			}
+		}()
+	}
+
+	for _, uf := range streetUFs {
+		jobs <- uf
+	}
+	close(jobs)
+	wg.Wait()
+
+	return int(total.Load())
+}
+
+// claimStreets reads the CEPs of every street file, with the same pool of
+// workers, and claims each one for the lowest ranked file it is in.
+func (i *ZipCodeImporter) claimStreets(ctx context.Context) {
+	ctx, endPhase := i.startPhase(ctx, "claim_streets")
+	defer endPhase(nil)
+	log := i.loggerFor(ctx)
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for w := 0; w < i.streetWorkers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				rank := fileRank(file)
+				// Broken records are reported by the import itself.
+				err := i.readRecords(file, 8, discardTracker{}, func(record []string, _ int) {
+					if cep := i.normalizeCEP(strings.TrimSpace(record[7])); cep != "" {
+						i.claim(cep, rank)
+					}
+				})
+				if err != nil {
+					log.Debug("Street file not claimed", zap.String("file", file), zap.Error(err))
+				}
+			}
+		}()
+	}
+
+	for _, uf := range streetUFs {
+		jobs <- "LOG_LOGRADOURO_" + uf + ".TXT"
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// discardTracker ignores the records it is notified of.
+type discardTracker struct{}
+
+func (discardTracker) read()                                {}
+func (discardTracker) reject(string, int, string, []string) {}
+func (discardTracker) fail(error)                           {}
+
+// fileReport returns the report entry of a DNE file. Importers built without
+// PopulateZipcodes (as in tests) get a report on first use.
+func (i *ZipCodeImporter) fileReport(file string) *FileReport {
+	i.reportOnce.Do(func() {
+		if i.report == nil {
+			i.report = newImportReport("")
+		}
+	})
+	return i.report.file(filepath.Base(file))
+}
+
+// dneReader reads the '@' delimited, ISO-8859-1 encoded DNE files. Records
+// are split before being decoded, so InputOffset is a position in the raw
+// file that can be seeked to.
+type dneReader struct {
+	*csv.Reader
+	decoder *encoding.Decoder
+}
+
+func newDNEReader(r io.Reader) *dneReader {
+	reader := csv.NewReader(r)
 	reader.Comma = '@'
 	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	return &dneReader{Reader: reader, decoder: charmap.ISO8859_1.NewDecoder()}
+}
+
+// Read returns the next record with its fields decoded to UTF-8.
+func (r *dneReader) Read() ([]string, error) {
+	record, err := r.Reader.Read()
+	for n, field := range record {
+		// ISO-8859-1 maps every byte, so decoding can not fail.
+		record[n], _ = r.decoder.String(field)
+	}
+	return record, err
+}
+
+// recordTracker is notified of every record read from a DNE file and of
+// the ones that could not be parsed.
+type recordTracker interface {
+	read()
+	reject(reason string, line int, detail string, record []string)
+	fail(err error)
+}
+
+// position is where a record of a DNE file ends: the byte offset in the raw
+// file and the line, both right after the record.
+type position struct {
+	offset int64
+	line   int
+}
+
+// readRecords calls fn for every well formed record of file with at least
+// minFields fields; broken lines are reported to tracker as malformed.
+func (i *ZipCodeImporter) readRecords(file string, minFields int, tracker recordTracker, fn func(record []string, line int)) error {
+	return i.scanRecords(file, position{}, minFields, tracker, func(record []string, line int, _ position) {
+		fn(record, line)
+	})
+}
+
+// scanRecords is readRecords starting at from and also passing the
+// position right after each record. Positions are what checkpoints are made
+// of. Files on disk are seeked to from; zip entries can not seek, so the
+// bytes before it are skipped without being parsed.
+func (i *ZipCodeImporter) scanRecords(file string, from position, minFields int, tracker recordTracker, fn func(record []string, line int, end position)) error {
+	f, err := i.open(file)
+	if err != nil {
+		tracker.fail(err)
+		return err
+	}
+	defer f.Close()
 
+	if from.offset > 0 {
+		if seeker, ok := f.(io.Seeker); ok {
+			_, err = seeker.Seek(from.offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, f, from.offset)
+		}
+		if err != nil {
+			err = fmt.Errorf("skipping to offset %d: %w", from.offset, err)
+			tracker.fail(err)
+			return err
+		}
+	}
+
+	reader := newDNEReader(f)
 	for {
 		record, err := reader.Read()
 		if err == io.EOF {
 			break
 		}
+		tracker.read()
 		if err != nil {
+			tracker.reject(ReasonMalformed, from.line+parseErrorLine(err), err.Error(), record)
 			continue
 		}
-		// 0 LOC_NU, 1 UFE_SG, 2 LOC_NO, 3 CEP, 4 LOC_IN_SIT, 5 LOC_IN_TIPO_LOC,
-		// 6 LOC_NU_SUB, 7 LOC_NO_ABREV, 8 MUN_NU
-		if len(record) < 9 {
+		line, _ := reader.FieldPos(0)
+		line += from.line
+		if len(record) < minFields {
+			tracker.reject(ReasonMalformed, line, fmt.Sprintf("expected at least %d fields, got %d", minFields, len(record)), record)
 			continue
 		}
+		last, _ := reader.FieldPos(len(record) - 1)
+		fn(record, line, position{offset: from.offset + reader.InputOffset(), line: from.line + last})
+	}
+	return nil
+}
+
+func (i *ZipCodeImporter) loadLocalities(file string) error {
+	stats := i.fileReport(file)
+	start := time.Now()
+	defer func() { stats.DurationMS += time.Since(start).Milliseconds() }()
+
+	// 0 LOC_NU, 1 UFE_SG, 2 LOC_NO, 3 CEP, 4 LOC_IN_SIT, 5 LOC_IN_TIPO_LOC,
+	// 6 LOC_NU_SUB, 7 LOC_NO_ABREV, 8 MUN_NU
+	return i.readRecords(file, 9, stats, func(record []string, line int) {
 		loc := &Localidade{
 			Codigo:         strings.TrimSpace(record[0]),
 			UF:             strings.TrimSpace(record[1]),
@@ -220,36 +780,18 @@ func (i *ZipCodeImporter) loadLocalities(file string) error {
 			CodigoIBGE:     strings.TrimSpace(record[8]),
 		}
 		if loc.Codigo != "" {
-			localities[loc.Codigo] = loc
+			i.localities[loc.Codigo] = loc
 		}
-	}
-	return nil
+	})
 }
 
 func (i *ZipCodeImporter) loadDistricts(file string) error {
-	f, err := os.Open(file)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	decoder := transform.NewReader(f, charmap.ISO8859_1.NewDecoder())
-	reader := csv.NewReader(decoder)
-	reader.Comma = '@'
-	reader.LazyQuotes = true
+	stats := i.fileReport(file)
+	start := time.Now()
+	defer func() { stats.DurationMS += time.Since(start).Milliseconds() }()
 
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			continue
-		}
-		// 0 BAI_NU, 1 UFE_SG, 2 LOC_NU, 3 BAI_NO, 4 BAI_NO_ABREV
-		if len(record) < 4 {
-			continue
-		}
+	// 0 BAI_NU, 1 UFE_SG, 2 LOC_NU, 3 BAI_NO, 4 BAI_NO_ABREV
+	return i.readRecords(file, 4, stats, func(record []string, line int) {
 		district := &Bairro{
 			Codigo:           strings.TrimSpace(record[0]),
 			UF:               strings.TrimSpace(record[1]),
@@ -259,20 +801,64 @@ func (i *ZipCodeImporter) loadDistricts(file string) error {
 		if len(record) >= 5 {
 			district.NomeAbreviado = strings.TrimSpace(record[4])
 		}
+		if len(i.localities) > 0 {
+			i.locality(district.CodigoLocalidade, line, record, stats)
+		}
 		if district.Codigo != "" {
-			districts[district.Codigo] = district
+			i.districts[district.Codigo] = district
+		}
+	})
+}
+
+// storeLookups persists the localities and districts of the release, so they
+// can be exported along with the CEPs. A table is only replaced when its
+// file was read.
+func (i *ZipCodeImporter) storeLookups() error {
+	if len(i.localities) > 0 {
+		if err := replacePrefix(i.db, localityPrefix, i.localities); err != nil {
+			return fmt.Errorf("storing localities: %w", err)
+		}
+	}
+	if len(i.districts) > 0 {
+		if err := replacePrefix(i.db, districtPrefix, i.districts); err != nil {
+			return fmt.Errorf("storing districts: %w", err)
 		}
 	}
 	return nil
 }
 
-func (i *ZipCodeImporter) importLocalityCEPs() error {
+func replacePrefix[T any](db *badger.DB, prefix string, records map[string]*T) error {
+	if err := db.DropPrefix([]byte(prefix)); err != nil {
+		return err
+	}
 	wb := db.NewWriteBatch()
 	defer wb.Cancel()
+	for code, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := wb.Set([]byte(prefix+code), data); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+func (i *ZipCodeImporter) importLocalityCEPs(ctx context.Context) error {
+	stats := i.fileReport("LOG_LOCALIDADE.TXT")
+	defer i.publishFile(stats)
+	start := time.Now()
+	defer func() { stats.DurationMS += time.Since(start).Milliseconds() }()
+
+	log := i.loggerFor(ctx)
+	wb := i.db.NewWriteBatch()
+	defer wb.Cancel()
 	batchSize := 5000
 	count := 0
+	rank := fileRank(stats.File)
 
-	for _, loc := range localities {
+	for _, loc := range i.localities {
 		if loc.CEP == "" {
 			continue
 		}
@@ -289,376 +875,312 @@ func (i *ZipCodeImporter) importLocalityCEPs() error {
 			CodigoIBGE: loc.CodigoIBGE,
 			TipoOrigem: "localidade",
 		}
-		if err := i.writeCEPIfNew(wb, cep, cepComplete); err != nil {
-			i.logger.Warn("Warning while writing locality CEP", zap.String("cep", cep), zap.Error(err))
+		written, err := i.storeCEP(wb, cep, cepComplete, rank)
+		if err != nil {
+			log.Warn("Warning while writing locality CEP", zap.String("cep", cep), zap.Error(err))
+			stats.reject(ReasonWriteError, 0, err.Error(), []string{loc.Codigo, loc.UF, loc.Nome, loc.CEP})
 			continue
 		}
+		if written {
+			stats.Written++
+		} else {
+			stats.Duplicate++
+		}
 		count++
 		if count%batchSize == 0 {
-			if err := wb.Flush(); err != nil {
-				i.logger.Warn("Warning on flush (localities)", zap.Error(err))
+			if err := flush(ctx, wb, stats.File, count); err != nil {
+				log.Warn("Warning on flush (localities)", zap.Error(err))
+				stats.fail(err)
 			}
-			wb = db.NewWriteBatch()
-			i.logger.Info("Localities processed", zap.Int("count", count))
+			wb = i.db.NewWriteBatch()
+			log.Info("Localities processed", zap.Int("count", count))
+			i.events.Publish(ProgressEvent{Type: EventFileProgress, File: stats.File, Records: count})
 		}
 	}
-	if err := wb.Flush(); err != nil {
+	if err := flush(ctx, wb, stats.File, count); err != nil {
+		stats.fail(err)
 		return err
 	}
 	return nil
 }
 
-func (i *ZipCodeImporter) importStreets(file string) (int, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-
-	decoder := transform.NewReader(f, charmap.ISO8859_1.NewDecoder())
-	reader := csv.NewReader(decoder)
-	reader.Comma = '@'
-	reader.LazyQuotes = true
-
-	wb := db.NewWriteBatch()
-	defer wb.Cancel()
+// importRecords streams file, builds a CEPCompleto from every record whose
+// cepField holds a valid CEP and writes it in batches. It returns how many
+// records with a valid CEP were processed.
+//
+// A checkpoint is saved after every flush, along with the CEPs the batch
+// wrote. When resuming, the file report and the de-duplication state are
+// restored from them and the file is read from the checkpoint on.
+func (i *ZipCodeImporter) importRecords(ctx context.Context, file, label string, batchSize, minFields, cepField int, build func(record []string, cep string, line int, stats *FileReport) CEPCompleto) (int, error) {
+	stats := i.fileReport(file)
+	defer i.publishFile(stats)
+	start := time.Now()
+	defer func() { stats.DurationMS += time.Since(start).Milliseconds() }()
 
-	count := 0
-	batchSize := 10000
+	ctx, span := tracer.Start(ctx, "import.file", trace.WithAttributes(attribute.String("dne.file", filepath.Base(file))))
+	log := i.loggerFor(ctx)
 
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			continue
-		}
-		// 0 LOG_NU, 1 UFE_SG, 2 LOC_NU, 3 BAI_NU_INI, 4 BAI_NU_FIM, 5 LOG_NO,
-		// 6 LOG_COMPLEMENTO, 7 CEP, 8 TLO_TX, 9 LOG_STA_TLO, 10 LOG_NO_ABREV
-		if len(record) < 8 {
-			continue
-		}
-		cep := i.normalizeCEP(strings.TrimSpace(record[7]))
-		if cep == "" {
-			continue
-		}
-		streetType := ""
-		if len(record) >= 9 {
-			streetType = strings.TrimSpace(record[8])
-		}
-		useType := ""
-		if len(record) >= 10 {
-			useType = strings.TrimSpace(record[9])
-		}
-		districtCode := ""
-		if len(record) >= 4 {
-			districtCode = strings.TrimSpace(record[3])
-		}
-		localityCode := ""
-		if len(record) >= 3 {
-			localityCode = strings.TrimSpace(record[2])
-		}
-		streetName := strings.TrimSpace(record[5])
-		complement := ""
-		if len(record) >= 7 {
-			complement = strings.TrimSpace(record[6])
+	rank := fileRank(file)
+	resumeAt := i.checkpoints[filepath.Base(file)]
+	if resumeAt.Offset > 0 && resumeAt.Report == nil {
+		// Saved by a version whose offsets were not raw file positions.
+		log.Warn("Ignoring checkpoint without a report, importing file again", zap.String("file", file))
+		resumeAt = Checkpoint{}
+	}
+	if resumeAt.Offset > 0 {
+		log.Info("Resuming file from checkpoint", zap.String("file", file), zap.Int64("offset", resumeAt.Offset), zap.Int("records", resumeAt.Records), zap.Bool("done", resumeAt.Done))
+		if err := i.restoreCheckpoint(stats, resumeAt, rank); err != nil {
+			stats.fail(err)
+			tracing.End(span, err)
+			return 0, err
 		}
+	}
 
-		districtName := ""
-		if d, ok := districts[districtCode]; ok {
-			districtName = d.Nome
+	wb := i.db.NewWriteBatch()
+	defer func() { wb.Cancel() }()
+
+	count := resumeAt.Records
+	end := position{offset: resumeAt.Offset, line: resumeAt.Line}
+	var batch []byte
+	// flushBatch writes the batch with the CEPs it holds and saves a
+	// checkpoint after it.
+	flushBatch := func(done bool) error {
+		if len(batch) > 0 {
+			if err := wb.Set(checkpointCEPsKey(stats.File, count), batch); err != nil {
+				return err
+			}
 		}
-
-		cityName := ""
-		ibgeCode := ""
-		uf := ""
-		if l, ok := localities[localityCode]; ok {
-			cityName = l.Nome
-			uf = l.UF
-			ibgeCode = l.CodigoIBGE
+		if err := flush(ctx, wb, stats.File, count); err != nil {
+			return err
 		}
+		batch = nil
+		i.saveCheckpoint(log, file, end, count, done, stats)
+		return nil
+	}
 
-		completeStreet := streetName
-		if streetType != "" && (useType == "S" || useType == "s" || useType == "") {
-			completeStreet = strings.TrimSpace(streetType + " " + streetName)
-		} else if streetType != "" && (useType == "N" || useType == "n") {
-			completeStreet = streetName
-		}
+	err := i.scanRecords(file, end, minFields, stats, func(record []string, line int, pos position) {
+		end = pos
 
-		cepComplete := CEPCompleto{
-			CEP:            cep,
-			Logradouro:     completeStreet,
-			Complemento:    complement,
-			Bairro:         districtName,
-			Cidade:         cityName,
-			UF:             uf,
-			CodigoIBGE:     ibgeCode,
-			TipoLogradouro: streetType,
-			TipoOrigem:     "logradouro",
+		cep := i.normalizeCEP(strings.TrimSpace(record[cepField]))
+		if cep == "" {
+			stats.reject(ReasonInvalidCEP, line, fmt.Sprintf("invalid CEP %q", record[cepField]), record)
+			return
 		}
 
-		if err := i.writeCEPIfNew(wb, cep, cepComplete); err != nil {
+		data := build(record, cep, line, stats)
+		written, err := i.storeCEP(wb, cep, data, rank)
+		switch {
+		case err != nil:
+			stats.reject(ReasonWriteError, line, err.Error(), record)
+		case written:
+			stats.Written++
+			batch = append(batch, cep...)
+		default:
+			stats.Duplicate++
 		}
 
 		count++
 		if count%batchSize == 0 {
-			if err := wb.Flush(); err != nil {
-				i.logger.Warn("Warning on flush (streets)", zap.Error(err))
+			if err := flushBatch(false); err != nil {
+				log.Warn("Warning on flush ("+label+")", zap.Error(err))
+				stats.fail(err)
+				batch = nil
 			}
-			wb = db.NewWriteBatch()
-			i.logger.Info("Processed (streets)", zap.Int("count", count))
+			wb = i.db.NewWriteBatch()
+			log.Info("Processed ("+label+")", zap.String("file", file), zap.Int("count", count))
+			i.events.Publish(ProgressEvent{Type: EventFileProgress, File: stats.File, Records: count})
 		}
+	})
+	if err != nil {
+		tracing.End(span, err)
+		return 0, err
 	}
 
-	if err := wb.Flush(); err != nil {
+	if err := flushBatch(true); err != nil {
+		stats.fail(err)
+		tracing.End(span, err)
 		return count, err
 	}
+	span.SetAttributes(attribute.Int("dne.records", count))
+	span.End()
 	return count, nil
 }
 
-func (i *ZipCodeImporter) importLargeUsers(file string) (int, error) {
-	f, err := os.Open(file)
+// restoreCheckpoint brings the report of a file and the CEPs it wrote back
+// to where an interrupted import left them at cp. Those CEPs are counted
+// from the records already in the store.
+func (i *ZipCodeImporter) restoreCheckpoint(stats *FileReport, cp Checkpoint, rank int) error {
+	ceps, err := loadCheckpointCEPs(i.db, cp.File, cp.Records)
 	if err != nil {
-		return 0, err
+		return fmt.Errorf("loading checkpoint of %s: %w", cp.File, err)
 	}
-	defer f.Close()
 
-	decoder := transform.NewReader(f, charmap.ISO8859_1.NewDecoder())
-	reader := csv.NewReader(decoder)
-	reader.Comma = '@'
-	reader.LazyQuotes = true
+	report := *cp.Report
+	report.File = stats.File
+	*stats = report
 
-	wb := db.NewWriteBatch()
-	defer wb.Cancel()
+	return i.db.View(func(txn *badger.Txn) error {
+		for _, cep := range ceps {
+			if !i.markSeen(cep, rank) {
+				continue
+			}
+			item, err := txn.Get([]byte("cep:" + cep))
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			var data CEPCompleto
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &data)
+			}); err != nil {
+				return err
+			}
+			i.counts.add(&data)
+		}
+		return nil
+	})
+}
 
-	count := 0
-	batchSize := 5000
+func (i *ZipCodeImporter) saveCheckpoint(log *zap.Logger, file string, end position, records int, done bool, stats *FileReport) {
+	report := *stats
+	cp := Checkpoint{File: filepath.Base(file), Offset: end.offset, Line: end.line, Records: records, Done: done, Report: &report}
+	if err := saveCheckpoint(i.db, cp); err != nil {
+		log.Warn("Failed to save checkpoint", zap.String("file", file), zap.Error(err))
+	}
+}
 
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			continue
-		}
-		// 0 GRU_NU, 1 UFE_SG, 2 LOC_NU, 3 BAI_NU, 4 LOG_NU, 5 GRU_NO, 6 GRU_ENDERECO, 7 CEP, 8 GRU_NO_ABREV
-		if len(record) < 8 {
-			continue
+func (i *ZipCodeImporter) importStreets(ctx context.Context, file string) (int, error) {
+	// 0 LOG_NU, 1 UFE_SG, 2 LOC_NU, 3 BAI_NU_INI, 4 BAI_NU_FIM, 5 LOG_NO,
+	// 6 LOG_COMPLEMENTO, 7 CEP, 8 TLO_TX, 9 LOG_STA_TLO, 10 LOG_NO_ABREV
+	return i.importRecords(ctx, file, "streets", 10000, 8, 7, func(record []string, cep string, line int, stats *FileReport) CEPCompleto {
+		streetType := ""
+		if len(record) >= 9 {
+			streetType = strings.TrimSpace(record[8])
 		}
-		cep := i.normalizeCEP(strings.TrimSpace(record[7]))
-		if cep == "" {
-			continue
+		useType := ""
+		if len(record) >= 10 {
+			useType = strings.TrimSpace(record[9])
 		}
 		districtCode := strings.TrimSpace(record[3])
 		localityCode := strings.TrimSpace(record[2])
-		largeUserName := strings.TrimSpace(record[5])
-		largeUserAddress := strings.TrimSpace(record[6])
-
-		districtName := ""
-		if d, ok := districts[districtCode]; ok {
-			districtName = d.Nome
-		}
-		cityName := ""
-		uf := ""
-		ibgeCode := ""
-		if l, ok := localities[localityCode]; ok {
-			cityName = l.Nome
-			uf = l.UF
-			ibgeCode = l.CodigoIBGE
-		}
+		streetName := strings.TrimSpace(record[5])
+		complement := strings.TrimSpace(record[6])
 
-		cepComplete := CEPCompleto{
-			CEP:         cep,
-			Logradouro:  largeUserAddress,
-			Complemento: "",
-			Bairro:      districtName,
-			Cidade:      cityName,
-			UF:          uf,
-			CodigoIBGE:  ibgeCode,
-			TipoOrigem:  "grande_usuario",
-			NomeOrigem:  largeUserName,
-		}
+		district := i.district(districtCode, line, record, stats)
+		locality := i.locality(localityCode, line, record, stats)
 
-		if err := i.writeCEPIfNew(wb, cep, cepComplete); err != nil {
+		completeStreet := streetName
+		if streetType != "" && (useType == "S" || useType == "s" || useType == "") {
+			completeStreet = strings.TrimSpace(streetType + " " + streetName)
+		} else if streetType != "" && (useType == "N" || useType == "n") {
+			completeStreet = streetName
 		}
 
-		count++
-		if count%batchSize == 0 {
-			if err := wb.Flush(); err != nil {
-				i.logger.Warn("Warning on flush (large users)", zap.Error(err))
-			}
-			wb = db.NewWriteBatch()
-			i.logger.Info("Processed (large users)", zap.Int("count", count))
+		return CEPCompleto{
+			CEP:            cep,
+			Logradouro:     completeStreet,
+			Complemento:    complement,
+			Bairro:         district.Nome,
+			Cidade:         locality.Nome,
+			UF:             locality.UF,
+			CodigoIBGE:     locality.CodigoIBGE,
+			TipoLogradouro: streetType,
+			TipoOrigem:     "logradouro",
 		}
-	}
-
-	if err := wb.Flush(); err != nil {
-		return count, err
-	}
-	return count, nil
+	})
 }
 
-func (i *ZipCodeImporter) importOperationalUnits(file string) (int, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-
-	decoder := transform.NewReader(f, charmap.ISO8859_1.NewDecoder())
-	reader := csv.NewReader(decoder)
-	reader.Comma = '@'
-	reader.LazyQuotes = true
-
-	wb := db.NewWriteBatch()
-	defer wb.Cancel()
+func (i *ZipCodeImporter) importLargeUsers(ctx context.Context, file string) (int, error) {
+	// 0 GRU_NU, 1 UFE_SG, 2 LOC_NU, 3 BAI_NU, 4 LOG_NU, 5 GRU_NO, 6 GRU_ENDERECO, 7 CEP, 8 GRU_NO_ABREV
+	return i.importRecords(ctx, file, "large users", 5000, 8, 7, func(record []string, cep string, line int, stats *FileReport) CEPCompleto {
+		district := i.district(strings.TrimSpace(record[3]), line, record, stats)
+		locality := i.locality(strings.TrimSpace(record[2]), line, record, stats)
 
-	count := 0
-	batchSize := 5000
-
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			continue
-		}
-		// 0 UOP_NU, 1 UFE_SG, 2 LOC_NU, 3 BAI_NU, 4 LOG_NU, 5 UOP_NO, 6 UOP_ENDERECO, 7 CEP, 8 UOP_IN_CP, 9 UOP_NO_ABREV
-		if len(record) < 8 {
-			continue
-		}
-		cep := i.normalizeCEP(strings.TrimSpace(record[7]))
-		if cep == "" {
-			continue
+		return CEPCompleto{
+			CEP:         cep,
+			Logradouro:  strings.TrimSpace(record[6]),
+			Complemento: "",
+			Bairro:      district.Nome,
+			Cidade:      locality.Nome,
+			UF:          locality.UF,
+			CodigoIBGE:  locality.CodigoIBGE,
+			TipoOrigem:  "grande_usuario",
+			NomeOrigem:  strings.TrimSpace(record[5]),
 		}
-		districtCode := strings.TrimSpace(record[3])
-		localityCode := strings.TrimSpace(record[2])
-		uopName := strings.TrimSpace(record[5])
-		uopAddress := strings.TrimSpace(record[6])
+	})
+}
 
-		districtName := ""
-		if d, ok := districts[districtCode]; ok {
-			districtName = d.Nome
-		}
-		cityName := ""
-		uf := ""
-		ibgeCode := ""
-		if l, ok := localities[localityCode]; ok {
-			cityName = l.Nome
-			uf = l.UF
-			ibgeCode = l.CodigoIBGE
-		}
+func (i *ZipCodeImporter) importOperationalUnits(ctx context.Context, file string) (int, error) {
+	// 0 UOP_NU, 1 UFE_SG, 2 LOC_NU, 3 BAI_NU, 4 LOG_NU, 5 UOP_NO, 6 UOP_ENDERECO, 7 CEP, 8 UOP_IN_CP, 9 UOP_NO_ABREV
+	return i.importRecords(ctx, file, "UOP", 5000, 8, 7, func(record []string, cep string, line int, stats *FileReport) CEPCompleto {
+		district := i.district(strings.TrimSpace(record[3]), line, record, stats)
+		locality := i.locality(strings.TrimSpace(record[2]), line, record, stats)
 
-		cepComplete := CEPCompleto{
+		return CEPCompleto{
 			CEP:         cep,
-			Logradouro:  uopAddress,
+			Logradouro:  strings.TrimSpace(record[6]),
 			Complemento: "",
-			Bairro:      districtName,
-			Cidade:      cityName,
-			UF:          uf,
-			CodigoIBGE:  ibgeCode,
+			Bairro:      district.Nome,
+			Cidade:      locality.Nome,
+			UF:          locality.UF,
+			CodigoIBGE:  locality.CodigoIBGE,
 			TipoOrigem:  "unid_oper",
-			NomeOrigem:  uopName,
-		}
-
-		if err := i.writeCEPIfNew(wb, cep, cepComplete); err != nil {
+			NomeOrigem:  strings.TrimSpace(record[5]),
 		}
-
-		count++
-		if count%batchSize == 0 {
-			if err := wb.Flush(); err != nil {
-				i.logger.Warn("Warning on flush (UOP)", zap.Error(err))
-			}
-			wb = db.NewWriteBatch()
-			i.logger.Info("Processed (UOP)", zap.Int("count", count))
-		}
-	}
-
-	if err := wb.Flush(); err != nil {
-		return count, err
-	}
-	return count, nil
+	})
 }
 
-func (i *ZipCodeImporter) importCPC(file string) (int, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-
-	decoder := transform.NewReader(f, charmap.ISO8859_1.NewDecoder())
-	reader := csv.NewReader(decoder)
-	reader.Comma = '@'
-	reader.LazyQuotes = true
-
-	wb := db.NewWriteBatch()
-	defer wb.Cancel()
-
-	count := 0
-	batchSize := 5000
+func (i *ZipCodeImporter) importCPC(ctx context.Context, file string) (int, error) {
+	// 0 CPC_NU, 1 UFE_SG, 2 LOC_NU, 3 CPC_NO, 4 CPC_ENDERECO, 5 CEP
+	return i.importRecords(ctx, file, "CPC", 5000, 6, 5, func(record []string, cep string, line int, stats *FileReport) CEPCompleto {
+		locality := i.locality(strings.TrimSpace(record[2]), line, record, stats)
 
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			continue
-		}
-		// 0 CPC_NU, 1 UFE_SG, 2 LOC_NU, 3 CPC_NO, 4 CPC_ENDERECO, 5 CEP
-		if len(record) < 6 {
-			continue
-		}
-		cep := i.normalizeCEP(strings.TrimSpace(record[5]))
-		if cep == "" {
-			continue
-		}
-		localityCode := strings.TrimSpace(record[2])
-		cpcName := strings.TrimSpace(record[3])
-		cpcAddress := strings.TrimSpace(record[4])
-
-		cityName := ""
-		uf := ""
-		ibgeCode := ""
-		if l, ok := localities[localityCode]; ok {
-			cityName = l.Nome
-			uf = l.UF
-			ibgeCode = l.CodigoIBGE
-		}
-
-		cepComplete := CEPCompleto{
+		return CEPCompleto{
 			CEP:         cep,
-			Logradouro:  cpcAddress,
+			Logradouro:  strings.TrimSpace(record[4]),
 			Complemento: "",
 			Bairro:      "",
-			Cidade:      cityName,
-			UF:          uf,
-			CodigoIBGE:  ibgeCode,
+			Cidade:      locality.Nome,
+			UF:          locality.UF,
+			CodigoIBGE:  locality.CodigoIBGE,
 			TipoOrigem:  "cpc",
-			NomeOrigem:  cpcName,
+			NomeOrigem:  strings.TrimSpace(record[3]),
 		}
+	})
+}
 
-		if err := i.writeCEPIfNew(wb, cep, cepComplete); err != nil {
-		}
+// locality resolves a LOC_NU, flagging the record as orphaned when the code
+// is not in LOG_LOCALIDADE.TXT.
+func (i *ZipCodeImporter) locality(code string, line int, record []string, stats *FileReport) Localidade {
+	if l, ok := i.localities[code]; ok {
+		return *l
+	}
+	stats.reject(ReasonOrphaned, line, fmt.Sprintf("unknown LOC_NU %q", code), record)
+	return Localidade{}
+}
 
-		count++
-		if count%batchSize == 0 {
-			if err := wb.Flush(); err != nil {
-				i.logger.Warn("Warning on flush (CPC)", zap.Error(err))
-			}
-			wb = db.NewWriteBatch()
-			i.logger.Info("Processed (CPC)", zap.Int("count", count))
-		}
+// district resolves a BAI_NU. An empty code is not a reference and is not
+// flagged.
+func (i *ZipCodeImporter) district(code string, line int, record []string, stats *FileReport) Bairro {
+	if code == "" {
+		return Bairro{}
 	}
+	if d, ok := i.districts[code]; ok {
+		return *d
+	}
+	stats.reject(ReasonOrphaned, line, fmt.Sprintf("unknown BAI_NU %q", code), record)
+	return Bairro{}
+}
 
-	if err := wb.Flush(); err != nil {
-		return count, err
+// open reads a DNE file from the configured source. Without a source (as in
+// tests calling the loaders directly) file is a path on disk.
+func (i *ZipCodeImporter) open(file string) (io.ReadCloser, error) {
+	if i.source == nil {
+		return os.Open(file)
 	}
-	return count, nil
+	return i.source.Open(file)
 }
 
 func (i *ZipCodeImporter) normalizeCEP(raw string) string {
@@ -670,20 +1192,92 @@ func (i *ZipCodeImporter) normalizeCEP(raw string) string {
 }
 
 func (i *ZipCodeImporter) writeCEPIfNew(wb *badger.WriteBatch, cep string, data CEPCompleto) error {
+	_, err := i.storeCEP(wb, cep, data, fileRank(""))
+	return err
+}
+
+// storeCEP writes data, read from a file of the given rank, unless cep was
+// already imported in this run or belongs to another file, and reports
+// whether it was written. The CEP is only marked seen once all of its
+// writes succeed; on failure it is released for other records.
+func (i *ZipCodeImporter) storeCEP(wb *badger.WriteBatch, cep string, data CEPCompleto, rank int) (bool, error) {
 	if cep == "" {
-		return fmt.Errorf("empty cep")
+		return false, fmt.Errorf("empty cep")
 	}
-	if seenCEPs[cep] {
-		return nil
+	if !i.reserve(cep, rank) {
+		return false, nil
 	}
+	if err := i.writeCEP(wb, cep, data); err != nil {
+		i.unmarkSeen(cep)
+		return false, err
+	}
+	i.markSeen(cep, rank)
+	i.counts.add(&data)
+	return true, nil
+}
+
+// writeCEP adds the record of cep, its city index entry and, when changes
+// are tracked, its history to wb.
+func (i *ZipCodeImporter) writeCEP(wb *badger.WriteBatch, cep string, data CEPCompleto) error {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
-	key := []byte("cep:" + cep)
-	if err := wb.Set(key, jsonData); err != nil {
+	if i.tracksChanges() {
+		if err := i.trackChange(wb, cep, data, jsonData); err != nil {
+			return err
+		}
+	}
+	if err := wb.Set([]byte("cep:"+cep), jsonData); err != nil {
 		return err
 	}
-	seenCEPs[cep] = true
+	if data.Cidade != "" {
+		if err := wb.Set(cityIndexKey(data.Cidade, cep), []byte(data.UF)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// claim reserves cep for a file of the given rank unless a lower ranked
+// file claimed or wrote it.
+func (i *ZipCodeImporter) claim(cep string, rank int) {
+	i.seenMu.Lock()
+	defer i.seenMu.Unlock()
+	if c, ok := i.seenCEPs[cep]; !ok || (!c.written && rank < c.rank) {
+		i.seenCEPs[cep] = cepClaim{rank: rank}
+	}
+}
+
+// reserve claims cep for a file of the given rank while its record is
+// written, and reports whether the file may write it: a CEP claimed by
+// another file, or already written, is a duplicate.
+func (i *ZipCodeImporter) reserve(cep string, rank int) bool {
+	i.seenMu.Lock()
+	defer i.seenMu.Unlock()
+	if c, ok := i.seenCEPs[cep]; ok {
+		return !c.written && c.rank == rank
+	}
+	i.seenCEPs[cep] = cepClaim{rank: rank}
+	return true
+}
+
+// markSeen records cep as imported from a file of the given rank and
+// reports whether it was new. A CEP claimed by another file, or already
+// written, is a duplicate.
+func (i *ZipCodeImporter) markSeen(cep string, rank int) bool {
+	i.seenMu.Lock()
+	defer i.seenMu.Unlock()
+	if c, ok := i.seenCEPs[cep]; ok && (c.written || c.rank != rank) {
+		return false
+	}
+	i.seenCEPs[cep] = cepClaim{rank: rank, written: true}
+	return true
+}
+
+// unmarkSeen releases cep after its record failed to be written.
+func (i *ZipCodeImporter) unmarkSeen(cep string) {
+	i.seenMu.Lock()
+	defer i.seenMu.Unlock()
+	delete(i.seenCEPs, cep)
+}
@@ -1,15 +1,21 @@
 package zipcodes
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/brasilcep/api/logger"
 	badger "github.com/dgraph-io/badger/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"golang.org/x/text/encoding/charmap"
 )
 
@@ -32,17 +38,12 @@ func setupTestDB(t *testing.T) (*badger.DB, func()) {
 func setupImporter(t *testing.T) (*ZipCodeImporter, func()) {
 	testDB, cleanup := setupTestDB(t)
 
-	// Reset global state
-	localities = make(map[string]*Localidade)
-	districts = make(map[string]*Bairro)
-	seenCEPs = make(map[string]bool)
-	db = testDB
-
 	testLogger := logger.NewLogger("info")
 	importer := &ZipCodeImporter{
 		db:     testDB,
 		logger: testLogger,
 	}
+	importer.resetState()
 
 	return importer, cleanup
 }
@@ -111,7 +112,7 @@ func TestWriteCEPIfNew(t *testing.T) {
 	defer cleanup()
 
 	t.Run("write new CEP successfully", func(t *testing.T) {
-		seenCEPs = make(map[string]bool)
+		importer.seenCEPs = make(map[string]cepClaim)
 		wb := importer.db.NewWriteBatch()
 		defer wb.Cancel()
 
@@ -126,7 +127,7 @@ func TestWriteCEPIfNew(t *testing.T) {
 
 		err := importer.writeCEPIfNew(wb, "12345678", cepData)
 		assert.NoError(t, err)
-		assert.True(t, seenCEPs["12345678"])
+		assert.True(t, importer.seenCEPs["12345678"].written)
 
 		err = wb.Flush()
 		assert.NoError(t, err)
@@ -151,8 +152,8 @@ func TestWriteCEPIfNew(t *testing.T) {
 	})
 
 	t.Run("skip already seen CEP", func(t *testing.T) {
-		seenCEPs = make(map[string]bool)
-		seenCEPs["99999999"] = true
+		importer.seenCEPs = make(map[string]cepClaim)
+		importer.seenCEPs["99999999"] = cepClaim{written: true}
 
 		wb := importer.db.NewWriteBatch()
 		defer wb.Cancel()
@@ -166,8 +167,27 @@ func TestWriteCEPIfNew(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("CEP is not seen when its city index fails", func(t *testing.T) {
+		importer.seenCEPs = make(map[string]cepClaim)
+		wb := importer.db.NewWriteBatch()
+		defer wb.Cancel()
+
+		// Badger refuses keys this long, so only the city index write fails.
+		cepData := CEPCompleto{CEP: "88888888", Cidade: strings.Repeat("x", 70000), UF: "SC"}
+		written, err := importer.storeCEP(wb, "88888888", cepData, 0)
+		assert.Error(t, err)
+		assert.False(t, written)
+		assert.NotContains(t, importer.seenCEPs, "88888888")
+
+		cepData.Cidade = "Florianópolis"
+		written, err = importer.storeCEP(wb, "88888888", cepData, 0)
+		assert.NoError(t, err)
+		assert.True(t, written)
+		assert.True(t, importer.seenCEPs["88888888"].written)
+	})
+
 	t.Run("return error for empty CEP", func(t *testing.T) {
-		seenCEPs = make(map[string]bool)
+		importer.seenCEPs = make(map[string]cepClaim)
 		wb := importer.db.NewWriteBatch()
 		defer wb.Cancel()
 
@@ -190,7 +210,7 @@ func TestLoadLocalities(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 
 	t.Run("load valid localities file", func(t *testing.T) {
-		localities = make(map[string]*Localidade)
+		importer.localities = make(map[string]*Localidade)
 
 		localitiesFile := filepath.Join(tmpDir, "LOG_LOCALIDADE.TXT")
 		content := "001@SP@São Paulo@01000-000@1@M@@SP@3550308\n" +
@@ -207,9 +227,9 @@ func TestLoadLocalities(t *testing.T) {
 
 		err = importer.loadLocalities(localitiesFile)
 		assert.NoError(t, err)
-		assert.Equal(t, 3, len(localities))
+		assert.Equal(t, 3, len(importer.localities))
 
-		sp := localities["001"]
+		sp := importer.localities["001"]
 		assert.NotNil(t, sp)
 		assert.Equal(t, "SP", sp.UF)
 		assert.Equal(t, "São Paulo", sp.Nome)
@@ -218,7 +238,7 @@ func TestLoadLocalities(t *testing.T) {
 	})
 
 	t.Run("skip invalid lines", func(t *testing.T) {
-		localities = make(map[string]*Localidade)
+		importer.localities = make(map[string]*Localidade)
 
 		localitiesFile := filepath.Join(tmpDir, "LOG_LOCALIDADE_INVALID.TXT")
 		content := "001@SP@São Paulo@01000-000@1@M@@SP@3550308\n" +
@@ -236,11 +256,11 @@ func TestLoadLocalities(t *testing.T) {
 
 		err = importer.loadLocalities(localitiesFile)
 		assert.NoError(t, err)
-		assert.Equal(t, 2, len(localities))
+		assert.Equal(t, 2, len(importer.localities))
 	})
 
 	t.Run("return error for non-existent file", func(t *testing.T) {
-		localities = make(map[string]*Localidade)
+		importer.localities = make(map[string]*Localidade)
 		err := importer.loadLocalities("/non/existent/file.txt")
 		assert.Error(t, err)
 	})
@@ -255,7 +275,7 @@ func TestLoadDistricts(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 
 	t.Run("load valid districts file", func(t *testing.T) {
-		districts = make(map[string]*Bairro)
+		importer.districts = make(map[string]*Bairro)
 
 		districtsFile := filepath.Join(tmpDir, "LOG_BAIRRO.TXT")
 		content := "001@SP@001@Centro@Ctr\n" +
@@ -267,9 +287,9 @@ func TestLoadDistricts(t *testing.T) {
 
 		err = importer.loadDistricts(districtsFile)
 		assert.NoError(t, err)
-		assert.Equal(t, 3, len(districts))
+		assert.Equal(t, 3, len(importer.districts))
 
-		centro := districts["001"]
+		centro := importer.districts["001"]
 		assert.NotNil(t, centro)
 		assert.Equal(t, "SP", centro.UF)
 		assert.Equal(t, "001", centro.CodigoLocalidade)
@@ -278,7 +298,7 @@ func TestLoadDistricts(t *testing.T) {
 	})
 
 	t.Run("skip invalid lines", func(t *testing.T) {
-		districts = make(map[string]*Bairro)
+		importer.districts = make(map[string]*Bairro)
 
 		districtsFile := filepath.Join(tmpDir, "LOG_BAIRRO_INVALID.TXT")
 		content := "001@SP@001@Centro@Ctr\n" +
@@ -290,11 +310,11 @@ func TestLoadDistricts(t *testing.T) {
 
 		err = importer.loadDistricts(districtsFile)
 		assert.NoError(t, err)
-		assert.Equal(t, 1, len(districts))
+		assert.Equal(t, 1, len(importer.districts))
 	})
 
 	t.Run("return error for non-existent file", func(t *testing.T) {
-		districts = make(map[string]*Bairro)
+		importer.districts = make(map[string]*Bairro)
 		err := importer.loadDistricts("/non/existent/file.txt")
 		assert.Error(t, err)
 	})
@@ -305,17 +325,17 @@ func TestImportLocalityCEPs(t *testing.T) {
 	defer cleanup()
 
 	t.Run("import locality CEPs successfully", func(t *testing.T) {
-		localities = make(map[string]*Localidade)
-		seenCEPs = make(map[string]bool)
+		importer.localities = make(map[string]*Localidade)
+		importer.seenCEPs = make(map[string]cepClaim)
 
-		localities["001"] = &Localidade{
+		importer.localities["001"] = &Localidade{
 			Codigo:     "001",
 			UF:         "SP",
 			Nome:       "São Paulo",
 			CEP:        "01000000",
 			CodigoIBGE: "3550308",
 		}
-		localities["002"] = &Localidade{
+		importer.localities["002"] = &Localidade{
 			Codigo:     "002",
 			UF:         "RJ",
 			Nome:       "Rio de Janeiro",
@@ -323,9 +343,9 @@ func TestImportLocalityCEPs(t *testing.T) {
 			CodigoIBGE: "3304557",
 		}
 
-		err := importer.importLocalityCEPs()
+		err := importer.importLocalityCEPs(context.Background())
 		assert.NoError(t, err)
-		assert.Equal(t, 2, len(seenCEPs))
+		assert.Equal(t, 2, len(importer.seenCEPs))
 
 		err = importer.db.View(func(txn *badger.Txn) error {
 			item, err := txn.Get([]byte("cep:01000000"))
@@ -349,19 +369,19 @@ func TestImportLocalityCEPs(t *testing.T) {
 	})
 
 	t.Run("skip localities without CEP", func(t *testing.T) {
-		localities = make(map[string]*Localidade)
-		seenCEPs = make(map[string]bool)
+		importer.localities = make(map[string]*Localidade)
+		importer.seenCEPs = make(map[string]cepClaim)
 
-		localities["001"] = &Localidade{
+		importer.localities["001"] = &Localidade{
 			Codigo: "001",
 			UF:     "SP",
 			Nome:   "São Paulo",
 			CEP:    "",
 		}
 
-		err := importer.importLocalityCEPs()
+		err := importer.importLocalityCEPs(context.Background())
 		assert.NoError(t, err)
-		assert.Equal(t, 0, len(seenCEPs))
+		assert.Equal(t, 0, len(importer.seenCEPs))
 	})
 }
 
@@ -374,17 +394,17 @@ func TestImportStreets(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 
 	t.Run("import streets with type usage", func(t *testing.T) {
-		localities = make(map[string]*Localidade)
-		districts = make(map[string]*Bairro)
-		seenCEPs = make(map[string]bool)
+		importer.localities = make(map[string]*Localidade)
+		importer.districts = make(map[string]*Bairro)
+		importer.seenCEPs = make(map[string]cepClaim)
 
-		localities["001"] = &Localidade{
+		importer.localities["001"] = &Localidade{
 			Codigo:     "001",
 			UF:         "SP",
 			Nome:       "São Paulo",
 			CodigoIBGE: "3550308",
 		}
-		districts["001"] = &Bairro{
+		importer.districts["001"] = &Bairro{
 			Codigo: "001",
 			Nome:   "Centro",
 		}
@@ -395,7 +415,7 @@ func TestImportStreets(t *testing.T) {
 		err := os.WriteFile(streetsFile, []byte(content), 0644)
 		require.NoError(t, err)
 
-		count, err := importer.importStreets(streetsFile)
+		count, err := importer.importStreets(context.Background(), streetsFile)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, count)
 
@@ -423,11 +443,11 @@ func TestImportStreets(t *testing.T) {
 	})
 
 	t.Run("import streets without type usage", func(t *testing.T) {
-		localities = make(map[string]*Localidade)
-		districts = make(map[string]*Bairro)
-		seenCEPs = make(map[string]bool)
+		importer.localities = make(map[string]*Localidade)
+		importer.districts = make(map[string]*Bairro)
+		importer.seenCEPs = make(map[string]cepClaim)
 
-		localities["001"] = &Localidade{
+		importer.localities["001"] = &Localidade{
 			Codigo: "001",
 			UF:     "SP",
 			Nome:   "São Paulo",
@@ -439,7 +459,7 @@ func TestImportStreets(t *testing.T) {
 		err := os.WriteFile(streetsFile, []byte(content), 0644)
 		require.NoError(t, err)
 
-		count, err := importer.importStreets(streetsFile)
+		count, err := importer.importStreets(context.Background(), streetsFile)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, count)
 
@@ -461,7 +481,7 @@ func TestImportStreets(t *testing.T) {
 	})
 
 	t.Run("skip streets without CEP", func(t *testing.T) {
-		seenCEPs = make(map[string]bool)
+		importer.seenCEPs = make(map[string]cepClaim)
 
 		streetsFile := filepath.Join(tmpDir, "LOG_LOGRADOURO_NO_CEP.TXT")
 		content := "003@SP@001@@@Teste Rua@@@@Rua@S@\n"
@@ -469,7 +489,7 @@ func TestImportStreets(t *testing.T) {
 		err := os.WriteFile(streetsFile, []byte(content), 0644)
 		require.NoError(t, err)
 
-		count, err := importer.importStreets(streetsFile)
+		count, err := importer.importStreets(context.Background(), streetsFile)
 		assert.NoError(t, err)
 		assert.Equal(t, 0, count)
 	})
@@ -484,17 +504,17 @@ func TestImportLargeUsers(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 
 	t.Run("import large users successfully", func(t *testing.T) {
-		localities = make(map[string]*Localidade)
-		districts = make(map[string]*Bairro)
-		seenCEPs = make(map[string]bool)
+		importer.localities = make(map[string]*Localidade)
+		importer.districts = make(map[string]*Bairro)
+		importer.seenCEPs = make(map[string]cepClaim)
 
-		localities["001"] = &Localidade{
+		importer.localities["001"] = &Localidade{
 			Codigo:     "001",
 			UF:         "SP",
 			Nome:       "São Paulo",
 			CodigoIBGE: "3550308",
 		}
-		districts["001"] = &Bairro{
+		importer.districts["001"] = &Bairro{
 			Codigo: "001",
 			Nome:   "Centro",
 		}
@@ -505,7 +525,7 @@ func TestImportLargeUsers(t *testing.T) {
 		err := os.WriteFile(largeUsersFile, []byte(content), 0644)
 		require.NoError(t, err)
 
-		count, err := importer.importLargeUsers(largeUsersFile)
+		count, err := importer.importLargeUsers(context.Background(), largeUsersFile)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, count)
 
@@ -540,17 +560,17 @@ func TestImportOperationalUnits(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 
 	t.Run("import operational units successfully", func(t *testing.T) {
-		localities = make(map[string]*Localidade)
-		districts = make(map[string]*Bairro)
-		seenCEPs = make(map[string]bool)
+		importer.localities = make(map[string]*Localidade)
+		importer.districts = make(map[string]*Bairro)
+		importer.seenCEPs = make(map[string]cepClaim)
 
-		localities["001"] = &Localidade{
+		importer.localities["001"] = &Localidade{
 			Codigo:     "001",
 			UF:         "RJ",
 			Nome:       "Rio de Janeiro",
 			CodigoIBGE: "3304557",
 		}
-		districts["002"] = &Bairro{
+		importer.districts["002"] = &Bairro{
 			Codigo: "002",
 			Nome:   "Copacabana",
 		}
@@ -566,7 +586,7 @@ func TestImportOperationalUnits(t *testing.T) {
 		err = os.WriteFile(uopFile, []byte(encodedContent), 0644)
 		require.NoError(t, err)
 
-		count, err := importer.importOperationalUnits(uopFile)
+		count, err := importer.importOperationalUnits(context.Background(), uopFile)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, count)
 
@@ -601,10 +621,10 @@ func TestImportCPC(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 
 	t.Run("import CPC successfully", func(t *testing.T) {
-		localities = make(map[string]*Localidade)
-		seenCEPs = make(map[string]bool)
+		importer.localities = make(map[string]*Localidade)
+		importer.seenCEPs = make(map[string]cepClaim)
 
-		localities["001"] = &Localidade{
+		importer.localities["001"] = &Localidade{
 			Codigo:     "001",
 			UF:         "MG",
 			Nome:       "Belo Horizonte",
@@ -617,7 +637,7 @@ func TestImportCPC(t *testing.T) {
 		err := os.WriteFile(cpcFile, []byte(content), 0644)
 		require.NoError(t, err)
 
-		count, err := importer.importCPC(cpcFile)
+		count, err := importer.importCPC(context.Background(), cpcFile)
 		assert.NoError(t, err)
 		assert.Equal(t, 1, count)
 
@@ -643,3 +663,91 @@ func TestImportCPC(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestImportAllStreets(t *testing.T) {
+	importer, cleanup := setupImporter(t)
+	defer cleanup()
+
+	tmpDir, err := os.MkdirTemp("", "all-streets-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	importer.localities["001"] = &Localidade{Codigo: "001", UF: "SP", Nome: "São Paulo"}
+	importer.localities["002"] = &Localidade{Codigo: "002", UF: "RJ", Nome: "Rio de Janeiro"}
+
+	files := map[string]string{
+		"LOG_LOGRADOURO_SP.TXT": "001@SP@001@@@Paulista@@01310-100@Avenida@S@\n" +
+			"002@SP@001@@@Augusta@@01305-000@Rua@S@\n",
+		"LOG_LOGRADOURO_RJ.TXT": "003@RJ@002@@@Atlântica@@22070-000@Avenida@S@\n" +
+			"004@RJ@002@@@Duplicada@@01310-100@Rua@S@\n",
+		"LOG_LOGRADOURO_MG.TXT": "005@MG@003@@@Afonso Pena@@30130-000@Avenida@S@\n",
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644))
+	}
+
+	importer.source = &dirSource{path: tmpDir}
+	importer.workers = 3
+	core, logs := observer.New(zapcore.InfoLevel)
+	importer.logger = &logger.Logger{Logger: zap.New(core)}
+
+	ctx, span := sdktrace.NewTracerProvider().Tracer("test").Start(context.Background(), "import.streets")
+	total := importer.importAllStreets(ctx)
+	span.End()
+	assert.Equal(t, 5, total)
+	assert.Equal(t, 4, len(importer.seenCEPs))
+
+	// The workers log with the trace of the import.
+	entries := logs.FilterMessage("Streets imported for UF").All()
+	require.Len(t, entries, 3)
+	for _, entry := range entries {
+		assert.Equal(t, span.SpanContext().TraceID().String(), entry.ContextMap()["trace_id"])
+	}
+
+	for _, cep := range []string{"01310100", "01305000", "22070000", "30130000"} {
+		err := importer.db.View(func(txn *badger.Txn) error {
+			_, err := txn.Get([]byte("cep:" + cep))
+			return err
+		})
+		assert.NoError(t, err, cep)
+	}
+}
+
+func TestImportAllStreetsDuplicateWinner(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "duplicate-streets-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	// SP is scheduled first, but RJ ranks first and must win every run.
+	files := map[string]string{
+		"LOG_LOGRADOURO_SP.TXT": "001@SP@001@@@Paulista@@01310-100@Avenida@S@\n",
+		"LOG_LOGRADOURO_RJ.TXT": "002@RJ@002@@@Duplicada@@01310-100@Rua@S@\n",
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644))
+	}
+
+	for run := 0; run < 10; run++ {
+		importer, cleanup := setupImporter(t)
+		importer.localities["001"] = &Localidade{Codigo: "001", UF: "SP", Nome: "São Paulo"}
+		importer.localities["002"] = &Localidade{Codigo: "002", UF: "RJ", Nome: "Rio de Janeiro"}
+		importer.source = &dirSource{path: tmpDir}
+		importer.workers = 2
+
+		assert.Equal(t, 2, importer.importAllStreets(context.Background()))
+
+		var cep CEPCompleto
+		err := importer.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte("cep:01310100"))
+			if err != nil {
+				return err
+			}
+			return item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &cep)
+			})
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "RJ", cep.UF, "run %d", run)
+		cleanup()
+	}
+}